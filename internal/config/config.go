@@ -1,41 +1,227 @@
 package config
 
 import (
-	"log"
 	"os"
+	"slices"
 	"strconv"
+	"time"
+
+	"github.com/pseudoresonance/authserver/internal/logging"
 )
 
 type MainConfig struct {
-	BindAddress            string            `yaml:"bindAddress"`
-	BindPort               int               `yaml:"bindPort"`
-	ApiIps                 []string          `yaml:"apiIpRanges"`
-	MonitoringIpRanges     []string          `yaml:"monitoringIpRanges"`
-	PrivateIps             []string          `yaml:"privateIpRanges"`
-	QueryTokenKey          string            `yaml:"queryTokenKey"`
-	MediaMtxUrlBase        string            `yaml:"mediamtxApiBase"`
-	MediaMtxUrlBasePublish string            `yaml:"mediamtxApiBasePublish"`
-	ForwardAuth            ForwardAuthConfig `yaml:"forwardAuth"`
-	Database               DatabaseConfig    `yaml:"database"`
+	BindAddress            string                `yaml:"bindAddress"`
+	BindPort               int                   `yaml:"bindPort"`
+	ApiIps                 []string              `yaml:"apiIpRanges"`
+	MonitoringIpRanges     []string              `yaml:"monitoringIpRanges"`
+	PrivateIps             []string              `yaml:"privateIpRanges"`
+	QueryTokenKey          string                `yaml:"queryTokenKey"`
+	ConnectionLimitMode    string                `yaml:"connectionLimitMode"`
+	MediaMtxUrlBase        string                `yaml:"mediamtxApiBase"`
+	MediaMtxUrlBasePublish string                `yaml:"mediamtxApiBasePublish"`
+	MediaMtxInstances      []MediaMtxInstance    `yaml:"mediamtxInstances"`
+	ServiceIdentity        ServiceIdentityConfig `yaml:"serviceIdentity"`
+	Log                    LogConfig             `yaml:"log"`
+	ForwardAuth            ForwardAuthConfig     `yaml:"forwardAuth"`
+	Signing                SigningConfig         `yaml:"signing"`
+	Jwt                    JwtConfig             `yaml:"jwt"`
+	Api                    ApiConfig             `yaml:"api"`
+	Share                  ShareConfig           `yaml:"share"`
+	Database               DatabaseConfig        `yaml:"database"`
+	Audit                  AuditConfig           `yaml:"audit"`
+	Reconcile              ReconcileConfig       `yaml:"reconcile"`
+	Credentials            CredentialsConfig     `yaml:"credentials"`
+
+	// Path the config was loaded from, empty if not loaded from a file
+	path string
+}
+
+/*
+Named MediaMTX server, identified by the instance query parameter in its auth URL
+*/
+type MediaMtxInstance struct {
+	Name    string   `yaml:"name"`
+	ApiBase string   `yaml:"apiBase"`
+	Roles   []string `yaml:"roles"` // Actions handled by the server (read, publish, playback), all if empty
+
+	// Credentials for the API, the service identity if none are set
+	Username    string            `yaml:"username"`
+	Password    string            `yaml:"password"`
+	BearerToken string            `yaml:"bearerToken"`
+	Tls         MediaMtxTlsConfig `yaml:"tls"`
+}
+
+/*
+CA and client certificate for an API served over HTTPS, the system CAs and no client certificate if empty
+*/
+type MediaMtxTlsConfig struct {
+	CaFile   string `yaml:"caFile"`
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+/*
+Identity of this server for its own calls to the MediaMTX API, accepted by the auth endpoint for api actions from any IP
+*/
+type ServiceIdentityConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Token    string `yaml:"token"` // Bearer token, sent instead of the username and password if set
+}
+
+/*
+Whether the identity has a password or token, as it is unused otherwise
+*/
+func (s ServiceIdentityConfig) Enabled() bool {
+	return len(s.Password) > 0 || len(s.Token) > 0
+}
+
+/*
+Whether the instance handles the given action
+*/
+func (i MediaMtxInstance) HasRole(action string) bool {
+	return len(i.Roles) == 0 || slices.Contains(i.Roles, action)
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
 }
 
 type ForwardAuthConfig struct {
-	UriHeader string `yaml:"uriHeader"`
-	IpHeader  string `yaml:"ipHeader"`
-	BasePath  string `yaml:"basePath"`
+	UriHeader   string `yaml:"uriHeader"`
+	IpHeader    string `yaml:"ipHeader"`
+	TrustedHops int    `yaml:"trustedHops"`
+	BasePath    string `yaml:"basePath"`
+}
+
+type SigningConfig struct {
+	Keys      []SigningKey `yaml:"keys"`
+	ActiveKey string       `yaml:"activeKey"`
+	MaxTtl    int          `yaml:"maxTtl"`
+}
+
+type SigningKey struct {
+	Id     string `yaml:"id"`
+	Secret string `yaml:"secret"`
+}
+
+type JwtConfig struct {
+	JwksFile     string   `yaml:"jwksFile"`
+	Keys         []Jwk    `yaml:"keys"`
+	Algorithms   []string `yaml:"algorithms"`
+	Issuer       string   `yaml:"issuer"`
+	Audience     string   `yaml:"audience"`
+	PathsClaim   string   `yaml:"pathsClaim"`
+	ActionsClaim string   `yaml:"actionsClaim"`
+	ExpiryClaim  string   `yaml:"expiryClaim"`
+	Leeway       int      `yaml:"leeway"`
+}
+
+/*
+JSON Web Key, shared between inline config and JWKS files
+*/
+type Jwk struct {
+	Kty string `yaml:"kty" json:"kty"`
+	Kid string `yaml:"kid,omitempty" json:"kid,omitempty"`
+	Alg string `yaml:"alg,omitempty" json:"alg,omitempty"`
+	Use string `yaml:"use,omitempty" json:"use,omitempty"`
+	N   string `yaml:"n,omitempty" json:"n,omitempty"`
+	E   string `yaml:"e,omitempty" json:"e,omitempty"`
+	Crv string `yaml:"crv,omitempty" json:"crv,omitempty"`
+	X   string `yaml:"x,omitempty" json:"x,omitempty"`
+	Y   string `yaml:"y,omitempty" json:"y,omitempty"`
+}
+
+type ApiConfig struct {
+	Keys []ApiKey `yaml:"keys"`
+}
+
+type ApiKey struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+}
+
+type ShareConfig struct {
+	DefaultTtl            int               `yaml:"defaultTtl"`
+	MaxTtl                int               `yaml:"maxTtl"`
+	DefaultMaxConnections int               `yaml:"defaultMaxConnections"`
+	MaxConnections        int               `yaml:"maxConnections"`
+	Urls                  map[string]string `yaml:"urls"`
+	IpHeader              string            `yaml:"ipHeader"`
+	TrustedHops           int               `yaml:"trustedHops"`
 }
 
 type DatabaseConfig struct {
+	Backend                 string `yaml:"backend"`
+	SqlitePath              string `yaml:"sqlitePath"`
 	Hostname                string `yaml:"hostname"`
 	Port                    int    `yaml:"port"`
 	Database                string `yaml:"database"`
 	Username                string `yaml:"username"`
 	Password                string `yaml:"password"`
+	AutoMigrate             bool   `yaml:"autoMigrate"`
+	ChangeDetection         string `yaml:"changeDetection"`
 	PollInterval            int    `yaml:"pollInterval"`
 	CacheDuration           int    `yaml:"cacheDuration"`
 	ConnectionTrackDuration int    `yaml:"connectionTrackDuration"`
 }
 
+/*
+Persistent log of auth decisions, written to the database in batches
+*/
+type AuditConfig struct {
+	Enabled       bool `yaml:"enabled"`
+	QueueSize     int  `yaml:"queueSize"`
+	BatchSize     int  `yaml:"batchSize"`
+	FlushInterval int  `yaml:"flushInterval"`
+	RetentionDays int  `yaml:"retentionDays"`
+}
+
+/*
+Matching of connections already on MediaMTX to credentials when the server starts
+*/
+type ReconcileConfig struct {
+	OnStartup bool `yaml:"onStartup"`
+	DryRun    bool `yaml:"dryRun"`
+}
+
+/*
+Static credentials used by the file backend
+*/
+type CredentialsConfig struct {
+	Tokens []FileToken `yaml:"tokens"`
+	Users  []FileUser  `yaml:"users"`
+}
+
+type FileToken struct {
+	Path           string     `yaml:"path"`
+	Action         string     `yaml:"action"`
+	Token          string     `yaml:"token"`
+	ValidFrom      *time.Time `yaml:"validFrom,omitempty"`
+	ExpiresAt      *time.Time `yaml:"expiresAt,omitempty"`
+	MaxConnections *int       `yaml:"maxConnections,omitempty"`
+	MaxUses        *int       `yaml:"maxUses,omitempty"`
+	AllowedCidrs   []string   `yaml:"allowedCidrs,omitempty"`
+	BindFirstIp    bool       `yaml:"bindFirstIp,omitempty"`
+}
+
+type FileUser struct {
+	Username     string      `yaml:"username"`
+	PasswordHash string      `yaml:"passwordHash"`
+	Grants       []FileGrant `yaml:"grants"`
+}
+
+type FileGrant struct {
+	Path   string `yaml:"path"`
+	Action string `yaml:"action"`
+}
+
+/*
+Asymmetric JWT signing algorithms accepted by default, as symmetric keys are never configured
+*/
+var DefaultJwtAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
 func NewMainConfig() MainConfig {
 	return MainConfig{
 		BindAddress:        "",
@@ -45,35 +231,126 @@ func NewMainConfig() MainConfig {
 		PrivateIps: []string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16", "198.18.0.0/15",
 			"::1/128", "fc00::/7", "fe80::/64"},
 		QueryTokenKey:          "token",
+		ConnectionLimitMode:    "reject",
 		MediaMtxUrlBase:        "http://localhost:9997",
 		MediaMtxUrlBasePublish: "http://localhost:9997",
+		MediaMtxInstances:      []MediaMtxInstance{},
+		ServiceIdentity: ServiceIdentityConfig{
+			Username: "mediamtxauth",
+			Password: "",
+			Token:    "",
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
 		ForwardAuth: ForwardAuthConfig{
 			UriHeader: "X-Forwarded-Uri",
 			IpHeader:  "X-Forwarded-For",
 			BasePath:  "/thumbnails",
 		},
+		Signing: SigningConfig{
+			Keys:      []SigningKey{},
+			ActiveKey: "",
+			MaxTtl:    86400,
+		},
+		Jwt: JwtConfig{
+			JwksFile:     "",
+			Keys:         []Jwk{},
+			Algorithms:   slices.Clone(DefaultJwtAlgorithms),
+			Issuer:       "",
+			Audience:     "",
+			PathsClaim:   "mediamtx_paths",
+			ActionsClaim: "mediamtx_actions",
+			ExpiryClaim:  "exp",
+			Leeway:       30,
+		},
+		Api: ApiConfig{
+			Keys: []ApiKey{},
+		},
+		Share: ShareConfig{
+			DefaultTtl:            3600,
+			MaxTtl:                86400,
+			DefaultMaxConnections: 1,
+			MaxConnections:        10,
+			IpHeader:              "",
+			Urls: map[string]string{
+				"rtsp":   "rtsp://localhost:8554/{{.Path}}?{{.Query}}",
+				"hls":    "http://localhost:8888/{{.Path}}/index.m3u8?{{.Query}}",
+				"webrtc": "http://localhost:8889/{{.Path}}?{{.Query}}",
+				"srt":    `{{if eq .Action "read"}}srt://localhost:8890?streamid={{.Action}}:{{.Path}}:::{{.Query}}{{end}}`,
+			},
+		},
 		Database: DatabaseConfig{
+			Backend:                 "postgres",
+			SqlitePath:              "mediamtxauth.db",
 			Hostname:                "localhost",
 			Port:                    5432,
 			Database:                "mediamtxauth",
 			Username:                "mediamtxauth",
 			Password:                "",
+			AutoMigrate:             false,
+			ChangeDetection:         "notify",
 			PollInterval:            15,
 			CacheDuration:           300,
 			ConnectionTrackDuration: 60,
 		},
+		Audit: AuditConfig{
+			Enabled:       true,
+			QueueSize:     10000,
+			BatchSize:     500,
+			FlushInterval: 1,
+			RetentionDays: 90,
+		},
+		Reconcile: ReconcileConfig{
+			OnStartup: true,
+			DryRun:    false,
+		},
+		Credentials: CredentialsConfig{
+			Tokens: []FileToken{},
+			Users:  []FileUser{},
+		},
 	}
 }
 
+/*
+MediaMTX servers to route API calls to, falling back to instances named read and publish for mediamtxApiBase and mediamtxApiBasePublish,
+or a single instance named default if they are the same
+*/
+func (m *MainConfig) Instances() []MediaMtxInstance {
+	if len(m.MediaMtxInstances) > 0 {
+		return m.MediaMtxInstances
+	}
+	if m.MediaMtxUrlBasePublish == m.MediaMtxUrlBase || len(m.MediaMtxUrlBasePublish) == 0 {
+		return []MediaMtxInstance{{Name: "default", ApiBase: m.MediaMtxUrlBase}}
+	}
+	return []MediaMtxInstance{
+		{Name: "read", ApiBase: m.MediaMtxUrlBase, Roles: []string{"read", "playback"}},
+		{Name: "publish", ApiBase: m.MediaMtxUrlBasePublish, Roles: []string{"publish"}},
+	}
+}
+
+/*
+Path the config was loaded from, empty if not loaded from a file
+*/
+func (m *MainConfig) Path() string {
+	return m.path
+}
+
 func (m *MainConfig) envInit() {
 	readEnvString("BIND_ADDRESS", &m.BindAddress)
 	readEnvInt("BIND_PORT", &m.BindPort)
+	readEnvString("LOG_LEVEL", &m.Log.Level)
+	readEnvString("LOG_FORMAT", &m.Log.Format)
+	readEnvString("SERVICE_PASSWORD", &m.ServiceIdentity.Password)
+	readEnvString("SERVICE_TOKEN", &m.ServiceIdentity.Token)
 	// Database
 	readEnvString("DB_HOSTNAME", &m.Database.Hostname)
 	readEnvInt("DB_PORT", &m.Database.Port)
 	readEnvString("DB_DATABASE", &m.Database.Database)
 	readEnvString("DB_USERNAME", &m.Database.Username)
 	readEnvString("DB_PASSWORD", &m.Database.Password)
+	readEnvString("DB_SQLITE_PATH", &m.Database.SqlitePath)
 }
 
 func readEnvString(env string, res *string) {
@@ -88,7 +365,7 @@ func readEnvInt(env string, res *int) {
 	if exist && len(val) > 0 {
 		parsed, err := strconv.Atoi(val)
 		if err != nil {
-			log.Fatalf("Invalid int %v\n", val)
+			logging.Fatal("Invalid int in environment variable", "env", env, "value", val)
 			return
 		}
 		*res = parsed
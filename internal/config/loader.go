@@ -1,7 +1,8 @@
 package config
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
 	"path"
 	"path/filepath"
@@ -11,14 +12,12 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-var values *MainConfig
-
 func LoadConfig(configPath string) (*MainConfig, error) {
 	// Check for config and create default
 	_, err := os.Stat(configPath)
 	exists := err == nil || !os.IsNotExist(err)
 	if !exists {
-		log.Println("Creating default config")
+		slog.Info("Creating default config", "path", configPath)
 		configData, err := yaml.Marshal(NewMainConfig())
 		if err != nil {
 			return nil, err
@@ -37,49 +36,47 @@ func LoadConfig(configPath string) (*MainConfig, error) {
 		}
 	}
 
-	// Revalidate after writing
-	stat, err := os.Stat(configPath)
+	return ReadConfig(configPath)
+}
+
+/*
+Read and merge the config from a file or directory, without creating a default config if missing
+*/
+func ReadConfig(configPath string) (*MainConfig, error) {
+	slog.Info("Loading config", "path", configPath)
+	return readConfig(configPath, false)
+}
+
+/*
+Read the config again while running, failing on any file which cannot be read or parsed rather than skipping it,
+so a partially written file is not mistaken for removed settings
+*/
+func ReloadConfig(configPath string) (*MainConfig, error) {
+	return readConfig(configPath, true)
+}
+
+func readConfig(configPath string, strict bool) (*MainConfig, error) {
+	configFiles, err := ConfigFiles(configPath)
 	if err != nil {
 		return nil, err
 	}
 
-	// Check if dir, then add all valid config files inside, otherwise add the single config file
-	configFiles := []string{}
-	if stat.IsDir() {
-		log.Printf("Loading config from directory %v\n", configPath)
-		potentialFiles, err := os.ReadDir(configPath)
-		if err != nil {
-			return nil, err
-		}
-		for _, file := range potentialFiles {
-			if file.IsDir() {
-				continue
-			}
-			ext := strings.ToLower(filepath.Ext(file.Name()))
-			if ext != ".yaml" && ext != ".yml" {
-				continue
-			}
-			configFiles = append(configFiles, path.Join(configPath, file.Name()))
-		}
-		sort.Strings(configFiles)
-	} else {
-		log.Printf("Loading config from %v\n", configPath)
-		configFiles = append(configFiles, stat.Name())
-	}
-
 	// Iterate over all found files and deep merge them in order
 	fullMap := map[string]interface{}{}
 	for _, f := range configFiles {
 		newMap := map[string]interface{}{}
 		data, err := os.ReadFile(f)
-		if err != nil {
-			log.Printf("Error while reading a config file: %v\n", f)
-			log.Println(err)
+		if err != nil && strict {
+			return nil, fmt.Errorf("%v: %w", f, err)
+		} else if err != nil {
+			slog.Error("Error while reading a config file", "path", f, "err", err)
 			continue
 		}
-		if err := yaml.Unmarshal(data, &newMap); err != nil {
-			log.Printf("Error while parsing a config file: %v\n", f)
-			log.Println(err)
+		// JSON is also valid YAML
+		if err := yaml.Unmarshal(data, &newMap); err != nil && strict {
+			return nil, fmt.Errorf("%v: %w", f, err)
+		} else if err != nil {
+			slog.Error("Error while parsing a config file", "path", f, "err", err)
 			continue
 		}
 		fullMap = deepMerge(fullMap, newMap)
@@ -90,9 +87,14 @@ func LoadConfig(configPath string) (*MainConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	var values *MainConfig
 	if err := yaml.Unmarshal(mMap, &values); err != nil {
 		return nil, err
 	}
+	if values == nil {
+		values = &MainConfig{}
+	}
+	values.path = configPath
 
 	// Check for environment variables to override config
 	values.envInit()
@@ -100,6 +102,40 @@ func LoadConfig(configPath string) (*MainConfig, error) {
 	return values, nil
 }
 
+/*
+List the config files at the given path, either the single file or all YAML/JSON files in the directory in name order
+*/
+func ConfigFiles(configPath string) ([]string, error) {
+	stat, err := os.Stat(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if dir, then add all valid config files inside, otherwise add the single config file
+	configFiles := []string{}
+	if stat.IsDir() {
+		potentialFiles, err := os.ReadDir(configPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range potentialFiles {
+			if file.IsDir() {
+				continue
+			}
+			ext := strings.ToLower(filepath.Ext(file.Name()))
+			if ext != ".yaml" && ext != ".yml" && ext != ".json" {
+				continue
+			}
+			configFiles = append(configFiles, path.Join(configPath, file.Name()))
+		}
+		sort.Strings(configFiles)
+	} else {
+		configFiles = append(configFiles, configPath)
+	}
+
+	return configFiles, nil
+}
+
 // From https://stackoverflow.com/a/70291996
 func deepMerge(a, b map[string]interface{}) map[string]interface{} {
 	out := make(map[string]interface{}, len(a))
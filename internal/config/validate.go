@@ -0,0 +1,168 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"text/template"
+
+	"github.com/pseudoresonance/authserver/internal/logging"
+)
+
+/*
+Check the config for values which would prevent the server from starting or behaving as expected
+*/
+func (m *MainConfig) Validate() error {
+	var errs []error
+	if m.BindPort < 0 || m.BindPort > 65535 {
+		errs = append(errs, fmt.Errorf("bindPort: invalid port %v", m.BindPort))
+	}
+	errs = append(errs, validateCidrs("apiIpRanges", m.ApiIps)...)
+	errs = append(errs, validateCidrs("monitoringIpRanges", m.MonitoringIpRanges)...)
+	errs = append(errs, validateCidrs("privateIpRanges", m.PrivateIps)...)
+	if len(m.QueryTokenKey) == 0 {
+		errs = append(errs, errors.New("queryTokenKey: must not be empty"))
+	}
+	if _, err := logging.ParseLevel(m.Log.Level); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %w", err))
+	}
+	switch m.Log.Format {
+	case "", "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("log.format: unknown format %v", m.Log.Format))
+	}
+	switch m.ConnectionLimitMode {
+	case "", "reject", "kickOldest":
+	default:
+		errs = append(errs, fmt.Errorf("connectionLimitMode: unknown mode %v", m.ConnectionLimitMode))
+	}
+
+	instances := map[string]bool{}
+	for i, instance := range m.MediaMtxInstances {
+		key := fmt.Sprintf("mediamtxInstances[%v]", i)
+		if len(instance.Name) == 0 || len(instance.ApiBase) == 0 {
+			errs = append(errs, fmt.Errorf("%v: name and apiBase must not be empty", key))
+		}
+		if instances[instance.Name] {
+			errs = append(errs, fmt.Errorf("%v: duplicate name %v", key, instance.Name))
+		}
+		instances[instance.Name] = true
+		for _, role := range instance.Roles {
+			switch role {
+			case "read", "publish", "playback":
+			default:
+				errs = append(errs, fmt.Errorf("%v.roles: unknown role %v", key, role))
+			}
+		}
+		if (len(instance.Username) > 0) != (len(instance.Password) > 0) {
+			errs = append(errs, fmt.Errorf("%v: username and password must be set together", key))
+		}
+		if len(instance.Username) > 0 && len(instance.BearerToken) > 0 {
+			errs = append(errs, fmt.Errorf("%v: only one of username or bearerToken may be set", key))
+		}
+		if (len(instance.Tls.CertFile) > 0) != (len(instance.Tls.KeyFile) > 0) {
+			errs = append(errs, fmt.Errorf("%v.tls: certFile and keyFile must be set together", key))
+		}
+	}
+	if len(m.ServiceIdentity.Password) > 0 && len(m.ServiceIdentity.Username) == 0 {
+		errs = append(errs, errors.New("serviceIdentity.username: must not be empty when a password is set"))
+	}
+
+	if m.ForwardAuth.TrustedHops < 0 {
+		errs = append(errs, errors.New("forwardAuth.trustedHops: must not be negative"))
+	}
+
+	for i, key := range m.Api.Keys {
+		if len(key.Key) == 0 {
+			errs = append(errs, fmt.Errorf("api.keys[%v]: key must not be empty", i))
+		}
+	}
+
+	if m.Share.MaxTtl < 0 || m.Share.DefaultTtl < 0 || m.Share.DefaultTtl > m.Share.MaxTtl {
+		errs = append(errs, fmt.Errorf("share: defaultTtl (%v) must be between 0 and maxTtl (%v)", m.Share.DefaultTtl, m.Share.MaxTtl))
+	}
+	if m.Share.MaxConnections < 0 || m.Share.DefaultMaxConnections < 0 {
+		errs = append(errs, errors.New("share: connection limits must not be negative"))
+	}
+	if m.Share.TrustedHops < 0 {
+		errs = append(errs, errors.New("share.trustedHops: must not be negative"))
+	}
+	for name, text := range m.Share.Urls {
+		if _, err := template.New(name).Parse(text); err != nil {
+			errs = append(errs, fmt.Errorf("share.urls.%v: %w", name, err))
+		}
+	}
+
+	switch m.Database.Backend {
+	case "", "postgres", "file", "sqlite":
+	default:
+		errs = append(errs, fmt.Errorf("database.backend: unknown backend %v", m.Database.Backend))
+	}
+	if m.Database.Backend == "sqlite" && len(m.Database.SqlitePath) == 0 {
+		errs = append(errs, errors.New("database.sqlitePath: must not be empty when using SQLite"))
+	}
+	if m.Database.Port < 0 || m.Database.Port > 65535 {
+		errs = append(errs, fmt.Errorf("database.port: invalid port %v", m.Database.Port))
+	}
+	switch m.Database.ChangeDetection {
+	case "", "notify", "poll":
+	default:
+		errs = append(errs, fmt.Errorf("database.changeDetection: unknown mode %v", m.Database.ChangeDetection))
+	}
+	if m.Database.ChangeDetection == "poll" && m.Database.PollInterval <= 0 {
+		errs = append(errs, errors.New("database.pollInterval: must be positive when polling"))
+	}
+	if m.Audit.QueueSize < 0 || m.Audit.BatchSize < 0 || m.Audit.FlushInterval < 0 || m.Audit.RetentionDays < 0 {
+		errs = append(errs, errors.New("audit: sizes and intervals must not be negative"))
+	}
+	if err := m.Credentials.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+/*
+Check the static credentials, which are also checked alone whenever they are reloaded
+*/
+func (c *CredentialsConfig) Validate() error {
+	var errs []error
+	for i, token := range c.Tokens {
+		key := fmt.Sprintf("credentials.tokens[%v]", i)
+		if len(token.Path) == 0 || len(token.Action) == 0 || len(token.Token) == 0 {
+			errs = append(errs, fmt.Errorf("%v: path, action and token must not be empty", key))
+		}
+		if token.ValidFrom != nil && token.ExpiresAt != nil && !token.ExpiresAt.After(*token.ValidFrom) {
+			errs = append(errs, fmt.Errorf("%v: expiresAt must be after validFrom", key))
+		}
+		if (token.MaxConnections != nil && *token.MaxConnections < 0) || (token.MaxUses != nil && *token.MaxUses < 0) {
+			errs = append(errs, fmt.Errorf("%v: limits must not be negative", key))
+		}
+		// Consumed uses and bound IPs could only be kept in memory, so would reset whenever the server restarts
+		if token.MaxUses != nil || token.BindFirstIp {
+			errs = append(errs, fmt.Errorf("%v: maxUses and bindFirstIp are not supported by the file backend", key))
+		}
+		errs = append(errs, validateCidrs(key+".allowedCidrs", token.AllowedCidrs)...)
+	}
+	users := map[string]bool{}
+	for i, user := range c.Users {
+		key := fmt.Sprintf("credentials.users[%v]", i)
+		if len(user.Username) == 0 || len(user.PasswordHash) == 0 {
+			errs = append(errs, fmt.Errorf("%v: username and passwordHash must not be empty", key))
+		}
+		if users[user.Username] {
+			errs = append(errs, fmt.Errorf("%v: duplicate username %v", key, user.Username))
+		}
+		users[user.Username] = true
+	}
+	return errors.Join(errs...)
+}
+
+func validateCidrs(key string, cidrs []string) []error {
+	var errs []error
+	for _, entry := range cidrs {
+		if _, _, err := net.ParseCIDR(entry); err != nil {
+			errs = append(errs, fmt.Errorf("%v: invalid CIDR %v", key, entry))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,253 @@
+package database
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+	"github.com/pseudoresonance/authserver/internal/metrics"
+)
+
+/*
+How often audit entries older than the retention period are deleted
+*/
+const auditPruneInterval = time.Hour
+
+/*
+Time allowed to write a batch of audit entries before the batch is dropped
+*/
+const auditWriteTimeout = 10 * time.Second
+
+/*
+Auth decision in auth_audit, with the token hashed
+*/
+type AuditEntry struct {
+	Id           int64     `json:"id"`
+	Time         time.Time `json:"time"`
+	Action       string    `json:"action"`
+	Path         string    `json:"path"`
+	Protocol     string    `json:"protocol"`
+	Ip           string    `json:"ip"`
+	ConnectionId string    `json:"connectionId"`
+	User         string    `json:"user"`
+	Token        string    `json:"token"`
+	Result       string    `json:"result"`
+	Reason       string    `json:"reason"`
+}
+
+/*
+Filter and pagination for searching audit entries, newest first
+*/
+type AuditFilter struct {
+	Token  string // Token hash
+	Path   string
+	Ip     string
+	From   *time.Time
+	To     *time.Time
+	Before int64 // Only IDs before this, for pagination
+	Limit  int
+}
+
+/*
+Store which can persist auth decisions
+*/
+type AuditStore interface {
+	WriteAudit(ctx context.Context, entries []AuditEntry) error
+	SearchAudit(ctx context.Context, filter AuditFilter) ([]AuditEntry, error)
+	// Delete entries decided before the given time, returning the number deleted
+	PruneAudit(ctx context.Context, before time.Time) (int64, error)
+}
+
+/*
+Queues audit entries and writes them to the store in batches, so auth requests never wait on the database
+*/
+type auditWriter struct {
+	store     AuditStore
+	queue     chan AuditEntry
+	batchSize int
+	interval  time.Duration
+	retention time.Duration
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+func newAuditWriter(store AuditStore, conf config.AuditConfig) *auditWriter {
+	w := &auditWriter{
+		store:     store,
+		queue:     make(chan AuditEntry, positiveOr(conf.QueueSize, 10000)),
+		batchSize: positiveOr(conf.BatchSize, 500),
+		interval:  time.Duration(positiveOr(conf.FlushInterval, 1)) * time.Second,
+		retention: time.Duration(conf.RetentionDays) * 24 * time.Hour,
+		done:      make(chan struct{}),
+	}
+	var ctx context.Context
+	ctx, w.cancel = context.WithCancel(context.Background())
+	go w.run(ctx)
+	return w
+}
+
+func positiveOr(value int, fallback int) int {
+	if value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+/*
+Queue an entry, dropping it if the queue is full
+*/
+func (w *auditWriter) add(entry AuditEntry) {
+	select {
+	case w.queue <- entry:
+	default:
+		metrics.AuditDropped.Inc()
+	}
+}
+
+func (w *auditWriter) run(ctx context.Context) {
+	defer close(w.done)
+	flush := time.NewTicker(w.interval)
+	defer flush.Stop()
+	prune := time.NewTicker(auditPruneInterval)
+	defer prune.Stop()
+	w.prune()
+
+	batch := make([]AuditEntry, 0, w.batchSize)
+	for {
+		select {
+		case entry := <-w.queue:
+			batch = append(batch, entry)
+			if len(batch) >= w.batchSize {
+				batch = w.write(batch)
+			}
+		case <-flush.C:
+			batch = w.write(batch)
+		case <-prune.C:
+			w.prune()
+		case <-ctx.Done():
+			// Write everything queued before stopping
+			for {
+				select {
+				case entry := <-w.queue:
+					batch = append(batch, entry)
+					if len(batch) >= w.batchSize {
+						batch = w.write(batch)
+					}
+				default:
+					w.write(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+/*
+Write a batch, dropping it if the store fails, returning the emptied batch for reuse
+*/
+func (w *auditWriter) write(batch []AuditEntry) []AuditEntry {
+	if len(batch) == 0 {
+		return batch
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), auditWriteTimeout)
+	defer cancel()
+	if err := w.store.WriteAudit(ctx, batch); err != nil {
+		slog.Error("Error while writing audit log, dropping entries", "entries", len(batch), "err", err)
+		metrics.AuditDropped.Add(float64(len(batch)))
+	}
+	return batch[:0]
+}
+
+func (w *auditWriter) prune() {
+	if w.retention <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	deleted, err := w.store.PruneAudit(ctx, time.Now().Add(-w.retention))
+	if err != nil {
+		slog.Error("Error while pruning audit log", "err", err)
+		return
+	}
+	if deleted > 0 {
+		slog.Info("Pruned audit log", "deleted", deleted)
+	}
+}
+
+/*
+Stop the writer once all queued entries have been written
+*/
+func (w *auditWriter) close() {
+	w.cancel()
+	<-w.done
+}
+
+/*
+Start the audit writer if enabled and supported by the store
+*/
+func (d *DatabaseManager) startAudit() {
+	if !d.conf.Audit.Enabled {
+		return
+	}
+	store, ok := d.store.(AuditStore)
+	if !ok {
+		slog.Warn("Credential store does not support the audit log, auth decisions will not be persisted")
+		return
+	}
+	d.audit = newAuditWriter(store, d.conf.Audit)
+}
+
+/*
+Canonical form of an IP address in the audit log, so entries and filters match however the address was written, or the
+text unchanged if it is not an address
+*/
+func NormalizeIp(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	return addr.Unmap().String()
+}
+
+/*
+Record an auth decision in the audit log without waiting, if enabled
+*/
+func (d *DatabaseManager) Audit(entry AuditEntry) {
+	if d == nil || d.audit == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	entry.Ip = NormalizeIp(entry.Ip)
+	d.audit.add(entry)
+}
+
+func (d *DatabaseManager) auditStore() (AuditStore, error) {
+	store, ok := d.store.(AuditStore)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return store, nil
+}
+
+func (d *DatabaseManager) SearchAudit(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	store, err := d.auditStore()
+	if err != nil {
+		return nil, err
+	}
+	return store.SearchAudit(ctx, filter)
+}
+
+/*
+Delete audit entries decided before the given time, returning the number deleted
+*/
+func (d *DatabaseManager) PruneAudit(ctx context.Context, before time.Time) (int64, error) {
+	store, err := d.auditStore()
+	if err != nil {
+		return 0, err
+	}
+	return store.PruneAudit(ctx, before)
+}
@@ -0,0 +1,103 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/pseudoresonance/authserver/internal/config"
+	"github.com/pseudoresonance/authserver/internal/metrics"
+)
+
+func TestAuditLog(t *testing.T) {
+	db, _, _ := newTestSqlite(t)
+	ctx := context.Background()
+	old := time.Now().AddDate(0, 0, -100)
+	db.Audit(AuditEntry{Time: old, Action: "read", Path: "stream", Ip: "203.0.113.5", Token: "sha256:aaaa", Result: "allow", Reason: "token"})
+	db.Audit(AuditEntry{Action: "read", Path: "stream", Ip: "203.0.113.6", Token: "sha256:bbbb", Result: "deny", Reason: "invalid_credentials"})
+	db.Audit(AuditEntry{Action: "publish", Path: "other", Ip: "::ffff:203.0.113.5", User: "alice", Result: "allow", Reason: "user"})
+	// Addresses are stored in canonical form
+	db.Audit(AuditEntry{Action: "read", Path: "other", Ip: "2001:DB8:0::1", Result: "deny", Reason: "invalid_credentials"})
+
+	// Entries are written asynchronously
+	var entries []AuditEntry
+	deadline := time.Now().Add(5 * time.Second)
+	for len(entries) < 4 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		var err error
+		if entries, err = db.SearchAudit(ctx, AuditFilter{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(entries) != 4 || entries[1].User != "alice" || !entries[3].Time.Equal(old.Truncate(time.Millisecond)) {
+		t.Fatalf("Audit entries not written in order: %+v\n", entries)
+	}
+
+	from := time.Now().Add(-time.Hour)
+	for _, test := range []struct {
+		filter AuditFilter
+		target int
+	}{
+		{AuditFilter{Token: "sha256:aaaa"}, 1},
+		{AuditFilter{Path: "stream"}, 2},
+		{AuditFilter{Ip: "203.0.113.5"}, 2},
+		{AuditFilter{Ip: "203.0.113.5", From: &from}, 1},
+		{AuditFilter{Ip: "2001:db8::1"}, 1},
+		{AuditFilter{To: &from}, 1},
+		{AuditFilter{Before: entries[2].Id}, 1},
+		{AuditFilter{Limit: 2}, 2},
+	} {
+		found, err := db.SearchAudit(ctx, test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != test.target {
+			t.Errorf("Wrong entries for %+v: need (%v) got (%v)\n", test.filter, test.target, len(found))
+		}
+	}
+
+	deleted, err := db.PruneAudit(ctx, time.Now().AddDate(0, 0, -90))
+	if err != nil || deleted != 1 {
+		t.Errorf("Wrong entries pruned: %v (%v)\n", deleted, err)
+	}
+}
+
+/*
+Store which signals each write as it starts, then blocks it until released
+*/
+type blockedAuditStore struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s blockedAuditStore) WriteAudit(ctx context.Context, entries []AuditEntry) error {
+	s.started <- struct{}{}
+	<-s.release
+	return nil
+}
+
+func (s blockedAuditStore) SearchAudit(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	return nil, nil
+}
+
+func (s blockedAuditStore) PruneAudit(ctx context.Context, before time.Time) (int64, error) {
+	return 0, nil
+}
+
+func TestAuditDropped(t *testing.T) {
+	store := blockedAuditStore{started: make(chan struct{}, 2), release: make(chan struct{})}
+	w := newAuditWriter(store, config.AuditConfig{QueueSize: 1, BatchSize: 1})
+	dropped := testutil.ToFloat64(metrics.AuditDropped)
+	// The first entry is being written, the second waits in the queue and the rest are dropped
+	w.add(AuditEntry{})
+	<-store.started
+	for range 4 {
+		w.add(AuditEntry{})
+	}
+	if got := testutil.ToFloat64(metrics.AuditDropped) - dropped; got != 3 {
+		t.Errorf("Wrong number of dropped entries: need (3) got (%v)\n", got)
+	}
+	close(store.release)
+	w.close()
+}
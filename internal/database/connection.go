@@ -1,11 +1,16 @@
 package database
 
 import (
-	"fmt"
-	"log"
-	"net/http"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
 
 	ttlcache "github.com/jellydator/ttlcache/v3"
+	"github.com/pseudoresonance/authserver/internal/config"
+	"github.com/pseudoresonance/authserver/internal/mediamtx"
 )
 
 /*
@@ -16,12 +21,23 @@ type Connection struct {
 	Protocol string
 }
 
+/*
+Details of the client making an auth request
+*/
+type Client struct {
+	Ip         net.IP
+	Connection *Connection // Nil for one time connections (ex: HLS)
+	Instance   string      // Named MediaMTX instance which made the request, empty if not given
+}
+
 /*
 Wrapper to hold full connection details for retrieval when disconnecting users
 */
 type ConnectionRecord struct {
-	Info  Connection
-	Creds *Credentials
+	Info     Connection
+	Creds    *Credentials
+	Instance string // Named MediaMTX instance the connection is on, empty to route by action
+	Started  time.Time
 }
 
 func (d *DatabaseManager) revoke(connData *CredentialData) {
@@ -32,7 +48,7 @@ func (d *DatabaseManager) revoke(connData *CredentialData) {
 			// Untracked connection (ex: localhost, failed auth)
 			continue
 		}
-		d.closeConnection(ret.Value().Info, ret.Value().Creds.Action)
+		d.kicks.add(ret.Value())
 	}
 }
 
@@ -49,6 +65,7 @@ func (d *DatabaseManager) Connect(conn Connection) {
 	wrapper := ret.Value()
 	wrapper.Info.Protocol = conn.Protocol
 	d.connections.Set(conn.Id, wrapper, ttlcache.PreviousOrDefaultTTL)
+	d.saveSession(wrapper)
 }
 
 /*
@@ -60,6 +77,7 @@ func (d *DatabaseManager) Disconnect(conn Connection) {
 		// Untracked connection (ex: localhost, failed auth)
 		return
 	}
+	d.deleteSession(conn.Id)
 
 	if creds := ret.Value().Creds; creds != nil {
 		if credData := d.cache.Get(*creds); credData != nil {
@@ -69,139 +87,202 @@ func (d *DatabaseManager) Disconnect(conn Connection) {
 }
 
 /*
-Tell MediaMTX to forcefully close a connection
+Time allowed for all attempts of a single MediaMTX API call
 */
-func (d *DatabaseManager) closeConnection(conn Connection, action string) {
-	var baseUrl string
-	switch action {
-	case "read", "playback":
-		baseUrl = d.conf.MediaMtxUrlBase
-	case "publish":
-		baseUrl = d.conf.MediaMtxUrlBasePublish
-	default:
-		log.Printf("Unknown connection action %v\n", conn.Protocol)
-		baseUrl = d.conf.MediaMtxUrlBase
-	}
-
-	switch conn.Protocol {
-	case "hls":
-		// Theoretically this shouldn't be used, but is here for just in case the onConnect webhook is missed for some reason
-		fallthrough
-	case "hlsMuxer":
-		// Ignore as it's not persistent
-
-	case "rtmp":
-		// Theoretically this shouldn't be used, but is here for just in case the onConnect webhook is missed for some reason
-		d.postToUrl(fmt.Sprintf("%v/v3/rtmpconns/kick/%v", baseUrl, conn.Id))
-		d.postToUrl(fmt.Sprintf("%v/v3/rtmpsconns/kick/%v", baseUrl, conn.Id))
-	case "rtmpConn":
-		d.postToUrl(fmt.Sprintf("%v/v3/rtmpconns/kick/%v", baseUrl, conn.Id))
-	case "rtmpsConn":
-		d.postToUrl(fmt.Sprintf("%v/v3/rtmpsconns/kick/%v", baseUrl, conn.Id))
-
-	case "rtsp":
-		// Theoretically this shouldn't be used, but is here for just in case the onConnect webhook is missed for some reason
-		d.postToUrl(fmt.Sprintf("%v/v3/rtspsessions/kick/%v", baseUrl, conn.Id))
-		d.postToUrl(fmt.Sprintf("%v/v3/rtspssessions/kick/%v", baseUrl, conn.Id))
-	case "rtspSession":
-		d.postToUrl(fmt.Sprintf("%v/v3/rtspsessions/kick/%v", baseUrl, conn.Id))
-	case "rtspsSession":
-		d.postToUrl(fmt.Sprintf("%v/v3/rtspssessions/kick/%v", baseUrl, conn.Id))
-
-	case "srt":
-		// Theoretically this shouldn't be used, but is here for just in case the onConnect webhook is missed for some reason
-		fallthrough
-	case "srtConn":
-		d.postToUrl(fmt.Sprintf("%v/v3/srtconns/kick/%v", baseUrl, conn.Id))
-
-	case "webrtc":
-		// Theoretically this shouldn't be used, but is here for just in case the onConnect webhook is missed for some reason
-		fallthrough
-	case "webRTCSession":
-		d.postToUrl(fmt.Sprintf("%v/v3/webrtcsessions/kick/%v", baseUrl, conn.Id))
+const mediaMtxCallTimeout = 30 * time.Second
+
+/*
+Kicks which can be queued before further kicks are dropped
+*/
+const kickQueueSize = 10000
 
+/*
+Kicks made at once, so a slow MediaMTX server does not hold up every other kick
+*/
+const kickWorkers = 8
+
+/*
+Queues kicks of tracked connections and makes them in the background, so auth requests and revocations never wait on
+MediaMTX while its API calls are retried
+*/
+type kickQueue struct {
+	queue  chan ConnectionRecord
+	kick   func(ctx context.Context, record ConnectionRecord)
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newKickQueue(kick func(ctx context.Context, record ConnectionRecord)) *kickQueue {
+	q := &kickQueue{queue: make(chan ConnectionRecord, kickQueueSize), kick: kick}
+	var ctx context.Context
+	ctx, q.cancel = context.WithCancel(context.Background())
+	for range kickWorkers {
+		q.wg.Add(1)
+		go q.run(ctx)
+	}
+	return q
+}
+
+/*
+Queue a kick, dropping it if the queue is full
+*/
+func (q *kickQueue) add(record ConnectionRecord) {
+	select {
+	case q.queue <- record:
 	default:
-		log.Printf("Unknown connection type %v\n", conn.Protocol)
+		slog.Error("Kick queue full, dropping kick", "id", record.Info.Id)
+	}
+}
+
+func (q *kickQueue) run(ctx context.Context) {
+	defer q.wg.Done()
+	for {
+		select {
+		case record := <-q.queue:
+			q.kick(ctx, record)
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
 /*
-Create a POST request with no body to the given URL
+Stop kicking, abandoning any queued kicks as their sessions are kept to be kicked on the next start
 */
-func (d *DatabaseManager) postToUrl(url string) {
-	req, err := http.NewRequest(http.MethodPost, url, nil)
-	if err != nil {
-		log.Printf("Error while closing connection\n%v\n", err)
+func (q *kickQueue) close() {
+	q.cancel()
+	q.wg.Wait()
+}
+
+/*
+Close a tracked connection and stop persisting it, unless stopped first so it is kicked again on the next start
+*/
+func (d *DatabaseManager) kick(ctx context.Context, record ConnectionRecord) {
+	d.closeConnection(ctx, record)
+	if ctx.Err() == nil {
+		d.deleteSession(record.Info.Id)
 	}
-	d.httpClient.Do(req)
 }
 
-func (d *DatabaseManager) validateConnection(conn Connection, action string) bool {
-	var baseUrl string
-	switch action {
-	case "read", "playback":
-		baseUrl = d.conf.MediaMtxUrlBase
-	case "publish":
-		baseUrl = d.conf.MediaMtxUrlBasePublish
-	default:
-		log.Printf("Unknown connection action %v\n", conn.Protocol)
-		baseUrl = d.conf.MediaMtxUrlBase
-	}
-
-	switch conn.Protocol {
-	// HLS shouldn't be in here at all as it's not persistent
-	case "hls":
-		fallthrough
-	case "hlsMuxer":
-		return false
-
-	case "rtmp":
-		// Theoretically this shouldn't be used, but is here for just in case the onConnect webhook is missed for some reason
-		return d.getUrlValid(fmt.Sprintf("%v/v3/rtmpconns/get/%v", baseUrl, conn.Id)) ||
-			d.getUrlValid(fmt.Sprintf("%v/v3/rtmpsconns/get/%v", baseUrl, conn.Id))
-	case "rtmpConn":
-		return d.getUrlValid(fmt.Sprintf("%v/v3/rtmpconns/get/%v", baseUrl, conn.Id))
-	case "rtmpsConn":
-		return d.getUrlValid(fmt.Sprintf("%v/v3/rtmpsconns/get/%v", baseUrl, conn.Id))
-
-	case "rtsp":
-		// Theoretically this shouldn't be used, but is here for just in case the onConnect webhook is missed for some reason
-		return d.getUrlValid(fmt.Sprintf("%v/v3/rtspsessions/get/%v", baseUrl, conn.Id)) ||
-			d.getUrlValid(fmt.Sprintf("%v/v3/rtspssessions/get/%v", baseUrl, conn.Id))
-	case "rtspSession":
-		return d.getUrlValid(fmt.Sprintf("%v/v3/rtspsessions/get/%v", baseUrl, conn.Id))
-	case "rtspsSession":
-		return d.getUrlValid(fmt.Sprintf("%v/v3/rtspssessions/get/%v", baseUrl, conn.Id))
-
-	case "srt":
-		// Theoretically this shouldn't be used, but is here for just in case the onConnect webhook is missed for some reason
-		fallthrough
-	case "srtConn":
-		return d.getUrlValid(fmt.Sprintf("%v/v3/srtconns/get/%v", baseUrl, conn.Id))
-
-	case "webrtc":
-		// Theoretically this shouldn't be used, but is here for just in case the onConnect webhook is missed for some reason
-		fallthrough
-	case "webRTCSession":
-		return d.getUrlValid(fmt.Sprintf("%v/v3/webrtcsessions/get/%v", baseUrl, conn.Id))
+/*
+State of a tracked connection on MediaMTX
+*/
+type connectionState int
 
-	default:
-		log.Printf("Unknown connection type %v\n", conn.Protocol)
+const (
+	connectionUnknown connectionState = iota // The API could not be reached or returned an error
+	connectionAlive
+	connectionGone
+)
+
+/*
+Configured MediaMTX server with its API client
+*/
+type mediaMtxInstance struct {
+	config.MediaMtxInstance
+	api *mediamtx.Client
+}
+
+/*
+API client options for an instance, authenticating with the service identity unless the instance has its own credentials
+*/
+func instanceOptions(instance config.MediaMtxInstance, identity config.ServiceIdentityConfig) (mediamtx.Options, error) {
+	options := mediamtx.Options{Username: instance.Username, Password: instance.Password, BearerToken: instance.BearerToken}
+	if len(options.Username) == 0 && len(options.BearerToken) == 0 {
+		if len(identity.Token) > 0 {
+			options.BearerToken = identity.Token
+		} else if len(identity.Password) > 0 {
+			options.Username = identity.Username
+			options.Password = identity.Password
+		}
 	}
-	return false
+	if tls := instance.Tls; len(tls.CaFile) > 0 || len(tls.CertFile) > 0 {
+		var err error
+		if options.Tls, err = mediamtx.LoadTls(tls.CaFile, tls.CertFile, tls.KeyFile); err != nil {
+			return options, err
+		}
+	}
+	return options, nil
 }
 
 /*
-Create a GET request to the given URL and return if the code was OK
+MediaMTX server a tracked connection is on, by its instance name if known, otherwise the first server with a role for its action
 */
-func (d *DatabaseManager) getUrlValid(url string) bool {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		log.Printf("Error while checking if connection is valid\n%v\n", err)
+func (d *DatabaseManager) instanceFor(record ConnectionRecord) mediaMtxInstance {
+	if len(record.Instance) > 0 {
+		for _, instance := range d.instances {
+			if instance.Name == record.Instance {
+				return instance
+			}
+		}
+		slog.Warn("Unknown MediaMTX instance, routing by action", "instance", record.Instance, "id", record.Info.Id)
+	}
+	for _, instance := range d.instances {
+		if instance.HasRole(record.Creds.Action) {
+			return instance
+		}
 	}
-	res, err := d.httpClient.Do(req)
-	if err != nil {
-		log.Printf("Error while checking if connection is valid\n%v\n", err)
+	slog.Warn("No MediaMTX instance for connection action", "action", record.Creds.Action, "id", record.Info.Id)
+	return d.instances[0]
+}
+
+/*
+Tell MediaMTX to forcefully close a connection
+*/
+func (d *DatabaseManager) closeConnection(ctx context.Context, record ConnectionRecord) {
+	d.kickConnection(ctx, d.instanceFor(record).api, record.Info)
+}
+
+/*
+Tell the given MediaMTX server to forcefully close a connection
+*/
+func (d *DatabaseManager) kickConnection(ctx context.Context, api *mediamtx.Client, conn Connection) {
+	kinds, ok := mediamtx.KindsForProtocol(conn.Protocol)
+	if !ok {
+		slog.Warn("Unknown connection type", "protocol", conn.Protocol, "id", conn.Id)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, mediaMtxCallTimeout)
+	defer cancel()
+	for _, kind := range kinds {
+		err := api.Kick(ctx, kind, conn.Id)
+		switch {
+		case err == nil:
+			return
+		case errors.Is(err, mediamtx.ErrNotFound):
+			// Already closed, or the other kind for a legacy protocol name
+			slog.Debug("Connection to close not found", "url", api.BaseUrl(), "kind", kind, "id", conn.Id)
+		default:
+			slog.Error("Error while closing connection", "url", api.BaseUrl(), "kind", kind, "id", conn.Id, "err", err)
+		}
+	}
+}
+
+/*
+Get a tracked connection from MediaMTX, with whether it is still alive
+*/
+func (d *DatabaseManager) getConnection(record ConnectionRecord) (mediamtx.Conn, connectionState) {
+	conn := record.Info
+	api := d.instanceFor(record).api
+	kinds, ok := mediamtx.KindsForProtocol(conn.Protocol)
+	if !ok {
+		slog.Warn("Unknown connection type", "protocol", conn.Protocol, "id", conn.Id)
+		return mediamtx.Conn{}, connectionGone
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mediaMtxCallTimeout)
+	defer cancel()
+	// HLS has no kinds as it's not persistent, so it is always gone
+	state := connectionGone
+	for _, kind := range kinds {
+		live, err := api.Get(ctx, kind, conn.Id)
+		switch {
+		case err == nil:
+			return live, connectionAlive
+		case errors.Is(err, mediamtx.ErrNotFound):
+		default:
+			slog.Error("Error while checking if connection is valid", "url", api.BaseUrl(), "kind", kind, "id", conn.Id, "err", err)
+			state = connectionUnknown
+		}
 	}
-	return res.StatusCode == http.StatusOK
+	return mediamtx.Conn{}, state
 }
@@ -1,19 +1,161 @@
 package database
 
 import (
+	"net/netip"
 	"slices"
 	"sync"
+	"time"
 )
 
 type CredentialData struct {
 	mutex       sync.RWMutex
 	connections []string
-	Valid       bool
+	expiryTimer *time.Timer
+	// Password hash the credentials were verified against, to detect password changes without the plaintext password
+	passwordHash string
+	Valid        bool
+	ValidFrom    time.Time // Next time invalid credentials become valid, zero if never
+	ExpiresAt    time.Time // Time valid credentials stop being valid, zero if never
+	// Maximum concurrent tracked connections, zero if unlimited
+	MaxConnections int
+	// Each new client consumes one of a limited number of uses
+	LimitedUses bool
+	// Addresses allowed to use the credentials
+	Ip ipRestriction
 }
 
-func (d *CredentialData) addConnection(conn string) {
+/*
+Check if the credentials are valid at the given time
+*/
+func (d *CredentialData) validAt(t time.Time) bool {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.Valid && (d.ExpiresAt.IsZero() || t.Before(d.ExpiresAt))
+}
+
+func (d *CredentialData) isValid() bool {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.Valid
+}
+
+func (d *CredentialData) hasConnections() bool {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return len(d.connections) > 0
+}
+
+/*
+Update the validity window from a fresh database lookup
+*/
+func (d *CredentialData) setWindow(window credentialWindow) {
+	d.mutex.Lock()
+	d.Valid = window.Valid
+	d.ValidFrom = window.ValidFrom
+	d.ExpiresAt = window.ExpiresAt
+	d.MaxConnections = window.MaxConnections
+	d.LimitedUses = window.LimitedUses
+	d.Ip = window.Ip
+	d.mutex.Unlock()
+}
+
+func (d *CredentialData) hasLimitedUses() bool {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.LimitedUses
+}
+
+func (d *CredentialData) getIpRestriction() ipRestriction {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.Ip
+}
+
+func (d *CredentialData) setBoundIp(bound netip.Prefix) {
+	d.mutex.Lock()
+	d.Ip.BoundIp = &bound
+	d.mutex.Unlock()
+}
+
+func (d *CredentialData) getPasswordHash() string {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.passwordHash
+}
+
+func (d *CredentialData) setPasswordHash(hash string) {
+	d.mutex.Lock()
+	d.passwordHash = hash
+	d.mutex.Unlock()
+}
+
+/*
+Mark the credentials as invalid
+*/
+func (d *CredentialData) invalidate() {
+	d.mutex.Lock()
+	d.Valid = false
+	d.mutex.Unlock()
+}
+
+/*
+Run fn at the expiry time, replacing any previously scheduled expiry
+*/
+func (d *CredentialData) scheduleExpiry(fn func()) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.expiryTimer != nil {
+		d.expiryTimer.Stop()
+		d.expiryTimer = nil
+	}
+	if !d.Valid || d.ExpiresAt.IsZero() {
+		return
+	}
+	d.expiryTimer = time.AfterFunc(time.Until(d.ExpiresAt), fn)
+}
+
+func (d *CredentialData) stopExpiry() {
 	d.mutex.Lock()
-	d.connections = append(d.connections, conn)
+	if d.expiryTimer != nil {
+		d.expiryTimer.Stop()
+		d.expiryTimer = nil
+	}
+	d.mutex.Unlock()
+}
+
+/*
+Add a connection if it is within the connection limit, or kick the oldest connections to make room if requested
+
+Returns whether the connection was added, and the connections which must be kicked
+*/
+func (d *CredentialData) tryAddConnection(conn string, kickOldest bool) (bool, []string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if slices.Contains(d.connections, conn) {
+		// Repeated auth request for an existing connection
+		return true, nil
+	}
+	if d.MaxConnections <= 0 || len(d.connections) < d.MaxConnections {
+		d.connections = append(d.connections, conn)
+		return true, nil
+	}
+	if !kickOldest {
+		return false, nil
+	}
+	excess := len(d.connections) - d.MaxConnections + 1
+	kicked := slices.Clone(d.connections[:excess])
+	d.connections = append(slices.Clone(d.connections[excess:]), conn)
+	return true, kicked
+}
+
+/*
+Add a connection which was already admitted, regardless of the connection limit
+*/
+func (d *CredentialData) restoreConnection(conn string) {
+	d.mutex.Lock()
+	if !slices.Contains(d.connections, conn) {
+		d.connections = append(d.connections, conn)
+	}
 	d.mutex.Unlock()
 }
 
@@ -21,7 +163,7 @@ func (d *CredentialData) removeConnection(conn string) {
 	d.mutex.Lock()
 	i := slices.Index(d.connections, conn)
 	if i >= 0 {
-		ret := make([]string, len(d.connections)-1)
+		ret := make([]string, 0, len(d.connections)-1)
 		ret = append(ret, d.connections[:i]...)
 		d.connections = append(ret, d.connections[i+1:]...)
 	}
@@ -2,62 +2,119 @@ package database
 
 import (
 	"context"
-	"log"
-	"net/http"
+	"fmt"
+	"log/slog"
 	"time"
 
-	"github.com/jackc/pgx/v5/pgxpool"
 	ttlcache "github.com/jellydator/ttlcache/v3"
 	"github.com/pseudoresonance/authserver/internal/config"
+	"github.com/pseudoresonance/authserver/internal/logging"
+	"github.com/pseudoresonance/authserver/internal/mediamtx"
+	"golang.org/x/sync/singleflight"
 )
 
-const TargetSchemaVersion = "2025-11-16T01:44:52+00:00"
-
 /*
 MediaMTX passed auth credentials
 */
 type Credentials struct {
-	Action     string
-	Path       string
-	QueryToken string
+	Action         string
+	Path           string
+	QueryToken     string
+	User           string
+	PasswordDigest string // Keyed digest of the password, the plaintext password is never stored
+}
+
+/*
+Log credentials with the token hashed and without the password digest
+*/
+func (c Credentials) LogValue() slog.Value {
+	if len(c.User) > 0 {
+		return slog.GroupValue(slog.String("path", c.Path), slog.String("action", c.Action), slog.String("user", c.User))
+	}
+	return slog.GroupValue(slog.String("path", c.Path), slog.String("action", c.Action), slog.String("token", logging.Token(c.QueryToken)))
+}
+
+/*
+Detects changes to credentials in the database and applies them to the cache
+*/
+type changeWatcher interface {
+	Start()
+	Close()
 }
 
 type DatabaseManager struct {
-	conf   *config.MainConfig
-	pool   *pgxpool.Pool
-	poller *DatabasePoller
+	conf    *config.MainConfig
+	store   CredentialStore
+	watcher changeWatcher
 
-	httpClient http.Client
+	// MediaMTX servers connections are routed to, in config order
+	instances []mediaMtxInstance
 
 	cache       *ttlcache.Cache[Credentials, *CredentialData]
 	connections *ttlcache.Cache[string, ConnectionRecord]
+
+	// Clients which have consumed a use of limited use credentials
+	consumers    *ttlcache.Cache[consumerKey, struct{}]
+	consumeGroup singleflight.Group
+
+	// Rejected users by user, path and action, holding the rejected password digest or empty if rejected for any password
+	rejections *ttlcache.Cache[Credentials, string]
+
+	audit    *auditWriter
+	sessions *sessionWriter
+	kicks    *kickQueue
+
+	streams streamTracker
 }
 
+/*
+Connect to the database and start caching credentials, tracking connections and watching for changes
+*/
 func (d *DatabaseManager) Init(config *config.MainConfig) {
-	d.conf = config
-	d.poller = &DatabasePoller{db: d, interval: time.Duration(d.conf.Database.PollInterval) * time.Second}
+	if err := d.Open(config); err != nil {
+		logging.Fatal("Error opening credential store", "err", err)
+	}
+	d.start()
+}
 
+/*
+Start caching credentials from the given store, tracking connections and watching for changes
+*/
+func (d *DatabaseManager) InitWithStore(config *config.MainConfig, store CredentialStore) {
+	if err := d.setStore(config, store); err != nil {
+		logging.Fatal("Error configuring MediaMTX instances", "err", err)
+	}
+	d.start()
+}
+
+func (d *DatabaseManager) start() {
 	d.cache = ttlcache.New(
 		ttlcache.WithTTL[Credentials, *CredentialData](time.Duration(d.conf.Database.CacheDuration)*time.Second),
 		ttlcache.WithDisableTouchOnHit[Credentials, *CredentialData](),
 	)
 	d.cache.OnEviction(func(ctx context.Context, reason ttlcache.EvictionReason, item *ttlcache.Item[Credentials, *CredentialData]) {
-		if credData := item.Value(); credData != nil && credData.Valid {
+		if credData := item.Value(); credData != nil && credData.isValid() {
 			// If there are still connections open, check if the creds are still valid before disconnecting them
-			if len(credData.connections) > 0 {
+			if credData.hasConnections() {
 				creds := item.Key()
-				val, err := d.validateAuth(&creds)
+				window, err := d.revalidate(&creds, credData)
 				if err != nil {
-					log.Printf("Error while validating auth\n%v\n", err)
+					slog.Error("Error while validating auth", "creds", creds, "err", err)
+					credData.stopExpiry()
 					d.revoke(credData)
 					return
 				}
-				if !val {
+				credData.setWindow(window)
+				if !window.Valid {
+					credData.stopExpiry()
 					d.revoke(credData)
 					return
 				}
-				d.cache.Set(creds, credData, ttlcache.DefaultTTL)
+				d.cache.Set(creds, credData, d.cacheTtl(window))
+				d.scheduleExpiry(creds, credData)
+				return
 			}
+			credData.stopExpiry()
 		}
 	})
 
@@ -66,55 +123,178 @@ func (d *DatabaseManager) Init(config *config.MainConfig) {
 		ttlcache.WithDisableTouchOnHit[string, ConnectionRecord](),
 	)
 	d.connections.OnEviction(func(ctx context.Context, reason ttlcache.EvictionReason, item *ttlcache.Item[string, ConnectionRecord]) {
+		if reason != ttlcache.EvictionReasonExpired {
+			return
+		}
 		record := item.Value()
-		valid := d.validateConnection(record.Info, record.Creds.Action)
-		if valid {
+		switch _, state := d.getConnection(record); state {
+		case connectionAlive:
 			// Reset cache if still valid
 			d.connections.Set(item.Key(), record, ttlcache.DefaultTTL)
+			return
+		case connectionUnknown:
+			// Keep tracking until MediaMTX can say whether the connection is gone
+			slog.Warn("Could not check connection, still tracking", "id", item.Key())
+			d.connections.Set(item.Key(), record, ttlcache.DefaultTTL)
+			return
+		}
+		// MediaMTX no longer has the connection, so stop counting it towards the connection limit
+		d.deleteSession(item.Key())
+		if credData := d.cache.Get(*record.Creds); credData != nil && credData.Value() != nil {
+			credData.Value().removeConnection(item.Key())
 		}
 	})
 
-	d.poller.Start()
+	// Touched on every request, so a client keeps its use for as long as it keeps making requests
+	d.consumers = ttlcache.New(
+		ttlcache.WithTTL[consumerKey, struct{}](time.Duration(d.conf.Database.CacheDuration) * time.Second),
+	)
+
+	// Kept apart from cached credentials, so guessed passwords replace a single entry rather than adding one each
+	d.rejections = ttlcache.New(
+		ttlcache.WithTTL[Credentials, string](time.Duration(d.conf.Database.CacheDuration)*time.Second),
+		ttlcache.WithDisableTouchOnHit[Credentials, string](),
+	)
+
 	go d.cache.Start()
 	go d.connections.Start()
+	go d.consumers.Start()
+	go d.rejections.Start()
+
+	d.checkSchema()
+	d.startSessions()
+	d.kicks = newKickQueue(d.kick)
+	d.restoreSessions()
+
+	d.watcher = d.newWatcher()
+	d.watcher.Start()
 
-	pgConf, err := pgxpool.ParseConfig("")
+	d.startAudit()
+}
+
+/*
+Open the configured credential store without any caching or background work, for managing credentials from the command line
+*/
+func (d *DatabaseManager) Open(config *config.MainConfig) error {
+	var store CredentialStore
+	var err error
+	switch config.Database.Backend {
+	case "", "postgres":
+		store, err = NewPostgresStore(context.Background(), config.Database)
+	case "sqlite":
+		store, err = NewSqliteStore(context.Background(), config.Database)
+	case "file":
+		store, err = NewFileStore(config)
+	default:
+		err = fmt.Errorf("unknown database backend %v", config.Database.Backend)
+	}
 	if err != nil {
-		log.Fatalf("Error creating PostgreSQL config\n%v\n", err)
+		return err
 	}
-	pgConf.ConnConfig.Host = d.conf.Database.Hostname
-	pgConf.ConnConfig.Port = uint16(d.conf.Database.Port)
-	pgConf.ConnConfig.Database = d.conf.Database.Database
-	pgConf.ConnConfig.User = d.conf.Database.Username
-	pgConf.ConnConfig.Password = d.conf.Database.Password
+	if err := d.setStore(config, store); err != nil {
+		store.Close()
+		return err
+	}
+	return nil
+}
 
-	d.pool, err = pgxpool.NewWithConfig(context.Background(), pgConf)
-	if err != nil {
-		log.Fatalf("Error creating PostgreSQL connection pool\n%v\n", err)
+func (d *DatabaseManager) setStore(config *config.MainConfig, store CredentialStore) error {
+	d.conf = config
+	d.store = store
+	d.instances = nil
+	for _, instance := range config.Instances() {
+		options, err := instanceOptions(instance, config.ServiceIdentity)
+		if err != nil {
+			return fmt.Errorf("instance %v: %w", instance.Name, err)
+		}
+		d.instances = append(d.instances, mediaMtxInstance{MediaMtxInstance: instance, api: mediamtx.NewClient(instance.ApiBase, options)})
 	}
-	d.checkSchema()
+	return nil
 }
 
+/*
+Create the change watcher for the configured change detection mode, polling if the store cannot send notifications
+*/
+func (d *DatabaseManager) newWatcher() changeWatcher {
+	poller := &DatabasePoller{db: d, interval: time.Duration(d.conf.Database.PollInterval) * time.Second}
+	switch d.conf.Database.ChangeDetection {
+	case "", "notify":
+		notifier, ok := d.store.(ChangeNotifier)
+		if !ok {
+			slog.Info("Credential store does not support notifications, polling", "interval", poller.interval)
+			return poller
+		}
+		// The triggers are installed by migration, so a missing trigger is a broken schema rather than a reason to poll
+		if err := notifier.EnableNotify(context.Background()); err != nil {
+			logging.Fatal("Database notifications unavailable, migrate the schema or set database.changeDetection to poll", "err", err)
+		}
+		slog.Info("Listening for database notifications")
+		return &DatabaseListener{db: d, notifier: notifier}
+	case "poll":
+		slog.Info("Polling database", "interval", poller.interval)
+		return poller
+	default:
+		logging.Fatal("Unknown database change detection mode", "mode", d.conf.Database.ChangeDetection)
+	}
+	return nil
+}
+
+/*
+Apply pending migrations if enabled, otherwise refuse to start on an outdated schema
+*/
 func (d *DatabaseManager) checkSchema() {
-	var schemaVersion time.Time
-	err := d.pool.QueryRow(context.Background(), `SELECT version FROM versions WHERE application = 'db_version'`).Scan(&schemaVersion)
-	if err != nil {
-		log.Fatalf("Error fetching PostgreSQL schema version\n%v\n", err)
+	if _, ok := d.store.(Migrator); !ok {
+		return
 	}
-	targetVersion, err := time.Parse(time.RFC3339, TargetSchemaVersion)
+	if d.conf.Database.AutoMigrate {
+		applied, err := d.MigrateUp(context.Background())
+		for _, m := range applied {
+			slog.Info("Applied migration", "version", m.Version, "name", m.Name)
+		}
+		if err != nil {
+			logging.Fatal("Error while migrating schema", "err", err)
+		}
+	}
+	status, err := d.MigrationStatus(context.Background())
 	if err != nil {
-		log.Fatalf("Invalid PostgreSQL schema version provided in code! (%v)\n%v\n", TargetSchemaVersion, err)
+		logging.Fatal("Error fetching schema version", "err", err)
+	}
+	pending := 0
+	for _, m := range status {
+		if m.AppliedAt == nil {
+			pending++
+		}
 	}
-	log.Printf("Database schema %v\n", schemaVersion)
-	if targetVersion.Compare(schemaVersion) > 0 {
-		log.Fatalf("Outdated PostgreSQL schema (%v) needs (%v)\n", schemaVersion, targetVersion)
+	if pending > 0 {
+		logging.Fatal("Outdated schema, run the migrate up command or enable database.autoMigrate", "pending", pending)
 	}
+	slog.Info("Database schema", "version", status[len(status)-1].Version, "name", status[len(status)-1].Name)
 }
 
 func (d *DatabaseManager) Close() {
-	d.poller.Close()
-	d.cache.Stop()
-	d.connections.Stop()
-	d.pool.Close()
-	d.httpClient.CloseIdleConnections()
+	if d.watcher != nil {
+		d.watcher.Close()
+	}
+	if d.audit != nil {
+		d.audit.close()
+	}
+	if d.cache != nil {
+		d.cache.Stop()
+		d.connections.Stop()
+		d.consumers.Stop()
+		d.rejections.Stop()
+	}
+	// Kicks delete sessions, so must stop first
+	if d.kicks != nil {
+		d.kicks.close()
+	}
+	if d.sessions != nil {
+		d.sessions.close()
+	}
+	if d.store != nil {
+		d.store.Close()
+	}
+	for _, instance := range d.instances {
+		instance.api.Close()
+	}
 }
@@ -0,0 +1,443 @@
+package database
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+	"github.com/pseudoresonance/authserver/internal/password"
+)
+
+/*
+Start a manager on a memory store, with MediaMTX kick requests sent to the returned channel
+*/
+func newTestManager(t *testing.T) (*DatabaseManager, *MemoryStore, chan string) {
+	url, kicks := newTestMediaMtx(t)
+	conf := config.NewMainConfig()
+	conf.MediaMtxUrlBase = url
+	conf.MediaMtxUrlBasePublish = url
+	store := NewMemoryStore()
+	db := &DatabaseManager{}
+	db.InitWithStore(&conf, store)
+	t.Cleanup(db.Close)
+	return db, store, kicks
+}
+
+/*
+Start a fake MediaMTX API, with kick requests sent to the returned channel
+*/
+func newTestMediaMtx(t *testing.T) (string, chan string) {
+	kicks := make(chan string, 16)
+	mediamtx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			kicks <- r.URL.Path
+		}
+	}))
+	t.Cleanup(mediamtx.Close)
+	return mediamtx.URL, kicks
+}
+
+func createToken(t *testing.T, store *MemoryStore, token Token) Token {
+	created, err := store.CreateToken(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return created
+}
+
+func checkValid(t *testing.T, db *DatabaseManager, creds Credentials, client Client, target bool) {
+	t.Helper()
+	valid, err := db.ValidateAuth(&creds, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid != target {
+		t.Errorf("Wrong result for %+v: need (%v) got (%v)\n", creds, target, valid)
+	}
+}
+
+func waitForKick(t *testing.T, kicks chan string, target string) {
+	t.Helper()
+	select {
+	case kick := <-kicks:
+		if kick != target {
+			t.Errorf("Wrong kick: need (%v) got (%v)\n", target, kick)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Connection %v was not kicked\n", target)
+	}
+}
+
+/*
+Wait for a change to reach the cache, without checking the store directly
+*/
+func waitForValid(t *testing.T, db *DatabaseManager, creds Credentials, target bool) {
+	t.Helper()
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if item := db.cache.Get(creds); item != nil && item.Value() != nil && item.Value().isValid() == target {
+			return
+		}
+	}
+	t.Errorf("Wrong cached result for %+v: need (%v)\n", creds, target)
+}
+
+func TestValidityWindow(t *testing.T) {
+	db, store, _ := newTestManager(t)
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	createToken(t, store, Token{Path: "expired", Action: "read", QueryToken: "a", ExpiresAt: &past})
+	createToken(t, store, Token{Path: "pending", Action: "read", QueryToken: "a", ValidFrom: &future})
+	createToken(t, store, Token{Path: "current", Action: "read", QueryToken: "a", ValidFrom: &past, ExpiresAt: &future})
+	client := Client{Ip: net.ParseIP("203.0.113.5")}
+	checkValid(t, db, Credentials{Path: "expired", Action: "read", QueryToken: "a"}, client, false)
+	checkValid(t, db, Credentials{Path: "pending", Action: "read", QueryToken: "a"}, client, false)
+	checkValid(t, db, Credentials{Path: "current", Action: "read", QueryToken: "a"}, client, true)
+}
+
+func TestCombineWindows(t *testing.T) {
+	now := time.Now()
+	past, soon, later := now.Add(-time.Hour), now.Add(time.Minute), now.Add(time.Hour)
+	// Only the current rows count, using the latest expiry
+	window := combineWindows([]Token{{ExpiresAt: &past}, {ValidFrom: &soon}, {ExpiresAt: &soon}, {ValidFrom: &past, ExpiresAt: &later}}, now)
+	if !window.Valid || !window.ExpiresAt.Equal(later) {
+		t.Errorf("Wrong window for current rows: %+v\n", window)
+	}
+	// Pending rows report the earliest time any becomes valid
+	window = combineWindows([]Token{{ValidFrom: &later}, {ValidFrom: &soon}, {ExpiresAt: &past}}, now)
+	if window.Valid || !window.ValidFrom.Equal(soon) {
+		t.Errorf("Wrong window for pending rows: %+v\n", window)
+	}
+	if window = combineWindows([]Token{{}, {ExpiresAt: &later}}, now); !window.Valid || !window.ExpiresAt.IsZero() {
+		t.Errorf("Wrong window for a row without expiry: %+v\n", window)
+	}
+}
+
+func TestCacheTtl(t *testing.T) {
+	db, _, _ := newTestManager(t)
+	full := time.Duration(db.conf.Database.CacheDuration) * time.Second
+	for _, c := range []struct {
+		window credentialWindow
+		max    time.Duration
+	}{
+		{credentialWindow{Valid: true}, full},
+		{credentialWindow{Valid: true, ExpiresAt: time.Now().Add(time.Minute)}, time.Minute},
+		{credentialWindow{ValidFrom: time.Now().Add(time.Minute)}, time.Minute},
+		{credentialWindow{Valid: true, ExpiresAt: time.Now().Add(time.Hour)}, full},
+	} {
+		if ttl := db.cacheTtl(c.window); ttl > c.max || ttl < c.max-time.Second {
+			t.Errorf("Wrong TTL for %+v: need (%v) got (%v)\n", c.window, c.max, ttl)
+		}
+	}
+	// Never zero, which the cache would treat as the default TTL
+	if ttl := db.cacheTtl(credentialWindow{Valid: true, ExpiresAt: time.Now().Add(-time.Second)}); ttl <= 0 {
+		t.Errorf("TTL not positive for past expiry: %v\n", ttl)
+	}
+}
+
+func TestPendingBecomesValid(t *testing.T) {
+	db, store, _ := newTestManager(t)
+	validFrom := time.Now().Add(200 * time.Millisecond)
+	token := createToken(t, store, Token{Path: "stream", Action: "read", QueryToken: "a", ValidFrom: &validFrom})
+	client := Client{Ip: net.ParseIP("203.0.113.5")}
+	checkValid(t, db, token.Credentials(), client, false)
+	// The cached rejection does not outlive valid_from
+	time.Sleep(time.Until(validFrom) + 50*time.Millisecond)
+	checkValid(t, db, token.Credentials(), client, true)
+}
+
+func TestRevokeKicks(t *testing.T) {
+	db, store, kicks := newTestManager(t)
+	token := createToken(t, store, Token{Path: "stream", Action: "read", QueryToken: "a"})
+	creds := token.Credentials()
+	checkValid(t, db, creds, Client{Ip: net.ParseIP("203.0.113.5"), Connection: &Connection{Id: "conn1", Protocol: "rtspSession"}}, true)
+
+	// Revoked directly in the store, so the change must arrive through the listener
+	if _, err := store.RevokeToken(context.Background(), token.Id); err != nil {
+		t.Fatal(err)
+	}
+	waitForKick(t, kicks, "/v3/rtspsessions/kick/conn1")
+	checkValid(t, db, creds, Client{Ip: net.ParseIP("203.0.113.5")}, false)
+}
+
+func TestRevokeNotBlocked(t *testing.T) {
+	// MediaMTX which holds every kick until released
+	release := make(chan struct{})
+	kicks := make(chan string, 16)
+	mediamtx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			<-release
+			kicks <- r.URL.Path
+		}
+	}))
+	t.Cleanup(mediamtx.Close)
+	unblock := sync.OnceFunc(func() { close(release) })
+	t.Cleanup(unblock)
+	conf := config.NewMainConfig()
+	conf.MediaMtxUrlBase = mediamtx.URL
+	conf.MediaMtxUrlBasePublish = mediamtx.URL
+	store := NewMemoryStore()
+	db := &DatabaseManager{}
+	db.InitWithStore(&conf, store)
+	t.Cleanup(db.Close)
+
+	token := createToken(t, store, Token{Path: "stream", Action: "read", QueryToken: "a"})
+	creds := token.Credentials()
+	checkValid(t, db, creds, Client{Ip: net.ParseIP("203.0.113.5"), Connection: &Connection{Id: "conn1", Protocol: "rtspSession"}}, true)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := db.RevokeToken(context.Background(), token.Id); err != nil {
+			t.Error(err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Revoking waited on MediaMTX\n")
+	}
+	unblock()
+	waitForKick(t, kicks, "/v3/rtspsessions/kick/conn1")
+}
+
+func TestExpiryKicks(t *testing.T) {
+	db, store, kicks := newTestManager(t)
+	expires := time.Now().Add(200 * time.Millisecond)
+	token := createToken(t, store, Token{Path: "stream", Action: "publish", QueryToken: "a", ExpiresAt: &expires})
+	checkValid(t, db, token.Credentials(), Client{Ip: net.ParseIP("203.0.113.5"), Connection: &Connection{Id: "conn1", Protocol: "srtConn"}}, true)
+	waitForKick(t, kicks, "/v3/srtconns/kick/conn1")
+}
+
+func TestInstanceRouting(t *testing.T) {
+	edge1, edge1Kicks := newTestMediaMtx(t)
+	edge2, edge2Kicks := newTestMediaMtx(t)
+	ingest, ingestKicks := newTestMediaMtx(t)
+	conf := config.NewMainConfig()
+	conf.MediaMtxInstances = []config.MediaMtxInstance{
+		{Name: "edge-1", ApiBase: edge1, Roles: []string{"read"}},
+		{Name: "edge-2", ApiBase: edge2, Roles: []string{"read"}},
+		{Name: "ingest", ApiBase: ingest, Roles: []string{"publish"}},
+	}
+	store := NewMemoryStore()
+	db := &DatabaseManager{}
+	db.InitWithStore(&conf, store)
+	defer db.Close()
+
+	read := createToken(t, store, Token{Path: "stream", Action: "read", QueryToken: "a"})
+	publish := createToken(t, store, Token{Path: "stream", Action: "publish", QueryToken: "b"})
+	ip := net.ParseIP("203.0.113.5")
+	checkValid(t, db, read.Credentials(), Client{Ip: ip, Connection: &Connection{Id: "conn1", Protocol: "rtspSession"}, Instance: "edge-2"}, true)
+	// Without an instance, the connection is routed by its action
+	checkValid(t, db, publish.Credentials(), Client{Ip: ip, Connection: &Connection{Id: "conn2", Protocol: "rtmpConn"}}, true)
+
+	for _, token := range []Token{read, publish} {
+		if _, err := store.RevokeToken(context.Background(), token.Id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForKick(t, edge2Kicks, "/v3/rtspsessions/kick/conn1")
+	waitForKick(t, ingestKicks, "/v3/rtmpconns/kick/conn2")
+	if len(edge1Kicks) > 0 {
+		t.Errorf("Kicked on the wrong instance: %v\n", <-edge1Kicks)
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	db, store, kicks := newTestManager(t)
+	maxConnections := 1
+	token := createToken(t, store, Token{Path: "stream", Action: "read", QueryToken: "a", MaxConnections: &maxConnections})
+	creds := token.Credentials()
+	ip := net.ParseIP("203.0.113.5")
+	first := Client{Ip: ip, Connection: &Connection{Id: "conn1", Protocol: "rtspSession"}}
+	checkValid(t, db, creds, first, true)
+	// Repeated requests for a tracked connection do not count against the limit
+	checkValid(t, db, creds, first, true)
+	checkValid(t, db, creds, Client{Ip: ip, Connection: &Connection{Id: "conn2", Protocol: "rtspSession"}}, false)
+	// One time connections are not tracked
+	checkValid(t, db, creds, Client{Ip: ip}, true)
+	if len(kicks) > 0 {
+		t.Errorf("Connection kicked when rejecting: %v\n", <-kicks)
+	}
+
+	db.Disconnect(Connection{Id: "conn1", Protocol: "rtspSession"})
+	checkValid(t, db, creds, Client{Ip: ip, Connection: &Connection{Id: "conn2", Protocol: "rtspSession"}}, true)
+}
+
+func TestKickOldest(t *testing.T) {
+	url, kicks := newTestMediaMtx(t)
+	conf := config.NewMainConfig()
+	conf.MediaMtxUrlBase = url
+	conf.MediaMtxUrlBasePublish = url
+	conf.ConnectionLimitMode = "kickOldest"
+	store := NewMemoryStore()
+	db := &DatabaseManager{}
+	db.InitWithStore(&conf, store)
+	defer db.Close()
+
+	maxConnections := 2
+	token := createToken(t, store, Token{Path: "stream", Action: "read", QueryToken: "a", MaxConnections: &maxConnections})
+	ip := net.ParseIP("203.0.113.5")
+	for _, id := range []string{"conn1", "conn2", "conn3"} {
+		checkValid(t, db, token.Credentials(), Client{Ip: ip, Connection: &Connection{Id: id, Protocol: "rtspSession"}}, true)
+	}
+	waitForKick(t, kicks, "/v3/rtspsessions/kick/conn1")
+	if db.connections.Has("conn1") || !db.connections.Has("conn2") || !db.connections.Has("conn3") {
+		t.Errorf("Wrong connections tracked: %v\n", db.connections.Keys())
+	}
+}
+
+func TestLimitedUses(t *testing.T) {
+	db, store, _ := newTestManager(t)
+	maxUses := 1
+	token := createToken(t, store, Token{Path: "stream", Action: "read", QueryToken: "a", MaxUses: &maxUses})
+	creds := token.Credentials()
+	first := Client{Ip: net.ParseIP("203.0.113.5"), Connection: &Connection{Id: "conn1", Protocol: "rtspSession"}}
+	checkValid(t, db, creds, first, true)
+	// The same client does not consume another use
+	checkValid(t, db, creds, first, true)
+	checkValid(t, db, creds, Client{Ip: net.ParseIP("203.0.113.6"), Connection: &Connection{Id: "conn2", Protocol: "rtspSession"}}, false)
+}
+
+func TestConsumeUseDuplicates(t *testing.T) {
+	checkConsumeUseDuplicates(t, NewMemoryStore())
+}
+
+/*
+Duplicate rows for the same credentials each give their own uses, consumed one row at a time
+*/
+func checkConsumeUseDuplicates(t *testing.T, store interface {
+	CredentialStore
+	TokenStore
+}) {
+	t.Helper()
+	ctx := context.Background()
+	maxUses := 1
+	for range 2 {
+		if _, err := store.CreateToken(ctx, Token{Path: "stream", Action: "read", QueryToken: "a", MaxUses: &maxUses}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	creds := Credentials{Path: "stream", Action: "read", QueryToken: "a"}
+	for i, target := range []bool{true, true, false} {
+		if consumed, err := store.ConsumeUse(ctx, creds); err != nil || consumed != target {
+			t.Errorf("Wrong result for use %v: need (%v) got (%v) (%v)\n", i+1, target, consumed, err)
+		}
+	}
+}
+
+func TestBindFirstIp(t *testing.T) {
+	db, store, _ := newTestManager(t)
+	token := createToken(t, store, Token{Path: "stream", Action: "read", QueryToken: "a", BindFirstIp: true,
+		AllowedCidrs: []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}})
+	creds := token.Credentials()
+	checkValid(t, db, creds, Client{Ip: net.ParseIP("198.51.100.1")}, false)
+	checkValid(t, db, creds, Client{Ip: net.ParseIP("203.0.113.5")}, true)
+	checkValid(t, db, creds, Client{Ip: net.ParseIP("203.0.113.6")}, false)
+	checkValid(t, db, creds, Client{Ip: net.ParseIP("203.0.113.5")}, true)
+}
+
+func TestUserPasswordChange(t *testing.T) {
+	db, store, kicks := newTestManager(t)
+	hash, err := password.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grants := []MemoryGrant{{Path: "stream", Action: "publish"}}
+	store.SetUser(MemoryUser{Username: "camera", PasswordHash: hash, Grants: grants})
+
+	client := Client{Ip: net.ParseIP("203.0.113.5"), Connection: &Connection{Id: "conn1", Protocol: "rtmpConn"}}
+	if valid, err := db.ValidateUser("camera", "wrong", "stream", "publish", client); err != nil || valid {
+		t.Errorf("Wrong password accepted (%v)\n", err)
+	}
+	if valid, err := db.ValidateUser("camera", "secret", "stream", "publish", client); err != nil || !valid {
+		t.Errorf("Correct password rejected (%v)\n", err)
+	}
+
+	newHash, err := password.Hash("changed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetUser(MemoryUser{Username: "camera", PasswordHash: newHash, Grants: grants})
+	waitForKick(t, kicks, "/v3/rtmpconns/kick/conn1")
+}
+
+func TestUserRejections(t *testing.T) {
+	db, store, _ := newTestManager(t)
+	hash, err := password.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetUser(MemoryUser{Username: "camera", PasswordHash: hash, Grants: []MemoryGrant{{Path: "stream", Action: "publish"}}})
+	client := Client{Ip: net.ParseIP("203.0.113.5")}
+	for _, guess := range []string{"guess1", "guess2", "guess3", "changed"} {
+		if valid, err := db.ValidateUser("camera", guess, "stream", "publish", client); err != nil || valid {
+			t.Errorf("Wrong password accepted (%v)\n", err)
+		}
+	}
+	// Guessed passwords share one entry, and are not cached with the credentials
+	if db.rejections.Len() != 1 || db.cache.Len() != 0 {
+		t.Errorf("Wrong cached rejections: need (1, 0) got (%v, %v)\n", db.rejections.Len(), db.cache.Len())
+	}
+	if valid, err := db.ValidateUser("camera", "secret", "stream", "publish", client); err != nil || !valid {
+		t.Errorf("Correct password rejected after wrong passwords (%v)\n", err)
+	}
+
+	// A rejected password is accepted once it becomes the password
+	newHash, err := password.Hash("changed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetUser(MemoryUser{Username: "camera", PasswordHash: newHash, Grants: []MemoryGrant{{Path: "stream", Action: "publish"}}})
+	for deadline := time.Now().Add(2 * time.Second); db.rejections.Len() > 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+	}
+	if valid, err := db.ValidateUser("camera", "changed", "stream", "publish", client); err != nil || !valid {
+		t.Errorf("Changed password rejected (%v)\n", err)
+	}
+}
+
+/*
+Memory store which records saved sessions
+*/
+type savingStore struct {
+	*MemoryStore
+	saved chan string
+}
+
+func (s savingStore) SaveSession(ctx context.Context, session Session) error {
+	s.saved <- session.Id
+	return nil
+}
+
+func (s savingStore) DeleteSession(ctx context.Context, id string) error {
+	return nil
+}
+
+func (s savingStore) ListSessions(ctx context.Context) ([]Session, error) {
+	return nil, nil
+}
+
+func TestSessionSavedOnce(t *testing.T) {
+	url, _ := newTestMediaMtx(t)
+	conf := config.NewMainConfig()
+	conf.MediaMtxUrlBase = url
+	conf.MediaMtxUrlBasePublish = url
+	store := savingStore{MemoryStore: NewMemoryStore(), saved: make(chan string, 16)}
+	db := &DatabaseManager{}
+	db.InitWithStore(&conf, store)
+
+	token := createToken(t, store.MemoryStore, Token{Path: "stream", Action: "read", QueryToken: "a"})
+	client := Client{Ip: net.ParseIP("203.0.113.5"), Connection: &Connection{Id: "conn1", Protocol: "rtspSession"}}
+	// Repeated requests for a tracked connection are not saved again
+	for range 3 {
+		checkValid(t, db, token.Credentials(), client, true)
+	}
+	// Closing applies every queued write
+	db.Close()
+	if saves := len(store.saved); saves != 1 {
+		t.Errorf("Wrong number of session saves: need (1) got (%v)\n", saves)
+	}
+}
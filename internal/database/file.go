@@ -0,0 +1,190 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+)
+
+const fileDefaultInterval = 15 * time.Second
+
+/*
+Credentials from the credentials section of the config, which are reloaded whenever the config files change
+*/
+type FileStore struct {
+	memory   *MemoryStore
+	path     string
+	interval time.Duration
+	stamps   []fileStamp
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+/*
+Modification time and size of a config file, used to detect changes without reading it
+*/
+type fileStamp struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+/*
+Load credentials from the config, watching the files it was loaded from for changes
+*/
+func NewFileStore(conf *config.MainConfig) (*FileStore, error) {
+	s := &FileStore{memory: NewMemoryStore(), path: conf.Path(), interval: time.Duration(conf.Database.PollInterval) * time.Second}
+	if s.interval <= 0 {
+		s.interval = fileDefaultInterval
+	}
+	if err := s.load(conf.Credentials); err != nil {
+		return nil, err
+	}
+	if len(s.path) == 0 {
+		// Not loaded from a file, so there is nothing to watch
+		return s, nil
+	}
+	stamps, err := configStamps(s.path)
+	if err != nil {
+		return nil, err
+	}
+	s.stamps = stamps
+
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+	s.done = make(chan struct{})
+	go s.watch(ctx)
+	return s, nil
+}
+
+func (s *FileStore) Close() {
+	if s.cancel != nil {
+		s.cancel()
+		<-s.done
+	}
+}
+
+/*
+Convert the configured credentials and replace the current ones
+*/
+func (s *FileStore) load(conf config.CredentialsConfig) error {
+	tokens := make([]Token, 0, len(conf.Tokens))
+	for i, t := range conf.Tokens {
+		token := Token{Path: t.Path, Action: t.Action, QueryToken: t.Token, ValidFrom: t.ValidFrom, ExpiresAt: t.ExpiresAt,
+			MaxConnections: t.MaxConnections, MaxUses: t.MaxUses, BindFirstIp: t.BindFirstIp}
+		for _, entry := range t.AllowedCidrs {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return fmt.Errorf("credentials.tokens[%v]: invalid CIDR %v", i, entry)
+			}
+			token.AllowedCidrs = append(token.AllowedCidrs, prefix.Masked())
+		}
+		tokens = append(tokens, token)
+	}
+	users := make([]MemoryUser, 0, len(conf.Users))
+	for _, u := range conf.Users {
+		user := MemoryUser{Username: u.Username, PasswordHash: u.PasswordHash}
+		for _, grant := range u.Grants {
+			user.Grants = append(user.Grants, MemoryGrant{Path: grant.Path, Action: grant.Action})
+		}
+		users = append(users, user)
+	}
+	s.memory.Replace(tokens, users)
+	return nil
+}
+
+func (s *FileStore) watch(ctx context.Context) {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.reload()
+		}
+	}
+}
+
+/*
+Reload the credentials if any config file changed, keeping the current credentials if the new ones are invalid
+*/
+func (s *FileStore) reload() {
+	stamps, err := configStamps(s.path)
+	if err != nil {
+		slog.Error("Error while checking config files for changes", "err", err)
+		return
+	}
+	if slices.Equal(stamps, s.stamps) {
+		return
+	}
+	s.stamps = stamps
+
+	slog.Info("Config changed, reloading credentials", "path", s.path)
+	conf, err := config.ReloadConfig(s.path)
+	if err == nil {
+		err = conf.Credentials.Validate()
+	}
+	if err == nil {
+		err = s.load(conf.Credentials)
+	}
+	if err != nil {
+		slog.Error("Error while reloading credentials, keeping the previous credentials", "err", err)
+	}
+}
+
+func configStamps(path string) ([]fileStamp, error) {
+	files, err := config.ConfigFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	stamps := make([]fileStamp, 0, len(files))
+	for _, f := range files {
+		stat, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		stamps = append(stamps, fileStamp{name: f, size: stat.Size(), modTime: stat.ModTime()})
+	}
+	return stamps, nil
+}
+
+func (s *FileStore) LookupToken(ctx context.Context, creds Credentials) ([]Token, error) {
+	return s.memory.LookupToken(ctx, creds)
+}
+
+func (s *FileStore) LookupUser(ctx context.Context, creds Credentials) (string, bool, error) {
+	return s.memory.LookupUser(ctx, creds)
+}
+
+func (s *FileStore) ConsumeUse(ctx context.Context, creds Credentials) (bool, error) {
+	return s.memory.ConsumeUse(ctx, creds)
+}
+
+func (s *FileStore) BindIp(ctx context.Context, creds Credentials, prefix netip.Prefix) (netip.Prefix, error) {
+	return s.memory.BindIp(ctx, creds, prefix)
+}
+
+func (s *FileStore) ChangedSince(ctx context.Context, since time.Time) ([]Credentials, error) {
+	return s.memory.ChangedSince(ctx, since)
+}
+
+func (s *FileStore) ActiveTokens(ctx context.Context, creds []Credentials) ([]Credentials, error) {
+	return s.memory.ActiveTokens(ctx, creds)
+}
+
+func (s *FileStore) EnableNotify(ctx context.Context) error {
+	return s.memory.EnableNotify(ctx)
+}
+
+func (s *FileStore) Listen(ctx context.Context, ready func(), changed func(Change)) error {
+	return s.memory.Listen(ctx, ready, changed)
+}
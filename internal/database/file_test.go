@@ -0,0 +1,70 @@
+package database
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+	"gopkg.in/yaml.v3"
+)
+
+func writeFile(t *testing.T, path string, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileReload(t *testing.T) {
+	url, kicks := newTestMediaMtx(t)
+	dir := t.TempDir()
+	base := config.NewMainConfig()
+	base.MediaMtxUrlBase = url
+	base.MediaMtxUrlBasePublish = url
+	base.Database.Backend = "file"
+	data, err := yaml.Marshal(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "config.yaml"), string(data))
+	credentialsPath := filepath.Join(dir, "credentials.json")
+	writeFile(t, credentialsPath, `{"credentials": {"tokens": [
+		{"path": "camera", "action": "read", "token": "a", "expiresAt": "2999-01-01T00:00:00Z"}
+	]}}`)
+
+	conf, err := config.ReadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFileStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &DatabaseManager{}
+	db.InitWithStore(conf, store)
+	t.Cleanup(db.Close)
+
+	client := Client{Ip: net.ParseIP("203.0.113.5"), Connection: &Connection{Id: "conn1", Protocol: "webRTCSession"}}
+	checkValid(t, db, Credentials{Path: "camera", Action: "read", QueryToken: "a"}, client, true)
+
+	// Invalid files keep the previous credentials
+	writeFile(t, credentialsPath, `{"credentials": {"tokens": [`)
+	store.reload()
+	checkValid(t, db, Credentials{Path: "camera", Action: "read", QueryToken: "a"}, Client{Ip: client.Ip}, true)
+	// Limits which would reset on restart are invalid
+	for _, token := range []string{`"maxUses": 1`, `"bindFirstIp": true`} {
+		writeFile(t, credentialsPath, `{"credentials": {"tokens": [{"path": "camera", "action": "read", "token": "c", `+token+`}]}}`)
+		store.reload()
+		checkValid(t, db, Credentials{Path: "camera", Action: "read", QueryToken: "c"}, Client{Ip: client.Ip}, false)
+	}
+
+	writeFile(t, credentialsPath, `{"credentials": {"tokens": [
+		{"path": "camera", "action": "read", "token": "b"}
+	]}}`)
+	store.reload()
+	waitForKick(t, kicks, "/v3/webrtcsessions/kick/conn1")
+	checkValid(t, db, Credentials{Path: "camera", Action: "read", QueryToken: "a"}, Client{Ip: client.Ip}, false)
+	checkValid(t, db, Credentials{Path: "camera", Action: "read", QueryToken: "b"}, Client{Ip: client.Ip}, true)
+}
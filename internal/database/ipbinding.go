@@ -0,0 +1,101 @@
+package database
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+)
+
+/*
+Restrictions on which addresses can use a set of credentials
+*/
+type ipRestriction struct {
+	AllowedCidrs []netip.Prefix // Empty if any address is allowed
+	BindFirstIp  bool           // Lock the credentials to the address of the first client
+	BoundIp      *netip.Prefix  // Address the credentials were locked to, nil if not yet used
+}
+
+/*
+Combine restrictions from multiple rows, keeping the most permissive of each
+*/
+func (r ipRestriction) merge(other ipRestriction) ipRestriction {
+	ret := ipRestriction{BindFirstIp: r.BindFirstIp && other.BindFirstIp, BoundIp: r.BoundIp}
+	if len(r.AllowedCidrs) > 0 && len(other.AllowedCidrs) > 0 {
+		ret.AllowedCidrs = append(slices.Clone(r.AllowedCidrs), other.AllowedCidrs...)
+	}
+	if ret.BoundIp == nil {
+		ret.BoundIp = other.BoundIp
+	}
+	return ret
+}
+
+/*
+Get the prefix a client is bound to, the single address for IPv4 or the /64 for IPv6
+*/
+func bindPrefix(addr netip.Addr) netip.Prefix {
+	if addr.Is4() {
+		return netip.PrefixFrom(addr, 32)
+	}
+	prefix, _ := addr.Prefix(64)
+	return prefix
+}
+
+/*
+Check if an address is within the allowed CIDRs, if any
+*/
+func (r ipRestriction) inAllowedCidrs(addr netip.Addr) bool {
+	return len(r.AllowedCidrs) == 0 || slices.ContainsFunc(r.AllowedCidrs, func(cidr netip.Prefix) bool {
+		return cidr.Contains(addr)
+	})
+}
+
+/*
+Check if an address is allowed without binding the credentials, so credentials which must be bound are only allowed once bound
+*/
+func (r ipRestriction) allows(ip net.IP) bool {
+	if len(r.AllowedCidrs) == 0 && !r.BindFirstIp {
+		return true
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	return r.inAllowedCidrs(addr) && (!r.BindFirstIp || (r.BoundIp != nil && r.BoundIp.Contains(addr)))
+}
+
+/*
+Check the client's address is allowed to use the credentials, binding them to the address on first use if required
+
+The binding is stored with the cached credentials and checked on every request, so a cached positive result for one address is never reused for another.
+*/
+func (d *DatabaseManager) checkIp(req *Credentials, credData *CredentialData, client Client) bool {
+	restriction := credData.getIpRestriction()
+	if len(restriction.AllowedCidrs) == 0 && !restriction.BindFirstIp {
+		return true
+	}
+	addr, ok := netip.AddrFromSlice(client.Ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	if !restriction.inAllowedCidrs(addr) {
+		return false
+	}
+	if !restriction.BindFirstIp {
+		return true
+	}
+	if restriction.BoundIp != nil {
+		return restriction.BoundIp.Contains(addr)
+	}
+
+	bound, err := d.store.BindIp(context.Background(), *req, bindPrefix(addr))
+	if err != nil {
+		slog.Error("Error while binding credentials to IP", "creds", *req, "err", err)
+		return false
+	}
+	credData.setBoundIp(bound)
+	return bound.Contains(addr)
+}
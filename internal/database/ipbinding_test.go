@@ -0,0 +1,94 @@
+package database
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+)
+
+func TestBindPrefix(t *testing.T) {
+	for addr, target := range map[string]string{
+		"203.0.113.5":          "203.0.113.5/32",
+		"2001:db8:1:2:3:4:5:6": "2001:db8:1:2::/64",
+	} {
+		if prefix := bindPrefix(netip.MustParseAddr(addr)); prefix != netip.MustParsePrefix(target) {
+			t.Errorf("Wrong prefix for %v: need (%v) got (%v)\n", addr, target, prefix)
+		}
+	}
+}
+
+func TestIpRestrictionMerge(t *testing.T) {
+	bound := netip.MustParsePrefix("203.0.113.5/32")
+	a := ipRestriction{AllowedCidrs: []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}, BindFirstIp: true}
+	b := ipRestriction{AllowedCidrs: []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")}, BindFirstIp: true, BoundIp: &bound}
+	merged := a.merge(b)
+	if len(merged.AllowedCidrs) != 2 || !merged.BindFirstIp || merged.BoundIp == nil || *merged.BoundIp != bound {
+		t.Errorf("Wrong merge of restricted rows: %+v\n", merged)
+	}
+	// A row without restrictions allows any address
+	if merged = a.merge(ipRestriction{}); len(merged.AllowedCidrs) != 0 || merged.BindFirstIp {
+		t.Errorf("Wrong merge with unrestricted row: %+v\n", merged)
+	}
+}
+
+func TestIpRestrictionAllows(t *testing.T) {
+	bound := netip.MustParsePrefix("203.0.113.5/32")
+	cidrs := []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}
+	for _, c := range []struct {
+		restriction ipRestriction
+		ip          string
+		target      bool
+	}{
+		{ipRestriction{}, "198.51.100.1", true},
+		{ipRestriction{AllowedCidrs: cidrs}, "203.0.113.6", true},
+		{ipRestriction{AllowedCidrs: cidrs}, "198.51.100.1", false},
+		// IPv4-mapped IPv6 addresses are matched as IPv4
+		{ipRestriction{AllowedCidrs: cidrs}, "::ffff:203.0.113.6", true},
+		// Credentials which must be bound are only allowed once bound
+		{ipRestriction{BindFirstIp: true}, "203.0.113.5", false},
+		{ipRestriction{BindFirstIp: true, BoundIp: &bound}, "203.0.113.5", true},
+		{ipRestriction{BindFirstIp: true, BoundIp: &bound}, "203.0.113.6", false},
+	} {
+		if allowed := c.restriction.allows(net.ParseIP(c.ip)); allowed != c.target {
+			t.Errorf("Wrong result for %v with %+v: need (%v) got (%v)\n", c.ip, c.restriction, c.target, allowed)
+		}
+	}
+}
+
+func TestBindIpv6Prefix(t *testing.T) {
+	db, store, _ := newTestManager(t)
+	token := createToken(t, store, Token{Path: "stream", Action: "read", QueryToken: "a", BindFirstIp: true})
+	creds := token.Credentials()
+	checkValid(t, db, creds, Client{Ip: net.ParseIP("2001:db8:1:2::1")}, true)
+	// Clients move between addresses in the same /64
+	checkValid(t, db, creds, Client{Ip: net.ParseIP("2001:db8:1:2::2")}, true)
+	checkValid(t, db, creds, Client{Ip: net.ParseIP("2001:db8:1:3::1")}, false)
+}
+
+func TestBoundIpPersisted(t *testing.T) {
+	db, store, _ := newTestManager(t)
+	token := createToken(t, store, Token{Path: "stream", Action: "read", QueryToken: "a", BindFirstIp: true})
+	creds := token.Credentials()
+	checkValid(t, db, creds, Client{Ip: net.ParseIP("203.0.113.5")}, true)
+	stored, err := store.GetToken(context.Background(), token.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.BoundIp == nil || *stored.BoundIp != netip.MustParsePrefix("203.0.113.5/32") {
+		t.Errorf("Wrong bound IP stored: %v\n", stored.BoundIp)
+	}
+
+	// Another server sharing the store keeps the binding
+	url, _ := newTestMediaMtx(t)
+	conf := config.NewMainConfig()
+	conf.MediaMtxUrlBase = url
+	conf.MediaMtxUrlBasePublish = url
+	other := &DatabaseManager{}
+	other.InitWithStore(&conf, store)
+	defer other.Close()
+	checkValid(t, other, creds, Client{Ip: net.ParseIP("203.0.113.6")}, false)
+	checkValid(t, other, creds, Client{Ip: net.ParseIP("203.0.113.5")}, true)
+}
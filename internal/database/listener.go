@@ -0,0 +1,78 @@
+package database
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+const (
+	listenerMinReconnect = time.Second
+	listenerMaxReconnect = 30 * time.Second
+)
+
+/*
+Listens for changes pushed by the store and applies them as they happen
+*/
+type DatabaseListener struct {
+	db       *DatabaseManager
+	notifier ChangeNotifier
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (d *DatabaseListener) Start() {
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	d.done = make(chan struct{})
+	go d.loop()
+}
+
+func (d *DatabaseListener) Close() {
+	d.cancel()
+	<-d.done
+}
+
+func (d *DatabaseListener) loop() {
+	defer close(d.done)
+	delay := listenerMinReconnect
+	for {
+		connected := false
+		err := d.notifier.Listen(d.ctx, func() {
+			connected = true
+			// Any changes made while disconnected were missed, so revalidate everything in the cache
+			d.catchUp()
+		}, d.apply)
+		if d.ctx.Err() != nil {
+			return
+		}
+		if connected {
+			delay = listenerMinReconnect
+		}
+		slog.Warn("Database listener disconnected, reconnecting", "delay", delay, "err", err)
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, listenerMaxReconnect)
+	}
+}
+
+func (d *DatabaseListener) apply(change Change) {
+	if len(change.User) > 0 {
+		d.db.refreshUser(change.User)
+		return
+	}
+	d.db.refresh(change.Creds)
+}
+
+/*
+Revalidate all cached credentials
+*/
+func (d *DatabaseListener) catchUp() {
+	for _, creds := range d.db.cache.Keys() {
+		d.db.refresh(creds)
+	}
+}
@@ -0,0 +1,65 @@
+package database
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+)
+
+/*
+Store notifier which only connects, for testing the catch up on connecting
+*/
+type connectOnlyNotifier struct{}
+
+func (connectOnlyNotifier) EnableNotify(ctx context.Context) error {
+	return nil
+}
+
+func (connectOnlyNotifier) Listen(ctx context.Context, ready func(), changed func(Change)) error {
+	ready()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestListenerCreated(t *testing.T) {
+	db, store, _ := newTestManager(t)
+	creds := Credentials{Path: "stream", Action: "read", QueryToken: "a"}
+	client := Client{Ip: net.ParseIP("203.0.113.5")}
+	checkValid(t, db, creds, client, false)
+
+	// The cached rejection is replaced as soon as the notification arrives
+	createToken(t, store, Token{Path: "stream", Action: "read", QueryToken: "a"})
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if item := db.cache.Get(creds); item != nil && item.Value().isValid() {
+			break
+		}
+	}
+	checkValid(t, db, creds, client, true)
+}
+
+func TestListenerCatchUp(t *testing.T) {
+	url, kicks := newTestMediaMtx(t)
+	conf := config.NewMainConfig()
+	conf.MediaMtxUrlBase = url
+	conf.MediaMtxUrlBasePublish = url
+	conf.Database.ChangeDetection = "poll"
+	conf.Database.PollInterval = 3600
+	store := NewMemoryStore()
+	db := &DatabaseManager{}
+	db.InitWithStore(&conf, store)
+	defer db.Close()
+
+	token := createToken(t, store, Token{Path: "stream", Action: "read", QueryToken: "a"})
+	checkValid(t, db, token.Credentials(), Client{Ip: net.ParseIP("203.0.113.5"), Connection: &Connection{Id: "conn1", Protocol: "rtspSession"}}, true)
+	// Revoked while nothing is listening, so only the catch up on connecting can find it
+	if _, err := store.RevokeToken(context.Background(), token.Id); err != nil {
+		t.Fatal(err)
+	}
+	listener := &DatabaseListener{db: db, notifier: connectOnlyNotifier{}}
+	listener.Start()
+	defer listener.Close()
+	waitForKick(t, kicks, "/v3/rtspsessions/kick/conn1")
+}
@@ -0,0 +1,385 @@
+package database
+
+import (
+	"context"
+	"maps"
+	"net/netip"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+User in a MemoryStore
+*/
+type MemoryUser struct {
+	Username     string
+	PasswordHash string
+	Revoked      bool
+	Grants       []MemoryGrant
+}
+
+/*
+Path and action a MemoryStore user can access
+*/
+type MemoryGrant struct {
+	Path   string
+	Action string
+}
+
+/*
+Credentials held in memory, which push every change to listeners
+*/
+type MemoryStore struct {
+	mutex   sync.Mutex
+	tokens  []Token
+	updated map[int64]time.Time // Last change to each token row which affects validity
+	users   map[string]MemoryUser
+	nextId  int64
+
+	listenerMutex sync.Mutex
+	listeners     map[*memoryListener]struct{}
+}
+
+type memoryListener struct {
+	changes chan Change
+	done    chan struct{}
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{updated: map[int64]time.Time{}, users: map[string]MemoryUser{}, nextId: 1, listeners: map[*memoryListener]struct{}{}}
+}
+
+func (s *MemoryStore) Close() {}
+
+/*
+Find a token row by credentials or ID, must hold the mutex
+*/
+func (s *MemoryStore) find(fn func(t *Token) bool) []*Token {
+	var found []*Token
+	for i := range s.tokens {
+		if fn(&s.tokens[i]) {
+			found = append(found, &s.tokens[i])
+		}
+	}
+	return found
+}
+
+func activeRow(creds Credentials) func(t *Token) bool {
+	return func(t *Token) bool {
+		return t.RevokedAt == nil && t.Path == creds.Path && t.Action == creds.Action && t.QueryToken == creds.QueryToken
+	}
+}
+
+func (s *MemoryStore) LookupToken(ctx context.Context, creds Credentials) ([]Token, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rows := []Token{}
+	for _, t := range s.find(activeRow(creds)) {
+		rows = append(rows, *t)
+	}
+	return rows, nil
+}
+
+func (s *MemoryStore) LookupUser(ctx context.Context, creds Credentials) (string, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user, ok := s.users[creds.User]
+	if !ok || user.Revoked {
+		return "", false, nil
+	}
+	return user.PasswordHash, slices.Contains(user.Grants, MemoryGrant{Path: creds.Path, Action: creds.Action}), nil
+}
+
+func (s *MemoryStore) ConsumeUse(ctx context.Context, creds Credentials) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// Only one of any duplicate rows is consumed
+	for _, t := range s.find(activeRow(creds)) {
+		if t.MaxUses != nil && t.UseCount < *t.MaxUses {
+			t.UseCount++
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *MemoryStore) BindIp(ctx context.Context, creds Credentials, prefix netip.Prefix) (netip.Prefix, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rows := s.find(activeRow(creds))
+	for _, t := range rows {
+		if t.BoundIp != nil {
+			// Another request bound the credentials first
+			return *t.BoundIp, nil
+		}
+	}
+	for _, t := range rows {
+		if t.BindFirstIp {
+			t.BoundIp = &prefix
+		}
+	}
+	return prefix, nil
+}
+
+func (s *MemoryStore) ChangedSince(ctx context.Context, since time.Time) ([]Credentials, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	changed := []Credentials{}
+	for _, t := range s.find(func(t *Token) bool { return s.updated[t.Id].After(since) }) {
+		if !slices.Contains(changed, t.Credentials()) {
+			changed = append(changed, t.Credentials())
+		}
+	}
+	return changed, nil
+}
+
+func (s *MemoryStore) ActiveTokens(ctx context.Context, creds []Credentials) ([]Credentials, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	active := []Credentials{}
+	for _, c := range creds {
+		if len(s.find(activeRow(c))) > 0 {
+			active = append(active, c)
+		}
+	}
+	return active, nil
+}
+
+func (s *MemoryStore) EnableNotify(ctx context.Context) error {
+	return nil
+}
+
+func (s *MemoryStore) Listen(ctx context.Context, ready func(), changed func(Change)) error {
+	listener := &memoryListener{changes: make(chan Change), done: make(chan struct{})}
+	s.listenerMutex.Lock()
+	s.listeners[listener] = struct{}{}
+	s.listenerMutex.Unlock()
+	defer func() {
+		s.listenerMutex.Lock()
+		delete(s.listeners, listener)
+		s.listenerMutex.Unlock()
+		close(listener.done)
+	}()
+
+	ready()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case change := <-listener.changes:
+			changed(change)
+		}
+	}
+}
+
+/*
+Push a change to all listeners, which must be done without holding the mutex as listeners read the store
+*/
+func (s *MemoryStore) notify(change Change) {
+	s.listenerMutex.Lock()
+	listeners := make([]*memoryListener, 0, len(s.listeners))
+	for listener := range s.listeners {
+		listeners = append(listeners, listener)
+	}
+	s.listenerMutex.Unlock()
+	for _, listener := range listeners {
+		select {
+		case listener.changes <- change:
+		case <-listener.done:
+		}
+	}
+}
+
+func (s *MemoryStore) CreateToken(ctx context.Context, t Token) (Token, error) {
+	s.mutex.Lock()
+	t.Id = s.nextId
+	s.nextId++
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = time.Now()
+	}
+	t.RevokedAt, t.UseCount, t.BoundIp = nil, 0, nil
+	s.tokens = append(s.tokens, t)
+	s.updated[t.Id] = time.Now()
+	s.mutex.Unlock()
+	s.notify(Change{Creds: t.Credentials()})
+	return t, nil
+}
+
+func (s *MemoryStore) GetToken(ctx context.Context, id int64) (Token, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rows := s.find(func(t *Token) bool { return t.Id == id })
+	if len(rows) == 0 {
+		return Token{}, ErrNotFound
+	}
+	return *rows[0], nil
+}
+
+func (s *MemoryStore) ListTokens(ctx context.Context, filter TokenFilter) ([]Token, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	tokens := []Token{}
+	for _, t := range s.tokens {
+		if t.Id <= filter.After || (len(filter.Path) > 0 && t.Path != filter.Path) || (len(filter.Action) > 0 && t.Action != filter.Action) {
+			continue
+		}
+		if filter.Active != nil {
+			active := t.RevokedAt == nil && (t.ValidFrom == nil || !t.ValidFrom.After(now)) && (t.ExpiresAt == nil || t.ExpiresAt.After(now))
+			if active != *filter.Active {
+				continue
+			}
+		}
+		tokens = append(tokens, t)
+		if filter.Limit > 0 && len(tokens) == filter.Limit {
+			break
+		}
+	}
+	return tokens, nil
+}
+
+func (s *MemoryStore) UpdateToken(ctx context.Context, id int64, update TokenUpdate) (Token, error) {
+	s.mutex.Lock()
+	rows := s.find(func(t *Token) bool { return t.Id == id })
+	if len(rows) == 0 {
+		s.mutex.Unlock()
+		return Token{}, ErrNotFound
+	}
+	t := rows[0]
+	if update.ValidFrom.Set {
+		t.ValidFrom = update.ValidFrom.Value
+	}
+	if update.ExpiresAt.Set {
+		t.ExpiresAt = update.ExpiresAt.Value
+	}
+	if update.MaxConnections.Set {
+		t.MaxConnections = update.MaxConnections.Value
+	}
+	if update.MaxUses.Set {
+		t.MaxUses = update.MaxUses.Value
+	}
+	if update.AllowedCidrs.Set {
+		t.AllowedCidrs = nil
+		if update.AllowedCidrs.Value != nil {
+			t.AllowedCidrs = *update.AllowedCidrs.Value
+		}
+	}
+	if update.BindFirstIp.Set && update.BindFirstIp.Value != nil {
+		t.BindFirstIp = *update.BindFirstIp.Value
+	}
+	if update.BoundIp.Set {
+		t.BoundIp = update.BoundIp.Value
+	}
+	s.updated[t.Id] = time.Now()
+	updated := *t
+	s.mutex.Unlock()
+	s.notify(Change{Creds: updated.Credentials()})
+	return updated, nil
+}
+
+func (s *MemoryStore) RevokeToken(ctx context.Context, id int64) (Token, error) {
+	s.mutex.Lock()
+	rows := s.find(func(t *Token) bool { return t.Id == id })
+	if len(rows) == 0 {
+		s.mutex.Unlock()
+		return Token{}, ErrNotFound
+	}
+	if rows[0].RevokedAt == nil {
+		now := time.Now()
+		rows[0].RevokedAt = &now
+		s.updated[rows[0].Id] = now
+	}
+	revoked := *rows[0]
+	s.mutex.Unlock()
+	s.notify(Change{Creds: revoked.Credentials()})
+	return revoked, nil
+}
+
+/*
+Create or replace a user
+*/
+func (s *MemoryStore) SetUser(user MemoryUser) {
+	s.mutex.Lock()
+	user.Grants = slices.Clone(user.Grants)
+	s.users[user.Username] = user
+	s.mutex.Unlock()
+	s.notify(Change{User: user.Username})
+}
+
+func (s *MemoryStore) DeleteUser(username string) {
+	s.mutex.Lock()
+	delete(s.users, username)
+	s.mutex.Unlock()
+	s.notify(Change{User: username})
+}
+
+/*
+Replace all credentials, keeping the consumed uses and bound IPs of tokens which remain, and notifying listeners of every
+token and user which was added, changed or removed
+*/
+func (s *MemoryStore) Replace(tokens []Token, users []MemoryUser) {
+	s.mutex.Lock()
+	now := time.Now()
+	previous := map[Credentials][]Token{}
+	for _, t := range s.tokens {
+		if t.RevokedAt == nil {
+			previous[t.Credentials()] = append(previous[t.Credentials()], t)
+		}
+	}
+
+	changed := map[Credentials]bool{}
+	replaced := make([]Token, 0, len(tokens))
+	for _, t := range tokens {
+		creds := t.Credentials()
+		t.RevokedAt = nil
+		if rows := previous[creds]; len(rows) > 0 {
+			previous[creds] = rows[1:]
+			t.Id, t.CreatedAt, t.UseCount, t.BoundIp = rows[0].Id, rows[0].CreatedAt, rows[0].UseCount, rows[0].BoundIp
+			if !reflect.DeepEqual(t, rows[0]) {
+				changed[creds] = true
+				s.updated[t.Id] = now
+			}
+		} else {
+			t.Id, t.CreatedAt, t.UseCount, t.BoundIp = s.nextId, now, 0, nil
+			s.nextId++
+			changed[creds] = true
+			s.updated[t.Id] = now
+		}
+		replaced = append(replaced, t)
+	}
+	for creds, rows := range previous {
+		if len(rows) > 0 {
+			changed[creds] = true
+		}
+	}
+	s.tokens = replaced
+	maps.DeleteFunc(s.updated, func(id int64, _ time.Time) bool {
+		return !slices.ContainsFunc(replaced, func(t Token) bool { return t.Id == id })
+	})
+
+	changedUsers := []string{}
+	replacedUsers := make(map[string]MemoryUser, len(users))
+	for _, user := range users {
+		user.Grants = slices.Clone(user.Grants)
+		replacedUsers[user.Username] = user
+		if prev, ok := s.users[user.Username]; !ok || !reflect.DeepEqual(prev, user) {
+			changedUsers = append(changedUsers, user.Username)
+		}
+	}
+	for username := range s.users {
+		if _, ok := replacedUsers[username]; !ok {
+			changedUsers = append(changedUsers, username)
+		}
+	}
+	s.users = replacedUsers
+	s.mutex.Unlock()
+
+	for creds := range changed {
+		s.notify(Change{Creds: creds})
+	}
+	for _, username := range changedUsers {
+		s.notify(Change{User: username})
+	}
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	ttlcache "github.com/jellydator/ttlcache/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/pseudoresonance/authserver/internal/metrics"
+)
+
+var (
+	cacheHitsDesc        = prometheus.NewDesc(metrics.Name("cache", "hits_total"), "Cache lookups which found an item.", []string{"cache"}, nil)
+	cacheMissesDesc      = prometheus.NewDesc(metrics.Name("cache", "misses_total"), "Cache lookups which found no item.", []string{"cache"}, nil)
+	cacheInsertionsDesc  = prometheus.NewDesc(metrics.Name("cache", "insertions_total"), "Items inserted into the cache.", []string{"cache"}, nil)
+	cacheEvictionsDesc   = prometheus.NewDesc(metrics.Name("cache", "evictions_total"), "Items expired or removed from the cache.", []string{"cache"}, nil)
+	cacheItemsDesc       = prometheus.NewDesc(metrics.Name("cache", "items"), "Items currently in the cache.", []string{"cache"}, nil)
+	trackedConnsDesc     = prometheus.NewDesc(metrics.Name("", "tracked_connections"), "MediaMTX connections currently tracked for kicking.", nil, nil)
+	pollerLagDesc        = prometheus.NewDesc(metrics.Name("poller", "lag_seconds"), "Time since the database was last polled for changes.", nil, nil)
+	auditQueueDesc       = prometheus.NewDesc(metrics.Name("audit", "queue_length"), "Audit entries waiting to be written to the database.", nil, nil)
+	streamsDesc          = prometheus.NewDesc(metrics.Name("", "streams"), "Streams ready or being read on MediaMTX, from the lifecycle webhooks.", nil, nil)
+	streamReadersDesc    = prometheus.NewDesc(metrics.Name("", "stream_readers"), "Readers of streams on MediaMTX, from the lifecycle webhooks.", nil, nil)
+	poolConnsDesc        = prometheus.NewDesc(metrics.Name("postgres", "pool_connections"), "PostgreSQL pool connections, by state.", []string{"state"}, nil)
+	poolMaxConnsDesc     = prometheus.NewDesc(metrics.Name("postgres", "pool_max_connections"), "Maximum size of the PostgreSQL pool.", nil, nil)
+	poolAcquiresDesc     = prometheus.NewDesc(metrics.Name("postgres", "pool_acquires_total"), "Connections acquired from the PostgreSQL pool.", nil, nil)
+	poolEmptyAcquireDesc = prometheus.NewDesc(metrics.Name("postgres", "pool_empty_acquires_total"), "Acquires which waited for a connection as the pool was empty.", nil, nil)
+	poolAcquireTimeDesc  = prometheus.NewDesc(metrics.Name("postgres", "pool_acquire_seconds_total"), "Total time spent acquiring connections from the PostgreSQL pool.", nil, nil)
+)
+
+/*
+Collects the state of the caches, connection tracking, change detection and store when scraped
+*/
+type managerCollector struct {
+	d *DatabaseManager
+}
+
+/*
+Collector for the state of a started manager, to be registered with the metrics registry
+*/
+func (d *DatabaseManager) Collector() prometheus.Collector {
+	return managerCollector{d: d}
+}
+
+func (c managerCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{cacheHitsDesc, cacheMissesDesc, cacheInsertionsDesc, cacheEvictionsDesc, cacheItemsDesc, trackedConnsDesc,
+		pollerLagDesc, auditQueueDesc, streamsDesc, streamReadersDesc, poolConnsDesc, poolMaxConnsDesc, poolAcquiresDesc, poolEmptyAcquireDesc, poolAcquireTimeDesc} {
+		ch <- desc
+	}
+}
+
+func (c managerCollector) Collect(ch chan<- prometheus.Metric) {
+	collectCache(ch, "credentials", c.d.cache.Metrics(), c.d.cache.Len())
+	collectCache(ch, "connections", c.d.connections.Metrics(), c.d.connections.Len())
+	ch <- prometheus.MustNewConstMetric(trackedConnsDesc, prometheus.GaugeValue, float64(c.d.connections.Len()))
+
+	if poller, ok := c.d.watcher.(*DatabasePoller); ok {
+		ch <- prometheus.MustNewConstMetric(pollerLagDesc, prometheus.GaugeValue, time.Since(poller.GetLastPoll()).Seconds())
+	}
+
+	if c.d.audit != nil {
+		ch <- prometheus.MustNewConstMetric(auditQueueDesc, prometheus.GaugeValue, float64(len(c.d.audit.queue)))
+	}
+
+	streams, readers := 0, 0
+	for _, stream := range c.d.Streams() {
+		streams++
+		readers += stream.Readers
+	}
+	ch <- prometheus.MustNewConstMetric(streamsDesc, prometheus.GaugeValue, float64(streams))
+	ch <- prometheus.MustNewConstMetric(streamReadersDesc, prometheus.GaugeValue, float64(readers))
+
+	if store, ok := c.d.store.(*PostgresStore); ok {
+		stat := store.pool.Stat()
+		ch <- prometheus.MustNewConstMetric(poolConnsDesc, prometheus.GaugeValue, float64(stat.AcquiredConns()), "acquired")
+		ch <- prometheus.MustNewConstMetric(poolConnsDesc, prometheus.GaugeValue, float64(stat.IdleConns()), "idle")
+		ch <- prometheus.MustNewConstMetric(poolConnsDesc, prometheus.GaugeValue, float64(stat.ConstructingConns()), "constructing")
+		ch <- prometheus.MustNewConstMetric(poolMaxConnsDesc, prometheus.GaugeValue, float64(stat.MaxConns()))
+		ch <- prometheus.MustNewConstMetric(poolAcquiresDesc, prometheus.CounterValue, float64(stat.AcquireCount()))
+		ch <- prometheus.MustNewConstMetric(poolEmptyAcquireDesc, prometheus.CounterValue, float64(stat.EmptyAcquireCount()))
+		ch <- prometheus.MustNewConstMetric(poolAcquireTimeDesc, prometheus.CounterValue, stat.AcquireDuration().Seconds())
+	}
+}
+
+func collectCache(ch chan<- prometheus.Metric, name string, m ttlcache.Metrics, items int) {
+	ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(m.Hits), name)
+	ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(m.Misses), name)
+	ch <- prometheus.MustNewConstMetric(cacheInsertionsDesc, prometheus.CounterValue, float64(m.Insertions), name)
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(m.Evictions), name)
+	ch <- prometheus.MustNewConstMetric(cacheItemsDesc, prometheus.GaugeValue, float64(items), name)
+}
+
+type queryStartKey struct{}
+
+/*
+Records the duration of every PostgreSQL query
+*/
+type queryTracer struct{}
+
+func (queryTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, queryStartKey{}, time.Now())
+}
+
+func (queryTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	start, ok := ctx.Value(queryStartKey{}).(time.Time)
+	if !ok {
+		return
+	}
+	result := "ok"
+	if data.Err != nil && !errors.Is(data.Err, pgx.ErrNoRows) {
+		result = "error"
+	}
+	metrics.QueryDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
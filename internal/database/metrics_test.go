@@ -0,0 +1,27 @@
+package database
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	db, store, _ := newTestManager(t)
+	token := createToken(t, store, Token{Path: "stream", Action: "read", QueryToken: "a"})
+	checkValid(t, db, token.Credentials(), Client{Ip: net.ParseIP("203.0.113.5"), Connection: &Connection{Id: "conn1", Protocol: "rtspSession"}}, true)
+
+	if problems, err := testutil.CollectAndLint(db.Collector()); err != nil || len(problems) > 0 {
+		t.Errorf("Invalid metrics: %v (%v)\n", problems, err)
+	}
+	expected := `
+# HELP mediamtxauth_tracked_connections MediaMTX connections currently tracked for kicking.
+# TYPE mediamtxauth_tracked_connections gauge
+mediamtxauth_tracked_connections 1
+`
+	if err := testutil.CollectAndCompare(db.Collector(), strings.NewReader(expected), "mediamtxauth_tracked_connections"); err != nil {
+		t.Error(err)
+	}
+}
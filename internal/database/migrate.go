@@ -0,0 +1,342 @@
+package database
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//go:embed migrations/postgres/*.sql
+var postgresMigrations embed.FS
+
+/*
+Arbitrary key for the advisory lock held while migrating, so concurrent servers and commands run migrations one at a time
+*/
+const migrationLockKey int64 = 0x6d74786175746801
+
+/*
+Prefix of the comment in up migrations naming the legacy schema version in the versions table they upgrade to
+*/
+const schemaVersionHeader = "-- Schema version: "
+
+/*
+Versioned schema change, embedded in the binary
+*/
+type Migration struct {
+	Version       int
+	Name          string
+	SchemaVersion time.Time // Legacy schema version after applying, kept in the versions table for older servers
+	up            string
+	down          string
+}
+
+/*
+Migration and when it was applied, nil if pending
+*/
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+	Adopted   bool // Recorded as applied when adopting a legacy database rather than applied, so cannot be rolled back
+}
+
+/*
+Migration recorded in the ledger
+*/
+type appliedMigration struct {
+	AppliedAt time.Time
+	Adopted   bool
+}
+
+/*
+Load the embedded migrations in version order
+*/
+func loadMigrations(files fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		name, direction, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("invalid migration file name %v", entry.Name())
+		}
+		versionText, name, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(versionText)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version %v", entry.Name())
+		}
+		data, err := fs.ReadFile(files, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if direction == "down" {
+			m.down = string(data)
+			continue
+		}
+		m.up = string(data)
+		if header, ok := strings.CutPrefix(m.up, schemaVersionHeader); ok {
+			header, _, _ = strings.Cut(header, "\n")
+			if m.SchemaVersion, err = time.Parse(time.RFC3339, strings.TrimSpace(header)); err != nil {
+				return nil, fmt.Errorf("invalid schema version in migration %v\n%w", entry.Name(), err)
+			}
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if len(m.up) == 0 || len(m.down) == 0 {
+			return nil, fmt.Errorf("migration %v is missing an up or down file", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int {
+		return a.Version - b.Version
+	})
+	return migrations, nil
+}
+
+/*
+Get all migrations and whether they have been applied
+*/
+func (s *PostgresStore) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	var status []MigrationStatus
+	err := s.withMigrationLock(ctx, func(conn *pgxpool.Conn, migrations []Migration) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			s := MigrationStatus{Migration: m}
+			if a, ok := applied[m.Version]; ok {
+				s.AppliedAt = &a.AppliedAt
+				s.Adopted = a.Adopted
+			}
+			status = append(status, s)
+		}
+		return nil
+	})
+	return status, err
+}
+
+/*
+Apply all pending migrations in order, each in its own transaction, returning the migrations applied
+*/
+func (s *PostgresStore) MigrateUp(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+	err := s.withMigrationLock(ctx, func(conn *pgxpool.Conn, migrations []Migration) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, m.up); err != nil {
+					return err
+				}
+				_, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %04d_%v failed\n%w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+/*
+Roll back the given number of most recently applied migrations, returning the migrations rolled back
+
+Adopted migrations are never rolled back, as their down migrations would drop tables created before migrations were embedded.
+*/
+func (s *PostgresStore) MigrateDown(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+	err := s.withMigrationLock(ctx, func(conn *pgxpool.Conn, migrations []Migration) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			m := migrations[i]
+			a, ok := applied[m.Version]
+			if !ok {
+				continue
+			}
+			if a.Adopted {
+				return fmt.Errorf("migration %04d_%v was adopted from a database created before migrations and cannot be rolled back", m.Version, m.Name)
+			}
+			err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, m.down); err != nil {
+					return err
+				}
+				_, err := tx.Exec(ctx, "DELETE FROM schema_migrations WHERE version = $1", m.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("rolling back migration %04d_%v failed\n%w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+/*
+Run fn on a dedicated connection while holding the migration lock, after making sure the ledger exists
+*/
+func (s *PostgresStore) withMigrationLock(ctx context.Context, fn func(conn *pgxpool.Conn, migrations []Migration) error) error {
+	migrations, err := loadMigrations(postgresMigrations, "migrations/postgres")
+	if err != nil {
+		return err
+	}
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	// Advisory locks belong to the session, so they must be taken and released on the same connection
+	var locked bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", migrationLockKey).Scan(&locked); err != nil {
+		return err
+	}
+	if !locked {
+		// Another process is migrating, wait for it to finish and continue from the state it left
+		slog.Info("Waiting for another process to finish migrating")
+		if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+			return err
+		}
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockKey)
+
+	if err := ensureLedger(ctx, conn, migrations); err != nil {
+		return err
+	}
+	return fn(conn, migrations)
+}
+
+/*
+Create the applied migrations ledger if missing
+
+Databases created before migrations were embedded are adopted by recording every migration up to their legacy schema version as applied,
+marked as adopted so they are never rolled back.
+*/
+func ensureLedger(ctx context.Context, conn *pgxpool.Conn, migrations []Migration) error {
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		var exists bool
+		if err := tx.QueryRow(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			// Ledgers created before adoption was recorded
+			_, err := tx.Exec(ctx, "ALTER TABLE schema_migrations ADD COLUMN IF NOT EXISTS adopted BOOLEAN NOT NULL DEFAULT false")
+			return err
+		}
+		_, err := tx.Exec(ctx, `CREATE TABLE schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			adopted BOOLEAN NOT NULL DEFAULT false
+		)`)
+		if err != nil {
+			return err
+		}
+
+		var legacy bool
+		if err := tx.QueryRow(ctx, "SELECT to_regclass('versions') IS NOT NULL").Scan(&legacy); err != nil || !legacy {
+			return err
+		}
+		var schemaVersion time.Time
+		err = tx.QueryRow(ctx, "SELECT version FROM versions WHERE application = 'db_version'").Scan(&schemaVersion)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if m.SchemaVersion.IsZero() || m.SchemaVersion.After(schemaVersion) {
+				break
+			}
+			if _, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, name, adopted) VALUES ($1, $2, true)", m.Version, m.Name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func appliedMigrations(ctx context.Context, conn *pgxpool.Conn) (map[int]appliedMigration, error) {
+	rows, err := conn.Query(ctx, "SELECT version, applied_at, adopted FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]appliedMigration{}
+	for rows.Next() {
+		var version int
+		var a appliedMigration
+		if err := rows.Scan(&version, &a.AppliedAt, &a.Adopted); err != nil {
+			return nil, err
+		}
+		applied[version] = a
+	}
+	return applied, rows.Err()
+}
+
+func (d *DatabaseManager) migrator() (Migrator, error) {
+	migrator, ok := d.store.(Migrator)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return migrator, nil
+}
+
+/*
+Get all migrations of the store and whether they have been applied
+*/
+func (d *DatabaseManager) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	migrator, err := d.migrator()
+	if err != nil {
+		return nil, err
+	}
+	return migrator.MigrationStatus(ctx)
+}
+
+func (d *DatabaseManager) MigrateUp(ctx context.Context) ([]Migration, error) {
+	migrator, err := d.migrator()
+	if err != nil {
+		return nil, err
+	}
+	return migrator.MigrateUp(ctx)
+}
+
+func (d *DatabaseManager) MigrateDown(ctx context.Context, steps int) ([]Migration, error) {
+	migrator, err := d.migrator()
+	if err != nil {
+		return nil, err
+	}
+	return migrator.MigrateDown(ctx, steps)
+}
@@ -0,0 +1,42 @@
+package database
+
+import (
+	"embed"
+	"strings"
+	"testing"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	for dir, files := range map[string]embed.FS{"migrations/postgres": postgresMigrations, "migrations/sqlite": sqliteMigrations} {
+		migrations, err := loadMigrations(files, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, m := range migrations {
+			if m.Version != i+1 {
+				t.Errorf("%v: migration %v_%v out of sequence, expected version %v", dir, m.Version, m.Name, i+1)
+			}
+			// Legacy schema versions must increase, as older servers still check the versions table
+			if dir == "migrations/postgres" && (m.SchemaVersion.IsZero() || i > 0 && !m.SchemaVersion.After(migrations[i-1].SchemaVersion)) {
+				t.Errorf("%v: migration %v_%v has an out of order schema version", dir, m.Version, m.Name)
+			}
+		}
+	}
+}
+
+func TestNotifyTriggersMigrated(t *testing.T) {
+	migrations, err := loadMigrations(postgresMigrations, "migrations/postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every trigger checked for at startup must be installed by a migration
+	for _, trigger := range notifyTriggers {
+		found := false
+		for _, m := range migrations {
+			found = found || strings.Contains(m.up, "CREATE TRIGGER "+trigger+" ")
+		}
+		if !found {
+			t.Errorf("Notification trigger %v not created by any migration\n", trigger)
+		}
+	}
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS stream_auth;
+DROP TABLE IF EXISTS versions;
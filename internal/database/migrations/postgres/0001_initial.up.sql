@@ -0,0 +1,13 @@
+-- Schema version: 2025-11-16T01:44:52+00:00
+CREATE TABLE IF NOT EXISTS versions (
+    application TEXT PRIMARY KEY,
+    version TIMESTAMPTZ NOT NULL
+);
+CREATE TABLE IF NOT EXISTS stream_auth (
+    path TEXT NOT NULL,
+    action TEXT NOT NULL,
+    queryToken TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS stream_auth_lookup ON stream_auth (path, action, queryToken);
+INSERT INTO versions (application, version) VALUES ('db_version', '2025-11-16T01:44:52+00:00') ON CONFLICT (application) DO NOTHING;
@@ -0,0 +1,2 @@
+ALTER TABLE stream_auth DROP COLUMN IF EXISTS valid_from, DROP COLUMN IF EXISTS expires_at;
+UPDATE versions SET version = '2025-11-16T01:44:52+00:00' WHERE application = 'db_version';
@@ -0,0 +1,3 @@
+-- Schema version: 2026-10-17T00:00:00+00:00
+ALTER TABLE stream_auth ADD COLUMN IF NOT EXISTS valid_from TIMESTAMPTZ NULL, ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ NULL;
+UPDATE versions SET version = '2026-10-17T00:00:00+00:00' WHERE application = 'db_version';
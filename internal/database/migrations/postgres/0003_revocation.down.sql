@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS stream_auth_touch ON stream_auth;
+DROP FUNCTION IF EXISTS stream_auth_touch();
+DROP INDEX IF EXISTS stream_auth_updated;
+ALTER TABLE stream_auth DROP COLUMN IF EXISTS revoked_at, DROP COLUMN IF EXISTS updated_at;
+UPDATE versions SET version = '2026-10-17T00:00:00+00:00' WHERE application = 'db_version';
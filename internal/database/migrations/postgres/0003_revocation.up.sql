@@ -0,0 +1,14 @@
+-- Schema version: 2026-10-17T01:00:00+00:00
+ALTER TABLE stream_auth ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMPTZ NULL, ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+CREATE INDEX IF NOT EXISTS stream_auth_updated ON stream_auth (updated_at);
+-- Only changes which affect validity, so consuming uses and binding IPs are not picked up by polling
+CREATE OR REPLACE FUNCTION stream_auth_touch() RETURNS trigger AS $$
+BEGIN
+    NEW.updated_at := now();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS stream_auth_touch ON stream_auth;
+CREATE TRIGGER stream_auth_touch BEFORE UPDATE OF path, action, queryToken, valid_from, expires_at, revoked_at ON stream_auth
+    FOR EACH ROW EXECUTE FUNCTION stream_auth_touch();
+UPDATE versions SET version = '2026-10-17T01:00:00+00:00' WHERE application = 'db_version';
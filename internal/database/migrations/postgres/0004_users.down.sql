@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS stream_user_grants;
+DROP TABLE IF EXISTS stream_users;
+DROP FUNCTION IF EXISTS stream_users_notify() CASCADE;
+UPDATE versions SET version = '2026-10-17T01:00:00+00:00' WHERE application = 'db_version';
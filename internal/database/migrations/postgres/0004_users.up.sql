@@ -0,0 +1,14 @@
+-- Schema version: 2026-10-17T02:00:00+00:00
+CREATE TABLE IF NOT EXISTS stream_users (
+    username TEXT PRIMARY KEY,
+    password_hash TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    revoked_at TIMESTAMPTZ NULL
+);
+CREATE TABLE IF NOT EXISTS stream_user_grants (
+    username TEXT NOT NULL REFERENCES stream_users (username) ON DELETE CASCADE,
+    path TEXT NOT NULL,
+    action TEXT NOT NULL,
+    PRIMARY KEY (username, path, action)
+);
+UPDATE versions SET version = '2026-10-17T02:00:00+00:00' WHERE application = 'db_version';
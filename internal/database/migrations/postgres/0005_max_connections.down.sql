@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS stream_auth_touch ON stream_auth;
+CREATE TRIGGER stream_auth_touch BEFORE UPDATE OF path, action, queryToken, valid_from, expires_at, revoked_at ON stream_auth
+    FOR EACH ROW EXECUTE FUNCTION stream_auth_touch();
+ALTER TABLE stream_auth DROP COLUMN IF EXISTS max_connections;
+UPDATE versions SET version = '2026-10-17T02:00:00+00:00' WHERE application = 'db_version';
@@ -0,0 +1,6 @@
+-- Schema version: 2026-10-17T04:00:00+00:00
+ALTER TABLE stream_auth ADD COLUMN IF NOT EXISTS max_uses INTEGER NULL, ADD COLUMN IF NOT EXISTS use_count INTEGER NOT NULL DEFAULT 0;
+DROP TRIGGER IF EXISTS stream_auth_touch ON stream_auth;
+CREATE TRIGGER stream_auth_touch BEFORE UPDATE OF path, action, queryToken, valid_from, expires_at, revoked_at, max_connections, max_uses ON stream_auth
+    FOR EACH ROW EXECUTE FUNCTION stream_auth_touch();
+UPDATE versions SET version = '2026-10-17T04:00:00+00:00' WHERE application = 'db_version';
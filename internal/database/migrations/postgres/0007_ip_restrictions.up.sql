@@ -0,0 +1,7 @@
+-- Schema version: 2026-10-17T05:00:00+00:00
+ALTER TABLE stream_auth ADD COLUMN IF NOT EXISTS allowed_cidrs CIDR[] NULL, ADD COLUMN IF NOT EXISTS bind_first_ip BOOLEAN NOT NULL DEFAULT false, ADD COLUMN IF NOT EXISTS bound_ip CIDR NULL;
+DROP TRIGGER IF EXISTS stream_auth_touch ON stream_auth;
+CREATE TRIGGER stream_auth_touch BEFORE UPDATE OF path, action, queryToken, valid_from, expires_at, revoked_at,
+    max_connections, max_uses, allowed_cidrs, bind_first_ip ON stream_auth
+    FOR EACH ROW EXECUTE FUNCTION stream_auth_touch();
+UPDATE versions SET version = '2026-10-17T05:00:00+00:00' WHERE application = 'db_version';
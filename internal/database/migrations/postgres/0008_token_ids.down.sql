@@ -0,0 +1,2 @@
+ALTER TABLE stream_auth DROP COLUMN IF EXISTS id;
+UPDATE versions SET version = '2026-10-17T05:00:00+00:00' WHERE application = 'db_version';
@@ -0,0 +1,3 @@
+-- Schema version: 2026-10-17T06:00:00+00:00
+ALTER TABLE stream_auth ADD COLUMN IF NOT EXISTS id BIGSERIAL UNIQUE;
+UPDATE versions SET version = '2026-10-17T06:00:00+00:00' WHERE application = 'db_version';
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS auth_audit;
+UPDATE versions SET version = '2026-10-17T06:00:00+00:00' WHERE application = 'db_version';
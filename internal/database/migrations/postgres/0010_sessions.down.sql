@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS sessions;
+UPDATE versions SET version = '2026-10-17T07:00:00+00:00' WHERE application = 'db_version';
@@ -0,0 +1,12 @@
+-- Schema version: 2026-10-17T08:00:00+00:00
+CREATE TABLE IF NOT EXISTS sessions (
+    id TEXT PRIMARY KEY,
+    protocol TEXT NOT NULL,
+    path TEXT NOT NULL,
+    action TEXT NOT NULL,
+    query_token TEXT NOT NULL,
+    username TEXT NOT NULL,
+    instance TEXT NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL
+);
+UPDATE versions SET version = '2026-10-17T08:00:00+00:00' WHERE application = 'db_version';
@@ -0,0 +1,6 @@
+DROP TRIGGER IF EXISTS stream_user_grants_notify ON stream_user_grants;
+DROP TRIGGER IF EXISTS stream_users_notify ON stream_users;
+DROP TRIGGER IF EXISTS stream_auth_notify ON stream_auth;
+DROP FUNCTION IF EXISTS stream_users_notify();
+DROP FUNCTION IF EXISTS stream_auth_notify();
+UPDATE versions SET version = '2026-10-17T08:00:00+00:00' WHERE application = 'db_version';
@@ -0,0 +1,37 @@
+-- Schema version: 2026-10-17T09:00:00+00:00
+CREATE OR REPLACE FUNCTION stream_auth_notify() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP IN ('UPDATE', 'DELETE') THEN
+		PERFORM pg_notify('stream_auth_changes', json_build_object('path', OLD.path, 'action', OLD.action, 'queryToken', OLD.queryToken)::text);
+	END IF;
+	IF TG_OP IN ('INSERT', 'UPDATE') THEN
+		PERFORM pg_notify('stream_auth_changes', json_build_object('path', NEW.path, 'action', NEW.action, 'queryToken', NEW.queryToken)::text);
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS stream_auth_notify ON stream_auth;
+CREATE TRIGGER stream_auth_notify AFTER INSERT OR UPDATE OR DELETE ON stream_auth
+	FOR EACH ROW EXECUTE FUNCTION stream_auth_notify();
+
+CREATE OR REPLACE FUNCTION stream_users_notify() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP IN ('UPDATE', 'DELETE') THEN
+		PERFORM pg_notify('stream_auth_changes', json_build_object('user', OLD.username)::text);
+	END IF;
+	IF TG_OP IN ('INSERT', 'UPDATE') THEN
+		PERFORM pg_notify('stream_auth_changes', json_build_object('user', NEW.username)::text);
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS stream_users_notify ON stream_users;
+CREATE TRIGGER stream_users_notify AFTER INSERT OR UPDATE OR DELETE ON stream_users
+	FOR EACH ROW EXECUTE FUNCTION stream_users_notify();
+
+DROP TRIGGER IF EXISTS stream_user_grants_notify ON stream_user_grants;
+CREATE TRIGGER stream_user_grants_notify AFTER INSERT OR UPDATE OR DELETE ON stream_user_grants
+	FOR EACH ROW EXECUTE FUNCTION stream_users_notify();
+UPDATE versions SET version = '2026-10-17T09:00:00+00:00' WHERE application = 'db_version';
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS stream_user_grants;
+DROP TABLE IF EXISTS stream_users;
+DROP TABLE IF EXISTS stream_auth;
@@ -0,0 +1,40 @@
+-- Timestamps are stored as fixed width UTC text (YYYY-MM-DDTHH:MM:SS.SSSZ) so they compare in order
+-- CIDR lists are stored as JSON arrays of strings
+CREATE TABLE IF NOT EXISTS stream_auth (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    path TEXT NOT NULL,
+    action TEXT NOT NULL,
+    queryToken TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+    valid_from TEXT NULL,
+    expires_at TEXT NULL,
+    revoked_at TEXT NULL,
+    max_connections INTEGER NULL,
+    max_uses INTEGER NULL,
+    use_count INTEGER NOT NULL DEFAULT 0,
+    allowed_cidrs TEXT NULL,
+    bind_first_ip INTEGER NOT NULL DEFAULT 0,
+    bound_ip TEXT NULL,
+    updated_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+);
+CREATE INDEX IF NOT EXISTS stream_auth_lookup ON stream_auth (path, action, queryToken);
+CREATE INDEX IF NOT EXISTS stream_auth_created ON stream_auth (created_at);
+CREATE INDEX IF NOT EXISTS stream_auth_updated ON stream_auth (updated_at);
+-- Only changes which affect validity, so consuming uses and binding IPs are not picked up by polling
+CREATE TRIGGER IF NOT EXISTS stream_auth_touch AFTER UPDATE OF path, action, queryToken, valid_from, expires_at, revoked_at,
+    max_connections, max_uses, allowed_cidrs, bind_first_ip ON stream_auth
+BEGIN
+    UPDATE stream_auth SET updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now') WHERE id = NEW.id;
+END;
+CREATE TABLE IF NOT EXISTS stream_users (
+    username TEXT PRIMARY KEY,
+    password_hash TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+    revoked_at TEXT NULL
+);
+CREATE TABLE IF NOT EXISTS stream_user_grants (
+    username TEXT NOT NULL REFERENCES stream_users (username) ON DELETE CASCADE,
+    path TEXT NOT NULL,
+    action TEXT NOT NULL,
+    PRIMARY KEY (username, path, action)
+);
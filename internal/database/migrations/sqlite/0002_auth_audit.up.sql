@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS auth_audit (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    decided_at TEXT NOT NULL,
+    action TEXT NOT NULL,
+    path TEXT NOT NULL,
+    protocol TEXT NOT NULL,
+    ip TEXT NOT NULL,
+    connection_id TEXT NOT NULL,
+    username TEXT NOT NULL,
+    token_hash TEXT NOT NULL,
+    result TEXT NOT NULL,
+    reason TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS auth_audit_decided ON auth_audit (decided_at);
+CREATE INDEX IF NOT EXISTS auth_audit_token ON auth_audit (token_hash, decided_at);
+CREATE INDEX IF NOT EXISTS auth_audit_path ON auth_audit (path, decided_at);
+CREATE INDEX IF NOT EXISTS auth_audit_ip ON auth_audit (ip, decided_at);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS sessions (
+    id TEXT PRIMARY KEY,
+    protocol TEXT NOT NULL,
+    path TEXT NOT NULL,
+    action TEXT NOT NULL,
+    query_token TEXT NOT NULL,
+    username TEXT NOT NULL,
+    instance TEXT NOT NULL,
+    started_at TEXT NOT NULL
+);
@@ -2,13 +2,21 @@ package database
 
 import (
 	"context"
-	"log"
+	"log/slog"
+	"maps"
+	"slices"
 	"sync"
 	"time"
 
 	ttlcache "github.com/jellydator/ttlcache/v3"
 )
 
+/*
+Changed rows are looked up from this long before the last poll, as a row's timestamp is taken when the change is made but
+the row is only visible once the change commits
+*/
+const pollOverlap = 5 * time.Second
+
 type DatabasePoller struct {
 	db *DatabaseManager
 
@@ -48,30 +56,70 @@ func (d *DatabasePoller) poll() {
 	if d.db.cache.Len() == 0 {
 		return
 	}
-	rows, err := d.db.pool.Query(context.Background(), "SELECT path, action, queryToken FROM stream_auth WHERE created_at > $1", pollTime)
+
+	changed, err := d.pollChanged(pollTime.Add(-pollOverlap))
 	if err != nil {
-		log.Printf("Error while polling database\n%v\n", err)
-		return
+		slog.Error("Error while polling database", "err", err)
+	}
+	removed, err := d.pollRemoved()
+	if err != nil {
+		slog.Error("Error while polling database", "err", err)
+	}
+
+	// Revalidate after reading all rows as the validity window must be checked as well
+	refreshed := map[Credentials]bool{}
+	for _, creds := range append(changed, removed...) {
+		if !refreshed[creds] {
+			refreshed[creds] = true
+			d.db.refresh(creds)
+		}
+	}
+}
+
+/*
+Find cached credentials with rows which have been created or changed since the last poll, such as a new token, a changed
+validity window or a revoked row being restored
+*/
+func (d *DatabasePoller) pollChanged(pollTime time.Time) ([]Credentials, error) {
+	rows, err := d.db.store.ChangedSince(context.Background(), pollTime)
+	if err != nil {
+		return nil, err
 	}
-	defer rows.Close()
-	var testCreds Credentials
-	for rows.Next() {
-		err := rows.Scan(&testCreds.Path, &testCreds.Action, &testCreds.QueryToken)
-		if err != nil {
-			log.Printf("Error while parsing database column\n%v\n", err)
-			continue
+	changed := []Credentials{}
+	for _, creds := range rows {
+		if d.db.cache.Has(creds) {
+			changed = append(changed, creds)
 		}
-		if cacheItem := d.db.cache.Get(testCreds); cacheItem != nil {
-			credData := cacheItem.Value()
-			if credData == nil {
-				credData = &CredentialData{}
-			}
-			if !credData.Valid {
-				credData.Valid = true
-				d.db.cache.Set(testCreds, credData, ttlcache.DefaultTTL)
-			}
+	}
+	return changed, nil
+}
+
+/*
+Find cached valid credentials which have since been revoked or deleted
+*/
+func (d *DatabasePoller) pollRemoved() ([]Credentials, error) {
+	cached := map[Credentials]bool{}
+	d.db.cache.Range(func(item *ttlcache.Item[Credentials, *CredentialData]) bool {
+		// Users are revalidated when their cache entry expires
+		if credData := item.Value(); credData != nil && credData.isValid() && len(item.Key().User) == 0 {
+			cached[item.Key()] = true
 		}
+		return true
+	})
+	if len(cached) == 0 {
+		return nil, nil
 	}
+
+	active, err := d.db.store.ActiveTokens(context.Background(), slices.Collect(maps.Keys(cached)))
+	if err != nil {
+		return nil, err
+	}
+	for _, creds := range active {
+		delete(cached, creds)
+	}
+
+	// Anything left over no longer has an active row
+	return slices.Collect(maps.Keys(cached)), nil
 }
 
 func (d *DatabasePoller) loop() {
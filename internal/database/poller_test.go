@@ -0,0 +1,51 @@
+package database
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+)
+
+func TestPollEmptyCache(t *testing.T) {
+	db, _, _ := newTestManager(t)
+	poller := &DatabasePoller{db: db}
+	last := time.Now().Add(-time.Minute)
+	poller.SetLastPoll(last)
+	// Nothing is cached, so the store is not queried
+	poller.poll()
+	if !poller.GetLastPoll().After(last) {
+		t.Errorf("Last poll not advanced: %v\n", poller.GetLastPoll())
+	}
+}
+
+func TestPollChanged(t *testing.T) {
+	url, _ := newTestMediaMtx(t)
+	conf := config.NewMainConfig()
+	conf.MediaMtxUrlBase = url
+	conf.MediaMtxUrlBasePublish = url
+	conf.Database.ChangeDetection = "poll"
+	conf.Database.PollInterval = 3600
+	store := NewMemoryStore()
+	db := &DatabaseManager{}
+	db.InitWithStore(&conf, store)
+	defer db.Close()
+
+	future := time.Now().Add(time.Hour)
+	token := createToken(t, store, Token{Path: "stream", Action: "read", QueryToken: "a", ValidFrom: &future})
+	creds := token.Credentials()
+	client := Client{Ip: net.ParseIP("203.0.113.5")}
+	checkValid(t, db, creds, client, false)
+
+	// A changed validity window is picked up, not only newly created rows
+	poller := &DatabasePoller{db: db}
+	poller.SetLastPoll(time.Now())
+	now := time.Now()
+	if _, err := store.UpdateToken(context.Background(), token.Id, TokenUpdate{ValidFrom: Optional[time.Time]{Set: true, Value: &now}}); err != nil {
+		t.Fatal(err)
+	}
+	poller.poll()
+	checkValid(t, db, creds, client, true)
+}
@@ -0,0 +1,205 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pseudoresonance/authserver/internal/config"
+)
+
+const notifyChannel = "stream_auth_changes"
+
+/*
+Triggers installed by migration which notify listeners of any change to stream_auth and users
+*/
+var notifyTriggers = []string{"stream_auth_notify", "stream_users_notify", "stream_user_grants_notify"}
+
+/*
+Notification payload sent by the stream_auth and user triggers
+*/
+type notifyPayload struct {
+	Path       string `json:"path"`
+	Action     string `json:"action"`
+	QueryToken string `json:"queryToken"`
+	User       string `json:"user"`
+}
+
+/*
+Credentials stored in PostgreSQL
+*/
+type PostgresStore struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresStore(ctx context.Context, conf config.DatabaseConfig) (*PostgresStore, error) {
+	pgConf, err := pgxpool.ParseConfig("")
+	if err != nil {
+		return nil, err
+	}
+	pgConf.ConnConfig.Host = conf.Hostname
+	pgConf.ConnConfig.Port = uint16(conf.Port)
+	pgConf.ConnConfig.Database = conf.Database
+	pgConf.ConnConfig.User = conf.Username
+	pgConf.ConnConfig.Password = conf.Password
+	pgConf.ConnConfig.Tracer = queryTracer{}
+
+	pool, err := pgxpool.NewWithConfig(ctx, pgConf)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresStore{pool: pool}, nil
+}
+
+func (s *PostgresStore) Close() {
+	s.pool.Close()
+}
+
+func (s *PostgresStore) LookupToken(ctx context.Context, creds Credentials) ([]Token, error) {
+	rows, err := s.pool.Query(ctx, "SELECT "+tokenColumns+" FROM stream_auth WHERE path = $1 AND action = $2 AND queryToken = $3 AND revoked_at IS NULL",
+		creds.Path, creds.Action, creds.QueryToken)
+	if err != nil {
+		return nil, err
+	}
+	return scanTokens(rows)
+}
+
+func (s *PostgresStore) LookupUser(ctx context.Context, creds Credentials) (string, bool, error) {
+	var hash string
+	var granted bool
+	err := s.pool.QueryRow(ctx, `SELECT password_hash,
+		EXISTS (SELECT 1 FROM stream_user_grants WHERE username = $1 AND path = $2 AND action = $3)
+		FROM stream_users WHERE username = $1 AND revoked_at IS NULL`, creds.User, creds.Path, creds.Action).Scan(&hash, &granted)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", false, nil
+	}
+	return hash, granted, err
+}
+
+func (s *PostgresStore) ConsumeUse(ctx context.Context, creds Credentials) (bool, error) {
+	var useCount int
+	// Only one of any duplicate rows is consumed
+	err := s.pool.QueryRow(ctx, `UPDATE stream_auth SET use_count = use_count + 1
+		WHERE id = (SELECT id FROM stream_auth
+			WHERE path = $1 AND action = $2 AND queryToken = $3 AND revoked_at IS NULL AND use_count < max_uses
+			ORDER BY id LIMIT 1 FOR UPDATE)
+		RETURNING use_count`, creds.Path, creds.Action, creds.QueryToken).Scan(&useCount)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// All uses have been consumed
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *PostgresStore) BindIp(ctx context.Context, creds Credentials, prefix netip.Prefix) (netip.Prefix, error) {
+	var bound netip.Prefix
+	err := s.pool.QueryRow(ctx, `UPDATE stream_auth SET bound_ip = $4
+		WHERE path = $1 AND action = $2 AND queryToken = $3 AND revoked_at IS NULL AND bind_first_ip AND bound_ip IS NULL
+		RETURNING bound_ip`, creds.Path, creds.Action, creds.QueryToken, prefix).Scan(&bound)
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return bound, err
+	}
+	// Another request bound the credentials first
+	err = s.pool.QueryRow(ctx, `SELECT bound_ip FROM stream_auth
+		WHERE path = $1 AND action = $2 AND queryToken = $3 AND revoked_at IS NULL AND bound_ip IS NOT NULL
+		LIMIT 1`, creds.Path, creds.Action, creds.QueryToken).Scan(&bound)
+	return bound, err
+}
+
+func (s *PostgresStore) ChangedSince(ctx context.Context, since time.Time) ([]Credentials, error) {
+	rows, err := s.pool.Query(ctx, "SELECT DISTINCT path, action, queryToken FROM stream_auth WHERE updated_at > $1", since)
+	if err != nil {
+		return nil, err
+	}
+	return scanCredentials(rows)
+}
+
+func (s *PostgresStore) ActiveTokens(ctx context.Context, creds []Credentials) ([]Credentials, error) {
+	paths := make([]string, len(creds))
+	actions := make([]string, len(creds))
+	tokens := make([]string, len(creds))
+	for i, c := range creds {
+		paths[i], actions[i], tokens[i] = c.Path, c.Action, c.QueryToken
+	}
+	rows, err := s.pool.Query(ctx, `SELECT path, action, queryToken FROM stream_auth
+		WHERE revoked_at IS NULL AND (path, action, queryToken) IN (SELECT * FROM unnest($1::text[], $2::text[], $3::text[]))`, paths, actions, tokens)
+	if err != nil {
+		return nil, err
+	}
+	return scanCredentials(rows)
+}
+
+func scanCredentials(rows pgx.Rows) ([]Credentials, error) {
+	defer rows.Close()
+	creds := []Credentials{}
+	for rows.Next() {
+		var c Credentials
+		if err := rows.Scan(&c.Path, &c.Action, &c.QueryToken); err != nil {
+			return nil, err
+		}
+		creds = append(creds, c)
+	}
+	return creds, rows.Err()
+}
+
+/*
+Check the notification triggers on stream_auth and users are installed
+*/
+func (s *PostgresStore) EnableNotify(ctx context.Context) error {
+	rows, err := s.pool.Query(ctx, `SELECT tgname FROM pg_trigger WHERE NOT tgisinternal
+		AND tgrelid IN ('stream_auth'::regclass, 'stream_users'::regclass, 'stream_user_grants'::regclass)`)
+	if err != nil {
+		return err
+	}
+	installed, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	for _, trigger := range notifyTriggers {
+		if !slices.Contains(installed, trigger) {
+			return fmt.Errorf("notification trigger %v is missing", trigger)
+		}
+	}
+	return nil
+}
+
+/*
+Listen for notifications on a dedicated connection until it fails
+*/
+func (s *PostgresStore) Listen(ctx context.Context, ready func(), changed func(Change)) error {
+	conn, err := pgx.ConnectConfig(ctx, s.pool.Config().ConnConfig.Copy())
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+notifyChannel); err != nil {
+		return err
+	}
+	ready()
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		var payload notifyPayload
+		if err := json.Unmarshal([]byte(notification.Payload), &payload); err != nil {
+			// The payload is not logged as it contains the token
+			slog.Error("Error while parsing database notification", "bytes", len(notification.Payload), "err", err)
+			continue
+		}
+		if len(payload.User) > 0 {
+			changed(Change{User: payload.User})
+			continue
+		}
+		changed(Change{Creds: Credentials{Path: payload.Path, Action: payload.Action, QueryToken: payload.QueryToken}})
+	}
+}
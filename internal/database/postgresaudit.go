@@ -0,0 +1,75 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const auditColumns = "id, decided_at, action, path, protocol, ip, connection_id, username, token_hash, result, reason"
+
+func (s *PostgresStore) WriteAudit(ctx context.Context, entries []AuditEntry) error {
+	_, err := s.pool.CopyFrom(ctx, pgx.Identifier{"auth_audit"},
+		[]string{"decided_at", "action", "path", "protocol", "ip", "connection_id", "username", "token_hash", "result", "reason"},
+		pgx.CopyFromSlice(len(entries), func(i int) ([]any, error) {
+			e := entries[i]
+			return []any{e.Time, e.Action, e.Path, e.Protocol, e.Ip, e.ConnectionId, e.User, e.Token, e.Result, e.Reason}, nil
+		}))
+	return err
+}
+
+func (s *PostgresStore) SearchAudit(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	conditions := []string{"TRUE"}
+	args := []any{}
+	add := func(condition string, value any) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.Before > 0 {
+		add("id < $%d", filter.Before)
+	}
+	if len(filter.Token) > 0 {
+		add("token_hash = $%d", filter.Token)
+	}
+	if len(filter.Path) > 0 {
+		add("path = $%d", filter.Path)
+	}
+	if len(filter.Ip) > 0 {
+		add("ip = $%d", filter.Ip)
+	}
+	if filter.From != nil {
+		add("decided_at >= $%d", *filter.From)
+	}
+	if filter.To != nil {
+		add("decided_at < $%d", *filter.To)
+	}
+	var limit any
+	if filter.Limit > 0 {
+		limit = filter.Limit
+	}
+	// A null limit is unlimited
+	args = append(args, limit)
+	rows, err := s.pool.Query(ctx, fmt.Sprintf("SELECT %v FROM auth_audit WHERE %v ORDER BY id DESC LIMIT $%d",
+		auditColumns, strings.Join(conditions, " AND "), len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.Id, &e.Time, &e.Action, &e.Path, &e.Protocol, &e.Ip, &e.ConnectionId, &e.User, &e.Token, &e.Result, &e.Reason); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *PostgresStore) PruneAudit(ctx context.Context, before time.Time) (int64, error) {
+	tag, err := s.pool.Exec(ctx, "DELETE FROM auth_audit WHERE decided_at < $1", before)
+	return tag.RowsAffected(), err
+}
@@ -0,0 +1,37 @@
+package database
+
+import (
+	"context"
+)
+
+func (s *PostgresStore) SaveSession(ctx context.Context, session Session) error {
+	_, err := s.pool.Exec(ctx, `INSERT INTO sessions (id, protocol, path, action, query_token, username, instance, started_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET protocol = excluded.protocol, path = excluded.path, action = excluded.action,
+		query_token = excluded.query_token, username = excluded.username, instance = excluded.instance`,
+		session.Id, session.Protocol, session.Creds.Path, session.Creds.Action, session.Creds.QueryToken, session.Creds.User, session.Instance, session.StartedAt)
+	return err
+}
+
+func (s *PostgresStore) DeleteSession(ctx context.Context, id string) error {
+	_, err := s.pool.Exec(ctx, "DELETE FROM sessions WHERE id = $1", id)
+	return err
+}
+
+func (s *PostgresStore) ListSessions(ctx context.Context) ([]Session, error) {
+	rows, err := s.pool.Query(ctx, "SELECT id, protocol, path, action, query_token, username, instance, started_at FROM sessions ORDER BY started_at, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		if err := rows.Scan(&session.Id, &session.Protocol, &session.Creds.Path, &session.Creds.Action, &session.Creds.QueryToken, &session.Creds.User,
+			&session.Instance, &session.StartedAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const tokenColumns = "id, path, action, queryToken, created_at, valid_from, expires_at, revoked_at, max_connections, max_uses, use_count, allowed_cidrs, bind_first_ip, bound_ip"
+
+func scanToken(row pgx.Row) (Token, error) {
+	var t Token
+	err := row.Scan(&t.Id, &t.Path, &t.Action, &t.QueryToken, &t.CreatedAt, &t.ValidFrom, &t.ExpiresAt, &t.RevokedAt,
+		&t.MaxConnections, &t.MaxUses, &t.UseCount, &t.AllowedCidrs, &t.BindFirstIp, &t.BoundIp)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return t, ErrNotFound
+	}
+	return t, err
+}
+
+func scanTokens(rows pgx.Rows) ([]Token, error) {
+	defer rows.Close()
+	tokens := []Token{}
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *PostgresStore) CreateToken(ctx context.Context, t Token) (Token, error) {
+	return scanToken(s.pool.QueryRow(ctx, `INSERT INTO stream_auth
+		(path, action, queryToken, valid_from, expires_at, max_connections, max_uses, allowed_cidrs, bind_first_ip)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING `+tokenColumns,
+		t.Path, t.Action, t.QueryToken, t.ValidFrom, t.ExpiresAt, t.MaxConnections, t.MaxUses, t.AllowedCidrs, t.BindFirstIp))
+}
+
+func (s *PostgresStore) GetToken(ctx context.Context, id int64) (Token, error) {
+	return scanToken(s.pool.QueryRow(ctx, "SELECT "+tokenColumns+" FROM stream_auth WHERE id = $1", id))
+}
+
+func (s *PostgresStore) ListTokens(ctx context.Context, filter TokenFilter) ([]Token, error) {
+	conditions := []string{"id > $1"}
+	args := []any{filter.After}
+	if len(filter.Path) > 0 {
+		args = append(args, filter.Path)
+		conditions = append(conditions, fmt.Sprintf("path = $%d", len(args)))
+	}
+	if len(filter.Action) > 0 {
+		args = append(args, filter.Action)
+		conditions = append(conditions, fmt.Sprintf("action = $%d", len(args)))
+	}
+	if filter.Active != nil {
+		active := "(revoked_at IS NULL AND (valid_from IS NULL OR valid_from <= now()) AND (expires_at IS NULL OR expires_at > now()))"
+		if *filter.Active {
+			conditions = append(conditions, active)
+		} else {
+			conditions = append(conditions, "NOT "+active)
+		}
+	}
+	args = append(args, filter.Limit)
+	rows, err := s.pool.Query(ctx, fmt.Sprintf("SELECT %v FROM stream_auth WHERE %v ORDER BY id LIMIT $%d",
+		tokenColumns, strings.Join(conditions, " AND "), len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanTokens(rows)
+}
+
+func (s *PostgresStore) UpdateToken(ctx context.Context, id int64, update TokenUpdate) (Token, error) {
+	sets := []string{}
+	args := []any{id}
+	add := func(column string, set bool, value any) {
+		if set {
+			args = append(args, value)
+			sets = append(sets, fmt.Sprintf("%v = $%d", column, len(args)))
+		}
+	}
+	add("valid_from", update.ValidFrom.Set, update.ValidFrom.Value)
+	add("expires_at", update.ExpiresAt.Set, update.ExpiresAt.Value)
+	add("max_connections", update.MaxConnections.Set, update.MaxConnections.Value)
+	add("max_uses", update.MaxUses.Set, update.MaxUses.Value)
+	add("allowed_cidrs", update.AllowedCidrs.Set, update.AllowedCidrs.Value)
+	add("bind_first_ip", update.BindFirstIp.Set && update.BindFirstIp.Value != nil, update.BindFirstIp.Value)
+	add("bound_ip", update.BoundIp.Set, update.BoundIp.Value)
+	if len(sets) == 0 {
+		return s.GetToken(ctx, id)
+	}
+	return scanToken(s.pool.QueryRow(ctx, fmt.Sprintf("UPDATE stream_auth SET %v WHERE id = $1 RETURNING %v",
+		strings.Join(sets, ", "), tokenColumns), args...))
+}
+
+func (s *PostgresStore) RevokeToken(ctx context.Context, id int64) (Token, error) {
+	return scanToken(s.pool.QueryRow(ctx, "UPDATE stream_auth SET revoked_at = COALESCE(revoked_at, now()) WHERE id = $1 RETURNING "+tokenColumns, id))
+}
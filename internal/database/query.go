@@ -2,59 +2,293 @@ package database
 
 import (
 	"context"
+	"log/slog"
+	"net"
+	"time"
 
 	"github.com/jellydator/ttlcache/v3"
 )
 
+/*
+Validity of a set of credentials at the time of lookup
+*/
+type credentialWindow struct {
+	Valid          bool
+	ValidFrom      time.Time // Next time the credentials become valid if currently invalid, zero if never
+	ExpiresAt      time.Time // Time the credentials stop being valid if currently valid, zero if never
+	MaxConnections int       // Maximum concurrent tracked connections, zero if unlimited
+	LimitedUses    bool      // Each new client consumes one of a limited number of uses
+	Ip             ipRestriction
+}
+
 /*
 Validate credentials against the cache and database and handle new connections
 */
-func (d *DatabaseManager) ValidateAuth(req *Credentials, connection *Connection) (bool, error) {
+func (d *DatabaseManager) ValidateAuth(req *Credentials, client Client) (bool, error) {
+	return d.validateCached(req, client, func(credData *CredentialData) (credentialWindow, error) {
+		return d.validateAuth(req)
+	})
+}
+
+/*
+Check credentials are valid for the given IP without registering a connection, consuming a use, or binding an IP
+*/
+func (d *DatabaseManager) CheckAuth(req *Credentials, ip net.IP) (bool, error) {
+	credData, err := d.lookupCached(req, func(credData *CredentialData) (credentialWindow, error) {
+		return d.validateAuth(req)
+	})
+	if err != nil || credData == nil {
+		return false, err
+	}
+	return credData.getIpRestriction().allows(ip), nil
+}
+
+/*
+Validate credentials against the cache, falling back to the given database lookup, and handle new connections
+*/
+func (d *DatabaseManager) validateCached(req *Credentials, client Client, lookup func(credData *CredentialData) (credentialWindow, error)) (bool, error) {
+	credData, err := d.lookupCached(req, lookup)
+	if err != nil || credData == nil {
+		return false, err
+	}
+	return d.admit(req, credData, client), nil
+}
+
+/*
+Get the cached data for credentials, falling back to the given database lookup, or nil if not currently valid
+*/
+func (d *DatabaseManager) lookupCached(req *Credentials, lookup func(credData *CredentialData) (credentialWindow, error)) (*CredentialData, error) {
 	// Check cache
 	if cacheVal := d.cache.Get(*req); cacheVal != nil {
 		credData := cacheVal.Value()
-		if credData == nil {
-			return false, nil
-		}
-		if credData.Valid && connection != nil {
-			defer d.registerConnection(req, credData, connection)
+		// Expiry is checked here as well in case the scheduled revocation has not yet run
+		if credData == nil || !credData.validAt(time.Now()) {
+			return nil, nil
 		}
-		return credData.Valid, nil
+		return credData, nil
+	}
+	if len(req.User) > 0 && d.userRejected(req) {
+		return nil, nil
 	}
 
 	// Check database
-	valid, err := d.validateAuth(req)
+	credData := &CredentialData{}
+	window, err := lookup(credData)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	credData := CredentialData{Valid: valid}
-	defer d.cache.Set(*req, &credData, ttlcache.DefaultTTL)
-	if valid && connection != nil {
-		defer d.registerConnection(req, &credData, connection)
+	credData.setWindow(window)
+	if len(req.User) > 0 && !window.Valid {
+		d.rejectUser(req, credData)
+		return nil, nil
 	}
-	return valid, nil
+	cacheItem, found := d.cache.GetOrSet(*req, credData, ttlcache.WithTTL[Credentials, *CredentialData](d.cacheTtl(window)))
+	if found {
+		// Another request cached these credentials first, so use its data to keep connection tracking in one place
+		credData = cacheItem.Value()
+		if credData == nil || !credData.validAt(time.Now()) {
+			return nil, nil
+		}
+		return credData, nil
+	}
+	d.scheduleExpiry(*req, credData)
+	if !window.Valid {
+		return nil, nil
+	}
+	return credData, nil
 }
 
 /*
-Internal function to validate credentials against the database
+Admit a client using valid credentials, enforcing IP, connection and usage limits
 */
-func (d *DatabaseManager) validateAuth(req *Credentials) (bool, error) {
-	rows, err := d.pool.Query(context.Background(), "SELECT 1 FROM stream_auth WHERE path = $1 AND action = $2 AND queryToken = $3", req.Path, req.Action, req.QueryToken)
+func (d *DatabaseManager) admit(req *Credentials, credData *CredentialData, client Client) bool {
+	if !d.checkIp(req, credData, client) {
+		return false
+	}
+	if !d.registerConnection(req, credData, client) {
+		return false
+	}
+	if !d.consumeUse(req, credData, client) {
+		d.unregisterConnection(req, credData, client.Connection)
+		return false
+	}
+	return true
+}
+
+/*
+Internal function to validate credentials against the store
+*/
+func (d *DatabaseManager) validateAuth(req *Credentials) (credentialWindow, error) {
+	rows, err := d.store.LookupToken(context.Background(), *req)
 	if err != nil {
-		return false, err
+		return credentialWindow{}, err
+	}
+	return combineWindows(rows, time.Now()), nil
+}
+
+/*
+Multiple rows may match the same credentials, so combine their windows at the given time
+*/
+func combineWindows(rows []Token, now time.Time) credentialWindow {
+	window := credentialWindow{}
+	for _, row := range rows {
+		if row.ValidFrom != nil && now.Before(*row.ValidFrom) {
+			// Not yet valid, track the earliest time any row becomes valid
+			if !window.Valid && (window.ValidFrom.IsZero() || row.ValidFrom.Before(window.ValidFrom)) {
+				window.ValidFrom = *row.ValidFrom
+			}
+			continue
+		}
+		if row.ExpiresAt != nil && !now.Before(*row.ExpiresAt) {
+			// Already expired
+			continue
+		}
+		ip := ipRestriction{AllowedCidrs: row.AllowedCidrs, BindFirstIp: row.BindFirstIp, BoundIp: row.BoundIp}
+		if !window.Valid {
+			window = credentialWindow{Valid: true, ExpiresAt: timeOrZero(row.ExpiresAt), MaxConnections: intOrZero(row.MaxConnections), LimitedUses: row.MaxUses != nil, Ip: ip}
+			continue
+		}
+		window.Ip = window.Ip.merge(ip)
+		// Uses only need to be counted if every currently valid row is limited
+		window.LimitedUses = window.LimitedUses && row.MaxUses != nil
+		if !window.ExpiresAt.IsZero() && (row.ExpiresAt == nil || row.ExpiresAt.After(window.ExpiresAt)) {
+			// Use the latest expiry of all currently valid rows
+			window.ExpiresAt = timeOrZero(row.ExpiresAt)
+		}
+		if window.MaxConnections > 0 && (row.MaxConnections == nil || *row.MaxConnections > window.MaxConnections) {
+			// Use the most permissive limit of all currently valid rows
+			window.MaxConnections = intOrZero(row.MaxConnections)
+		}
+	}
+	return window
+}
+
+/*
+Revalidate previously validated credentials against the store without the original secret
+*/
+func (d *DatabaseManager) revalidate(creds *Credentials, credData *CredentialData) (credentialWindow, error) {
+	if len(creds.User) > 0 {
+		return d.validateUserHash(creds, credData.getPasswordHash())
+	}
+	return d.validateAuth(creds)
+}
+
+/*
+Revalidate credentials against the database, updating the cache and kicking tracked connections if no longer valid
+*/
+func (d *DatabaseManager) refresh(creds Credentials) {
+	if d.cache == nil {
+		// Opened without a cache (ex: command line), a running server detects the change itself
+		return
+	}
+	cacheItem := d.cache.Get(creds)
+	if cacheItem == nil {
+		return
+	}
+	credData := cacheItem.Value()
+	if credData == nil {
+		credData = &CredentialData{}
+	}
+	window, err := d.revalidate(&creds, credData)
+	if err != nil {
+		slog.Error("Error while validating auth", "creds", creds, "err", err)
+		return
+	}
+	credData.setWindow(window)
+	d.cache.Set(creds, credData, d.cacheTtl(window))
+	d.scheduleExpiry(creds, credData)
+	if !window.Valid {
+		d.revoke(credData)
+	}
+}
+
+/*
+Get the cache duration for the given credentials, clamped so that the entry never outlives a change in validity
+*/
+func (d *DatabaseManager) cacheTtl(window credentialWindow) time.Duration {
+	ttl := time.Duration(d.conf.Database.CacheDuration) * time.Second
+	var until time.Time
+	if window.Valid {
+		until = window.ExpiresAt
+	} else {
+		until = window.ValidFrom
+	}
+	if !until.IsZero() {
+		// Zero TTL would fall back to the default TTL in the cache
+		ttl = max(min(ttl, time.Until(until)), time.Millisecond)
 	}
-	defer rows.Close()
-	return rows.Next(), nil
+	return ttl
 }
 
 /*
-Register a connection for tracking
+Schedule revocation of all tracked connections at the exact moment the credentials expire
 */
-func (d *DatabaseManager) registerConnection(req *Credentials, credData *CredentialData, connection *Connection) {
+func (d *DatabaseManager) scheduleExpiry(creds Credentials, credData *CredentialData) {
+	credData.scheduleExpiry(func() {
+		credData.invalidate()
+		d.revoke(credData)
+		// Drop the cache entry so the next request revalidates against the database
+		if cacheItem := d.cache.Get(creds); cacheItem != nil && cacheItem.Value() == credData {
+			d.cache.Delete(creds)
+		}
+	})
+}
+
+/*
+Register a connection for tracking, returning false if the connection limit was reached
+*/
+func (d *DatabaseManager) registerConnection(req *Credentials, credData *CredentialData, client Client) bool {
+	connection := client.Connection
 	if connection == nil {
 		// One time connection (ex: HLS)
+		return true
+	}
+	added, kicked := credData.tryAddConnection(connection.Id, d.conf.ConnectionLimitMode == "kickOldest")
+	if !added {
+		return false
+	}
+	record := ConnectionRecord{Creds: req, Info: *connection, Instance: client.Instance, Started: time.Now()}
+	previous := d.connections.Get(connection.Id)
+	if previous != nil {
+		// Repeated auth request for an existing connection, which is already persisted
+		record.Started = previous.Value().Started
+	}
+	d.connections.Set(connection.Id, record, ttlcache.DefaultTTL)
+	if previous == nil {
+		d.saveSession(record)
+	}
+	for _, conn := range kicked {
+		ret, exist := d.connections.GetAndDelete(conn)
+		if ret == nil || !exist {
+			continue
+		}
+		d.kicks.add(ret.Value())
+	}
+	return true
+}
+
+/*
+Stop tracking a connection which was registered but then denied
+*/
+func (d *DatabaseManager) unregisterConnection(req *Credentials, credData *CredentialData, connection *Connection) {
+	if connection == nil {
 		return
 	}
-	credData.addConnection(connection.Id)
-	d.connections.Set(connection.Id, ConnectionRecord{Creds: req, Info: *connection}, ttlcache.DefaultTTL)
+	credData.removeConnection(connection.Id)
+	d.connections.Delete(connection.Id)
+	d.deleteSession(connection.Id)
+}
+
+func timeOrZero(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+func intOrZero(i *int) int {
+	if i == nil {
+		return 0
+	}
+	return *i
 }
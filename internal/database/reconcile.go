@@ -0,0 +1,155 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/pseudoresonance/authserver/internal/mediamtx"
+)
+
+/*
+Outcomes of reconciling a live connection
+*/
+const (
+	ReconcileTracked  = "tracked"  // Already tracked
+	ReconcileIdle     = "idle"     // Not reading or publishing yet, so not yet authenticated
+	ReconcileAccepted = "accepted" // Accepted without stored credentials (ex: private IP, signed token)
+	ReconcileUnknown  = "unknown"  // No query token to check (ex: user, JWT)
+	ReconcileValid    = "valid"    // Tracked from now on, unless a dry run
+	ReconcileInvalid  = "invalid"  // Kicked, unless a dry run
+	ReconcileError    = "error"    // Credentials could not be checked
+)
+
+/*
+Connection listed by the MediaMTX API
+*/
+type LiveConnection struct {
+	Instance string    `json:"instance"` // Name of the MediaMTX instance the connection was listed on
+	Id       string    `json:"id"`
+	Protocol string    `json:"protocol"`
+	Path     string    `json:"path"`
+	Action   string    `json:"action"` // Empty while idle
+	Query    string    `json:"-"`      // Contains the token
+	Ip       net.IP    `json:"ip"`
+	Created  time.Time `json:"created"`
+}
+
+type ReconcileResult struct {
+	LiveConnection
+	Outcome string `json:"outcome"`
+}
+
+/*
+Match the connections on every MediaMTX server to credentials, tracking those which are valid and kicking those which are not
+
+Connections for which accept returns true are left alone, for those accepted by other means than stored credentials.
+With a dry run, the outcomes are only reported.
+A server which cannot be listed does not stop the others being reconciled, with every failure returned together.
+*/
+func (d *DatabaseManager) Reconcile(ctx context.Context, dryRun bool, accept func(conn LiveConnection) bool) ([]ReconcileResult, error) {
+	results := []ReconcileResult{}
+	var errs []error
+	for _, instance := range d.instances {
+		conns, err := d.listLiveConnections(ctx, instance)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("listing connections on %v failed\n%w", instance.Name, err))
+			continue
+		}
+		for _, conn := range conns {
+			results = append(results, ReconcileResult{LiveConnection: conn, Outcome: d.reconcile(ctx, instance.api, conn, dryRun, accept)})
+		}
+	}
+	return results, errors.Join(errs...)
+}
+
+func (d *DatabaseManager) reconcile(ctx context.Context, api *mediamtx.Client, conn LiveConnection, dryRun bool, accept func(conn LiveConnection) bool) string {
+	if d.connections != nil && d.connections.Get(conn.Id) != nil {
+		return ReconcileTracked
+	}
+	if len(conn.Action) == 0 {
+		return ReconcileIdle
+	}
+	if accept != nil && accept(conn) {
+		return ReconcileAccepted
+	}
+	values, err := url.ParseQuery(conn.Query)
+	if err != nil || len(values.Get(d.conf.QueryTokenKey)) == 0 {
+		return ReconcileUnknown
+	}
+
+	creds := &Credentials{Path: conn.Path, Action: conn.Action, QueryToken: values.Get(d.conf.QueryTokenKey)}
+	var credData *CredentialData
+	if d.cache != nil {
+		credData, err = d.lookupCached(creds, func(credData *CredentialData) (credentialWindow, error) {
+			return d.validateAuth(creds)
+		})
+	} else {
+		// Opened without a cache (ex: command line)
+		var window credentialWindow
+		if window, err = d.validateAuth(creds); window.Valid {
+			credData = &CredentialData{}
+			credData.setWindow(window)
+		}
+	}
+	if err != nil {
+		slog.Error("Error while validating auth", "creds", creds, "err", err)
+		return ReconcileError
+	}
+
+	info := Connection{Id: conn.Id, Protocol: conn.Protocol}
+	if credData == nil || !credData.getIpRestriction().allows(conn.Ip) {
+		if !dryRun {
+			d.kickConnection(ctx, api, info)
+		}
+		return ReconcileInvalid
+	}
+	if !dryRun && d.connections != nil {
+		credData.restoreConnection(conn.Id)
+		record := ConnectionRecord{Info: info, Creds: creds, Instance: conn.Instance, Started: conn.Created}
+		d.connections.Set(conn.Id, record, ttlcache.DefaultTTL)
+		d.saveSession(record)
+	}
+	return ReconcileValid
+}
+
+/*
+List the authenticated connections of every kind on a MediaMTX server, skipping kinds which are disabled
+*/
+func (d *DatabaseManager) listLiveConnections(ctx context.Context, instance mediaMtxInstance) ([]LiveConnection, error) {
+	api := instance.api
+	conns := []LiveConnection{}
+	for _, kind := range mediamtx.Kinds {
+		items, err := api.List(ctx, kind)
+		// Rejected credentials are an error rather than a disabled kind
+		var status *mediamtx.StatusError
+		switch {
+		case errors.Is(err, mediamtx.ErrNotFound), errors.As(err, &status) && status.Status < http.StatusInternalServerError &&
+			status.Status != http.StatusUnauthorized && status.Status != http.StatusForbidden:
+			slog.Debug("Connection kind unavailable", "url", api.BaseUrl(), "kind", kind, "err", err)
+			continue
+		case err != nil:
+			return nil, err
+		}
+		for _, item := range items {
+			conn := LiveConnection{Instance: instance.Name, Id: item.Id, Protocol: kind.Protocol(), Path: item.Path, Query: item.Query, Created: item.Created}
+			switch item.State {
+			case "read", "publish":
+				conn.Action = item.State
+			}
+			host, _, err := net.SplitHostPort(item.RemoteAddr)
+			if err != nil {
+				host = item.RemoteAddr
+			}
+			conn.Ip = net.ParseIP(host)
+			conns = append(conns, conn)
+		}
+	}
+	return conns, nil
+}
@@ -0,0 +1,125 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+	"github.com/pseudoresonance/authserver/internal/mediamtx"
+)
+
+/*
+Page of connections from a MediaMTX list endpoint
+*/
+type connPage struct {
+	PageCount int             `json:"pageCount"`
+	Items     []mediamtx.Conn `json:"items"`
+}
+
+func TestReconcile(t *testing.T) {
+	// RTSP sessions split over two pages, with every other kind disabled
+	pages := []connPage{{PageCount: 2}, {PageCount: 2}}
+	for i, conn := range []mediamtx.Conn{
+		{Id: "valid", State: "read", Path: "stream", Query: "token=a", RemoteAddr: "203.0.113.5:5000"},
+		{Id: "revoked", State: "read", Path: "stream", Query: "token=b", RemoteAddr: "203.0.113.6:5000"},
+		{Id: "user", State: "publish", Path: "stream", RemoteAddr: "203.0.113.7:5000"},
+		{Id: "idle", State: "idle", Path: "stream", Query: "token=b", RemoteAddr: "203.0.113.8:5000"},
+		{Id: "private", State: "read", Path: "stream", Query: "token=b", RemoteAddr: "10.0.0.1:5000"},
+	} {
+		pages[min(i/3, 1)].Items = append(pages[min(i/3, 1)].Items, conn)
+	}
+	kicks := make(chan string, 16)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v3/rtspsessions/list", func(w http.ResponseWriter, r *http.Request) {
+		page := 0
+		if r.URL.Query().Get("page") == "1" {
+			page = 1
+		}
+		json.NewEncoder(w).Encode(pages[page])
+	})
+	mux.HandleFunc("POST /", func(w http.ResponseWriter, r *http.Request) {
+		kicks <- r.URL.Path
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	conf := config.NewMainConfig()
+	conf.MediaMtxUrlBase = server.URL
+	conf.MediaMtxUrlBasePublish = server.URL
+	store := NewMemoryStore()
+	token := createToken(t, store, Token{Path: "stream", Action: "read", QueryToken: "a"})
+	db := &DatabaseManager{}
+	db.InitWithStore(&conf, store)
+	defer db.Close()
+	accept := func(conn LiveConnection) bool {
+		return conn.Ip.IsPrivate()
+	}
+
+	target := map[string]string{"valid": ReconcileValid, "revoked": ReconcileInvalid, "user": ReconcileUnknown, "idle": ReconcileIdle, "private": ReconcileAccepted}
+	results, err := db.Reconcile(context.Background(), true, accept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(target) {
+		t.Fatalf("Wrong number of connections: need (%v) got (%v)\n", len(target), len(results))
+	}
+	for _, r := range results {
+		if r.Outcome != target[r.Id] {
+			t.Errorf("Wrong outcome for %v: need (%v) got (%v)\n", r.Id, target[r.Id], r.Outcome)
+		}
+	}
+	if len(kicks) > 0 || db.connections.Get("valid") != nil {
+		t.Errorf("Dry run changed connections\n")
+	}
+
+	if _, err := db.Reconcile(context.Background(), false, accept); err != nil {
+		t.Fatal(err)
+	}
+	waitForKick(t, kicks, "/v3/rtspsessions/kick/revoked")
+	if db.connections.Get("valid") == nil {
+		t.Fatalf("Valid connection not tracked\n")
+	}
+	// Tracked connections are kicked when their credentials are revoked, like any other
+	if _, err := db.RevokeToken(context.Background(), token.Id); err != nil {
+		t.Fatal(err)
+	}
+	waitForKick(t, kicks, "/v3/rtspsessions/kick/valid")
+	if results, _ := db.Reconcile(context.Background(), true, accept); results[0].Outcome != ReconcileInvalid {
+		t.Errorf("Wrong outcome after revoking: %v\n", results[0].Outcome)
+	}
+}
+
+func TestReconcileListFailed(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v3/rtspsessions/list", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(connPage{PageCount: 1, Items: []mediamtx.Conn{
+			{Id: "valid", State: "read", Path: "stream", Query: "token=a", RemoteAddr: "203.0.113.5:5000"},
+		}})
+	})
+	working := httptest.NewServer(mux)
+	defer working.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	conf := config.NewMainConfig()
+	conf.MediaMtxInstances = []config.MediaMtxInstance{{Name: "broken", ApiBase: broken.URL}, {Name: "working", ApiBase: working.URL}}
+	store := NewMemoryStore()
+	createToken(t, store, Token{Path: "stream", Action: "read", QueryToken: "a"})
+	db := &DatabaseManager{}
+	db.InitWithStore(&conf, store)
+	defer db.Close()
+
+	// The failing server is reported, but the others are still reconciled
+	results, err := db.Reconcile(context.Background(), true, func(conn LiveConnection) bool { return false })
+	if err == nil {
+		t.Errorf("Listing failure not returned\n")
+	}
+	if len(results) != 1 || results[0].Outcome != ReconcileValid || results[0].Instance != "working" {
+		t.Errorf("Wrong results from working server: %+v\n", results)
+	}
+}
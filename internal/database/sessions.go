@@ -0,0 +1,215 @@
+package database
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+)
+
+/*
+Time allowed for a single session write before giving up
+*/
+const sessionWriteTimeout = 5 * time.Second
+
+/*
+Session writes which can be queued before further writes are dropped
+*/
+const sessionQueueSize = 10000
+
+/*
+Tracked connection in sessions
+*/
+type Session struct {
+	Id        string
+	Protocol  string
+	Creds     Credentials // Password digest is not stored
+	Instance  string      // Named MediaMTX instance, empty to route by action
+	StartedAt time.Time
+}
+
+func (d *DatabaseManager) sessionStore() (SessionStore, bool) {
+	store, ok := d.store.(SessionStore)
+	return store, ok
+}
+
+/*
+Session to save, or the ID of a session to delete
+*/
+type sessionWrite struct {
+	session *Session
+	id      string
+}
+
+/*
+Queues session writes and applies them in order, so auth requests never wait on the database
+*/
+type sessionWriter struct {
+	store  SessionStore
+	queue  chan sessionWrite
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newSessionWriter(store SessionStore) *sessionWriter {
+	w := &sessionWriter{store: store, queue: make(chan sessionWrite, sessionQueueSize), done: make(chan struct{})}
+	var ctx context.Context
+	ctx, w.cancel = context.WithCancel(context.Background())
+	go w.run(ctx)
+	return w
+}
+
+/*
+Queue a write, dropping it if the queue is full as connections are tracked in memory regardless
+*/
+func (w *sessionWriter) add(write sessionWrite) {
+	select {
+	case w.queue <- write:
+	default:
+		slog.Warn("Session queue full, dropping write", "id", write.id)
+	}
+}
+
+func (w *sessionWriter) run(ctx context.Context) {
+	defer close(w.done)
+	for {
+		select {
+		case write := <-w.queue:
+			w.write(write)
+		case <-ctx.Done():
+			// Apply everything queued before stopping
+			for {
+				select {
+				case write := <-w.queue:
+					w.write(write)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *sessionWriter) write(write sessionWrite) {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionWriteTimeout)
+	defer cancel()
+	if write.session != nil {
+		if err := w.store.SaveSession(ctx, *write.session); err != nil {
+			slog.Error("Error while saving session", "id", write.id, "err", err)
+		}
+		return
+	}
+	if err := w.store.DeleteSession(ctx, write.id); err != nil {
+		slog.Error("Error while deleting session", "id", write.id, "err", err)
+	}
+}
+
+/*
+Stop the writer once all queued writes have been applied
+*/
+func (w *sessionWriter) close() {
+	w.cancel()
+	<-w.done
+}
+
+/*
+Start the session writer if supported by the store
+*/
+func (d *DatabaseManager) startSessions() {
+	if store, ok := d.sessionStore(); ok {
+		d.sessions = newSessionWriter(store)
+	}
+}
+
+/*
+Persist a tracked connection in the background
+*/
+func (d *DatabaseManager) saveSession(record ConnectionRecord) {
+	if d.sessions == nil {
+		return
+	}
+	creds := *record.Creds
+	creds.PasswordDigest = ""
+	d.sessions.add(sessionWrite{id: record.Info.Id,
+		session: &Session{Id: record.Info.Id, Protocol: record.Info.Protocol, Creds: creds, Instance: record.Instance, StartedAt: record.Started}})
+}
+
+/*
+Stop persisting a connection in the background
+*/
+func (d *DatabaseManager) deleteSession(id string) {
+	if d.sessions == nil {
+		return
+	}
+	d.sessions.add(sessionWrite{id: id})
+}
+
+/*
+Track the connections persisted by a previous run, kicking those whose credentials are no longer valid
+
+Credentials are cached with their connections, so changes to them are applied exactly as if the connections were made by this run.
+*/
+func (d *DatabaseManager) restoreSessions() {
+	store, ok := d.sessionStore()
+	if !ok {
+		return
+	}
+	sessions, err := store.ListSessions(context.Background())
+	if err != nil {
+		slog.Error("Error while loading sessions, connections from before the restart will not be tracked", "err", err)
+		return
+	}
+
+	restored, kicked := 0, 0
+	byCreds := map[Credentials]*CredentialData{}
+	for _, s := range sessions {
+		creds := s.Creds
+		credData, ok := byCreds[creds]
+		if !ok {
+			credData = &CredentialData{}
+			window, err := d.restoreWindow(&creds, credData)
+			if err != nil {
+				// Keep the session to try again on the next start
+				slog.Error("Error while validating auth", "creds", creds, "err", err)
+				continue
+			}
+			credData.setWindow(window)
+			byCreds[creds] = credData
+			if window.Valid {
+				d.cache.Set(creds, credData, d.cacheTtl(window))
+				d.scheduleExpiry(creds, credData)
+			}
+		}
+
+		record := ConnectionRecord{Info: Connection{Id: s.Id, Protocol: s.Protocol}, Creds: &creds, Instance: s.Instance, Started: s.StartedAt}
+		if !credData.isValid() {
+			d.kicks.add(record)
+			kicked++
+			continue
+		}
+		credData.restoreConnection(s.Id)
+		d.connections.Set(s.Id, record, ttlcache.DefaultTTL)
+		restored++
+	}
+	if restored > 0 || kicked > 0 {
+		slog.Info("Restored tracked connections", "restored", restored, "kicked", kicked)
+	}
+}
+
+/*
+Look up the current validity of restored credentials
+
+Users are trusted with their current password hash, as the password they connected with is not known.
+*/
+func (d *DatabaseManager) restoreWindow(creds *Credentials, credData *CredentialData) (credentialWindow, error) {
+	if len(creds.User) == 0 {
+		return d.validateAuth(creds)
+	}
+	hash, granted, err := d.lookupUser(creds)
+	if err != nil {
+		return credentialWindow{}, err
+	}
+	credData.setPasswordHash(hash)
+	return credentialWindow{Valid: granted && len(hash) > 0}, nil
+}
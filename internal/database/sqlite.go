@@ -0,0 +1,212 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+	_ "modernc.org/sqlite"
+)
+
+/*
+Timestamps are stored as fixed width UTC text, so they compare in order
+*/
+const sqliteTimeFormat = "2006-01-02T15:04:05.000Z"
+
+/*
+Maximum number of credentials checked in a single query, staying well below the SQLite variable limit
+*/
+const sqliteBatchSize = 500
+
+/*
+Credentials stored in an embedded SQLite database file
+*/
+type SqliteStore struct {
+	db *sql.DB
+}
+
+func NewSqliteStore(ctx context.Context, conf config.DatabaseConfig) (*SqliteStore, error) {
+	// Write transactions take the lock up front, as upgrading a read lock fails immediately when another connection is writing
+	db, err := sql.Open("sqlite", "file:"+conf.SqlitePath+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SqliteStore{db: db}, nil
+}
+
+func (s *SqliteStore) Close() {
+	s.db.Close()
+}
+
+func sqliteTime(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
+func sqliteCidrs(cidrs []netip.Prefix) (any, error) {
+	if len(cidrs) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(cidrs)
+	return string(data), err
+}
+
+func sqlitePrefix(prefix *netip.Prefix) any {
+	if prefix == nil {
+		return nil
+	}
+	return prefix.String()
+}
+
+/*
+Scans a nullable text column, calling parse with the text if not null
+*/
+type sqliteText func(text string) error
+
+func (s sqliteText) Scan(src any) error {
+	switch src := src.(type) {
+	case nil:
+		return nil
+	case string:
+		return s(src)
+	case []byte:
+		return s(string(src))
+	default:
+		return fmt.Errorf("unexpected %T in text column", src)
+	}
+}
+
+func scanSqliteTime(dst **time.Time) sqliteText {
+	*dst = nil
+	return func(text string) error {
+		t, err := time.Parse(time.RFC3339Nano, text)
+		*dst = &t
+		return err
+	}
+}
+
+func scanSqliteCidrs(dst *[]netip.Prefix) sqliteText {
+	*dst = nil
+	return func(text string) error {
+		return json.Unmarshal([]byte(text), dst)
+	}
+}
+
+func scanSqlitePrefix(dst **netip.Prefix) sqliteText {
+	*dst = nil
+	return func(text string) error {
+		prefix, err := netip.ParsePrefix(text)
+		*dst = &prefix
+		return err
+	}
+}
+
+func (s *SqliteStore) LookupToken(ctx context.Context, creds Credentials) ([]Token, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+tokenColumns+" FROM stream_auth WHERE path = ? AND action = ? AND queryToken = ? AND revoked_at IS NULL",
+		creds.Path, creds.Action, creds.QueryToken)
+	if err != nil {
+		return nil, err
+	}
+	return scanSqliteTokens(rows)
+}
+
+func (s *SqliteStore) LookupUser(ctx context.Context, creds Credentials) (string, bool, error) {
+	var hash string
+	var granted bool
+	err := s.db.QueryRowContext(ctx, `SELECT password_hash,
+		EXISTS (SELECT 1 FROM stream_user_grants WHERE username = ?1 AND path = ?2 AND action = ?3)
+		FROM stream_users WHERE username = ?1 AND revoked_at IS NULL`, creds.User, creds.Path, creds.Action).Scan(&hash, &granted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	return hash, granted, err
+}
+
+func (s *SqliteStore) ConsumeUse(ctx context.Context, creds Credentials) (bool, error) {
+	var useCount int
+	// Only one of any duplicate rows is consumed
+	err := s.db.QueryRowContext(ctx, `UPDATE stream_auth SET use_count = use_count + 1
+		WHERE id = (SELECT id FROM stream_auth
+			WHERE path = ? AND action = ? AND queryToken = ? AND revoked_at IS NULL AND use_count < max_uses
+			ORDER BY id LIMIT 1)
+		RETURNING use_count`, creds.Path, creds.Action, creds.QueryToken).Scan(&useCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		// All uses have been consumed
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *SqliteStore) BindIp(ctx context.Context, creds Credentials, prefix netip.Prefix) (netip.Prefix, error) {
+	var bound *netip.Prefix
+	err := s.db.QueryRowContext(ctx, `UPDATE stream_auth SET bound_ip = ?4
+		WHERE path = ?1 AND action = ?2 AND queryToken = ?3 AND revoked_at IS NULL AND bind_first_ip AND bound_ip IS NULL
+		RETURNING bound_ip`, creds.Path, creds.Action, creds.QueryToken, prefix.String()).Scan(scanSqlitePrefix(&bound))
+	if errors.Is(err, sql.ErrNoRows) {
+		// Another request bound the credentials first
+		err = s.db.QueryRowContext(ctx, `SELECT bound_ip FROM stream_auth
+			WHERE path = ? AND action = ? AND queryToken = ? AND revoked_at IS NULL AND bound_ip IS NOT NULL
+			LIMIT 1`, creds.Path, creds.Action, creds.QueryToken).Scan(scanSqlitePrefix(&bound))
+	}
+	if err != nil || bound == nil {
+		return netip.Prefix{}, err
+	}
+	return *bound, nil
+}
+
+func (s *SqliteStore) ChangedSince(ctx context.Context, since time.Time) ([]Credentials, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT DISTINCT path, action, queryToken FROM stream_auth WHERE updated_at > ?", sqliteTime(&since))
+	if err != nil {
+		return nil, err
+	}
+	return scanSqliteCredentials(rows)
+}
+
+func (s *SqliteStore) ActiveTokens(ctx context.Context, creds []Credentials) ([]Credentials, error) {
+	active := []Credentials{}
+	for batch := range slices.Chunk(creds, sqliteBatchSize) {
+		values := make([]string, len(batch))
+		args := make([]any, 0, len(batch)*3)
+		for i, c := range batch {
+			values[i] = "(?, ?, ?)"
+			args = append(args, c.Path, c.Action, c.QueryToken)
+		}
+		rows, err := s.db.QueryContext(ctx, `SELECT path, action, queryToken FROM stream_auth
+			WHERE revoked_at IS NULL AND (path, action, queryToken) IN (VALUES `+strings.Join(values, ", ")+`)`, args...)
+		if err != nil {
+			return nil, err
+		}
+		found, err := scanSqliteCredentials(rows)
+		if err != nil {
+			return nil, err
+		}
+		active = append(active, found...)
+	}
+	return active, nil
+}
+
+func scanSqliteCredentials(rows *sql.Rows) ([]Credentials, error) {
+	defer rows.Close()
+	creds := []Credentials{}
+	for rows.Next() {
+		var c Credentials
+		if err := rows.Scan(&c.Path, &c.Action, &c.QueryToken); err != nil {
+			return nil, err
+		}
+		creds = append(creds, c)
+	}
+	return creds, rows.Err()
+}
@@ -0,0 +1,220 @@
+package database
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+	"github.com/pseudoresonance/authserver/internal/password"
+)
+
+/*
+Start a manager on a migrated SQLite database, polling for changes every second
+*/
+func newTestSqlite(t *testing.T) (*DatabaseManager, *SqliteStore, chan string) {
+	db, store, kicks := openTestSqlite(t, filepath.Join(t.TempDir(), "auth.db"), nil)
+	t.Cleanup(db.Close)
+	return db, store, kicks
+}
+
+/*
+Start a manager on the given SQLite database file, calling prepare with the store before starting, which must be closed by the caller
+*/
+func openTestSqlite(t *testing.T, path string, prepare func(store *SqliteStore)) (*DatabaseManager, *SqliteStore, chan string) {
+	url, kicks := newTestMediaMtx(t)
+	conf := config.NewMainConfig()
+	conf.MediaMtxUrlBase = url
+	conf.MediaMtxUrlBasePublish = url
+	conf.Database.Backend = "sqlite"
+	conf.Database.SqlitePath = path
+	conf.Database.AutoMigrate = true
+	conf.Database.PollInterval = 1
+	store, err := NewSqliteStore(context.Background(), conf.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prepare != nil {
+		prepare(store)
+	}
+	db := &DatabaseManager{}
+	db.InitWithStore(&conf, store)
+	return db, store, kicks
+}
+
+func TestSqliteMigrations(t *testing.T) {
+	_, store, _ := newTestSqlite(t)
+	ctx := context.Background()
+	if applied, err := store.MigrateUp(ctx); err != nil || len(applied) != 0 {
+		t.Errorf("Migrations applied twice: %v (%v)\n", applied, err)
+	}
+	rolledBack, err := store.MigrateDown(ctx, 1)
+	if err != nil || len(rolledBack) != 1 {
+		t.Fatalf("Wrong rollback: %v (%v)\n", rolledBack, err)
+	}
+	status, err := store.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status[len(status)-1].AppliedAt != nil {
+		t.Errorf("Rolled back migration still applied\n")
+	}
+	if applied, err := store.MigrateUp(ctx); err != nil || len(applied) != 1 {
+		t.Errorf("Wrong migrations reapplied: %v (%v)\n", applied, err)
+	}
+}
+
+func TestSqliteTokens(t *testing.T) {
+	db, store, kicks := newTestSqlite(t)
+	ctx := context.Background()
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	maxUses := 1
+	token, err := db.CreateToken(ctx, Token{Path: "stream", Action: "read", QueryToken: "a", ValidFrom: &past, ExpiresAt: &future, MaxUses: &maxUses,
+		AllowedCidrs: []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}, BindFirstIp: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token.AllowedCidrs) != 1 || token.ExpiresAt == nil || token.CreatedAt.IsZero() {
+		t.Errorf("Token did not round trip: %+v\n", token)
+	}
+	creds := token.Credentials()
+	first := Client{Ip: net.ParseIP("203.0.113.5"), Connection: &Connection{Id: "conn1", Protocol: "rtspSession"}}
+	checkValid(t, db, creds, Client{Ip: net.ParseIP("198.51.100.1")}, false)
+	checkValid(t, db, creds, first, true)
+	// The first use is consumed and the IP is bound
+	checkValid(t, db, creds, Client{Ip: net.ParseIP("203.0.113.6"), Connection: &Connection{Id: "conn2", Protocol: "rtspSession"}}, false)
+	if stored, err := store.GetToken(ctx, token.Id); err != nil || stored.UseCount != 1 || stored.BoundIp == nil {
+		t.Errorf("Use and IP not recorded: %+v (%v)\n", stored, err)
+	}
+
+	active := true
+	if tokens, err := store.ListTokens(ctx, TokenFilter{Path: "stream", Active: &active, Limit: 10}); err != nil || len(tokens) != 1 {
+		t.Errorf("Active token not listed: %v (%v)\n", tokens, err)
+	}
+
+	// Revoked directly in the store, so the change must be found by the poller
+	if _, err := store.RevokeToken(ctx, token.Id); err != nil {
+		t.Fatal(err)
+	}
+	waitForKick(t, kicks, "/v3/rtspsessions/kick/conn1")
+}
+
+func TestSqliteConsumeUseDuplicates(t *testing.T) {
+	_, store, _ := newTestSqlite(t)
+	checkConsumeUseDuplicates(t, store)
+}
+
+func TestSqlitePollChanged(t *testing.T) {
+	db, store, _ := newTestSqlite(t)
+	ctx := context.Background()
+	past := time.Now().Add(-time.Hour)
+	token, err := store.CreateToken(ctx, Token{Path: "stream", Action: "read", QueryToken: "a", ExpiresAt: &past})
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := token.Credentials()
+	client := Client{Ip: net.ParseIP("203.0.113.5")}
+	checkValid(t, db, creds, client, false)
+
+	// Changed directly in the database, so only polling for updated rows can find it
+	if _, err := store.db.Exec("UPDATE stream_auth SET expires_at = NULL WHERE id = ?", token.Id); err != nil {
+		t.Fatal(err)
+	}
+	waitForValid(t, db, creds, true)
+	if _, err := store.db.Exec("UPDATE stream_auth SET revoked_at = ? WHERE id = ?", sqliteTime(&past), token.Id); err != nil {
+		t.Fatal(err)
+	}
+	waitForValid(t, db, creds, false)
+	// Restoring a revoked row is picked up as well
+	if _, err := store.db.Exec("UPDATE stream_auth SET revoked_at = NULL WHERE id = ?", token.Id); err != nil {
+		t.Fatal(err)
+	}
+	waitForValid(t, db, creds, true)
+}
+
+func TestSqliteUsers(t *testing.T) {
+	db, store, _ := newTestSqlite(t)
+	hash, err := password.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.db.Exec(`INSERT INTO stream_users (username, password_hash) VALUES ('camera', ?);
+		INSERT INTO stream_user_grants (username, path, action) VALUES ('camera', 'stream', 'publish')`, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := Client{Ip: net.ParseIP("203.0.113.5")}
+	if valid, err := db.ValidateUser("camera", "secret", "stream", "publish", client); err != nil || !valid {
+		t.Errorf("Correct password rejected (%v)\n", err)
+	}
+	if valid, err := db.ValidateUser("camera", "secret", "other", "publish", client); err != nil || valid {
+		t.Errorf("Path without a grant accepted (%v)\n", err)
+	}
+}
+
+func TestSqliteSessions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.db")
+	first, store, _ := openTestSqlite(t, path, nil)
+	ctx := context.Background()
+	kept, err := first.CreateToken(ctx, Token{Path: "stream", Action: "read", QueryToken: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := first.CreateToken(ctx, Token{Path: "stream", Action: "read", QueryToken: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("203.0.113.5")
+	checkValid(t, first, kept.Credentials(), Client{Ip: ip, Connection: &Connection{Id: "conn1", Protocol: "rtspSession"}, Instance: "default"}, true)
+	checkValid(t, first, kept.Credentials(), Client{Ip: ip, Connection: &Connection{Id: "conn2", Protocol: "rtspSession"}}, true)
+	checkValid(t, first, revoked.Credentials(), Client{Ip: ip, Connection: &Connection{Id: "conn3", Protocol: "webRTCSession"}}, true)
+	first.Disconnect(Connection{Id: "conn2"})
+	// Sessions are written in the background
+	if sessions := waitForSessions(t, store, 2); len(sessions) != 2 || sessions[0].Id != "conn1" || sessions[0].Creds != kept.Credentials() || sessions[0].Instance != "default" {
+		t.Errorf("Wrong sessions saved: %+v\n", sessions)
+	}
+	first.Close()
+
+	// Revoked while the server was down, so the connection is kicked on startup
+	second, store, kicks := openTestSqlite(t, path, func(store *SqliteStore) {
+		if _, err := store.RevokeToken(ctx, revoked.Id); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer second.Close()
+	waitForKick(t, kicks, "/v3/webrtcsessions/kick/conn3")
+	if record := second.connections.Get("conn1"); record == nil || record.Value().Instance != "default" {
+		t.Fatalf("Session not restored\n")
+	}
+
+	// Connections from before the restart are still kicked when their credentials are revoked
+	if _, err := store.RevokeToken(ctx, kept.Id); err != nil {
+		t.Fatal(err)
+	}
+	waitForKick(t, kicks, "/v3/rtspsessions/kick/conn1")
+	// The session is deleted after the kick
+	if sessions := waitForSessions(t, store, 0); len(sessions) != 0 {
+		t.Errorf("Sessions not deleted: %+v\n", sessions)
+	}
+}
+
+/*
+Wait for the given number of sessions to be saved, returning the sessions saved
+*/
+func waitForSessions(t *testing.T, store *SqliteStore, count int) []Session {
+	t.Helper()
+	var sessions []Session
+	var err error
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if sessions, err = store.ListSessions(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if len(sessions) == count {
+			break
+		}
+	}
+	return sessions
+}
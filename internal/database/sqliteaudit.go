@@ -0,0 +1,98 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*
+Maximum number of audit entries inserted in a single statement, staying well below the SQLite variable limit
+*/
+const sqliteAuditBatchSize = 100
+
+func (s *SqliteStore) WriteAudit(ctx context.Context, entries []AuditEntry) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for batch := range slices.Chunk(entries, sqliteAuditBatchSize) {
+		values := make([]string, len(batch))
+		args := make([]any, 0, len(batch)*10)
+		for i, e := range batch {
+			values[i] = "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+			args = append(args, sqliteTime(&e.Time), e.Action, e.Path, e.Protocol, e.Ip, e.ConnectionId, e.User, e.Token, e.Result, e.Reason)
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO auth_audit
+			(decided_at, action, path, protocol, ip, connection_id, username, token_hash, result, reason)
+			VALUES `+strings.Join(values, ", "), args...)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SqliteStore) SearchAudit(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	conditions := []string{"1"}
+	args := []any{}
+	add := func(condition string, value any) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.Before > 0 {
+		add("id < ?%d", filter.Before)
+	}
+	if len(filter.Token) > 0 {
+		add("token_hash = ?%d", filter.Token)
+	}
+	if len(filter.Path) > 0 {
+		add("path = ?%d", filter.Path)
+	}
+	if len(filter.Ip) > 0 {
+		add("ip = ?%d", filter.Ip)
+	}
+	if filter.From != nil {
+		add("decided_at >= ?%d", sqliteTime(filter.From))
+	}
+	if filter.To != nil {
+		add("decided_at < ?%d", sqliteTime(filter.To))
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		// Negative limits are unlimited in SQLite
+		limit = -1
+	}
+	args = append(args, limit)
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf("SELECT %v FROM auth_audit WHERE %v ORDER BY id DESC LIMIT ?%d",
+		auditColumns, strings.Join(conditions, " AND "), len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var decided *time.Time
+		if err := rows.Scan(&e.Id, scanSqliteTime(&decided), &e.Action, &e.Path, &e.Protocol, &e.Ip, &e.ConnectionId, &e.User, &e.Token,
+			&e.Result, &e.Reason); err != nil {
+			return nil, err
+		}
+		if decided != nil {
+			e.Time = *decided
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *SqliteStore) PruneAudit(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM auth_audit WHERE decided_at < ?", sqliteTime(&before))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,150 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"time"
+)
+
+//go:embed migrations/sqlite/*.sql
+var sqliteMigrations embed.FS
+
+/*
+Get all migrations and whether they have been applied
+*/
+func (s *SqliteStore) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := s.ensureLedger(ctx)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := sqliteAppliedMigrations(ctx, s.db)
+	if err != nil {
+		return nil, err
+	}
+	status := []MigrationStatus{}
+	for _, m := range migrations {
+		s := MigrationStatus{Migration: m}
+		if appliedAt, ok := applied[m.Version]; ok {
+			s.AppliedAt = &appliedAt
+		}
+		status = append(status, s)
+	}
+	return status, nil
+}
+
+/*
+Apply all pending migrations in order, each in its own transaction, returning the migrations applied
+*/
+func (s *SqliteStore) MigrateUp(ctx context.Context) ([]Migration, error) {
+	migrations, err := s.ensureLedger(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for _, m := range migrations {
+		applied, err := s.migrate(ctx, m, false)
+		if err != nil {
+			return done, fmt.Errorf("migration %04d_%v failed\n%w", m.Version, m.Name, err)
+		}
+		if applied {
+			done = append(done, m)
+		}
+	}
+	return done, nil
+}
+
+/*
+Roll back the given number of most recently applied migrations, returning the migrations rolled back
+*/
+func (s *SqliteStore) MigrateDown(ctx context.Context, steps int) ([]Migration, error) {
+	migrations, err := s.ensureLedger(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		m := migrations[i]
+		applied, err := s.migrate(ctx, m, true)
+		if err != nil {
+			return done, fmt.Errorf("rolling back migration %04d_%v failed\n%w", m.Version, m.Name, err)
+		}
+		if applied {
+			done = append(done, m)
+		}
+	}
+	return done, nil
+}
+
+/*
+Apply or roll back a migration in a transaction, returning false if it was already in that state
+
+Transactions take the write lock up front, so concurrent processes migrate one at a time and see the ledger left by the other.
+*/
+func (s *SqliteStore) migrate(ctx context.Context, m Migration, down bool) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var applied bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = ?)", m.Version).Scan(&applied); err != nil {
+		return false, err
+	}
+	if applied != down {
+		return false, nil
+	}
+	if down {
+		if _, err := tx.ExecContext(ctx, m.down); err != nil {
+			return false, err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = ?", m.Version)
+	} else {
+		if _, err := tx.ExecContext(ctx, m.up); err != nil {
+			return false, err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+/*
+Create the applied migrations ledger if missing, returning the embedded migrations
+*/
+func (s *SqliteStore) ensureLedger(ctx context.Context) ([]Migration, error) {
+	migrations, err := loadMigrations(sqliteMigrations, "migrations/sqlite")
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+	)`)
+	return migrations, err
+}
+
+func sqliteAppliedMigrations(ctx context.Context, db *sql.DB) (map[int]time.Time, error) {
+	rows, err := db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt *time.Time
+		if err := rows.Scan(&version, scanSqliteTime(&appliedAt)); err != nil {
+			return nil, err
+		}
+		if appliedAt != nil {
+			applied[version] = *appliedAt
+		}
+	}
+	return applied, rows.Err()
+}
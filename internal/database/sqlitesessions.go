@@ -0,0 +1,43 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+func (s *SqliteStore) SaveSession(ctx context.Context, session Session) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO sessions (id, protocol, path, action, query_token, username, instance, started_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET protocol = excluded.protocol, path = excluded.path, action = excluded.action,
+		query_token = excluded.query_token, username = excluded.username, instance = excluded.instance`,
+		session.Id, session.Protocol, session.Creds.Path, session.Creds.Action, session.Creds.QueryToken, session.Creds.User, session.Instance,
+		sqliteTime(&session.StartedAt))
+	return err
+}
+
+func (s *SqliteStore) DeleteSession(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE id = ?", id)
+	return err
+}
+
+func (s *SqliteStore) ListSessions(ctx context.Context) ([]Session, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, protocol, path, action, query_token, username, instance, started_at FROM sessions ORDER BY started_at, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		var started *time.Time
+		if err := rows.Scan(&session.Id, &session.Protocol, &session.Creds.Path, &session.Creds.Action, &session.Creds.QueryToken, &session.Creds.User,
+			&session.Instance, scanSqliteTime(&started)); err != nil {
+			return nil, err
+		}
+		if started != nil {
+			session.StartedAt = *started
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func scanSqliteToken(row interface{ Scan(dest ...any) error }) (Token, error) {
+	var t Token
+	var createdAt *time.Time
+	err := row.Scan(&t.Id, &t.Path, &t.Action, &t.QueryToken, scanSqliteTime(&createdAt), scanSqliteTime(&t.ValidFrom), scanSqliteTime(&t.ExpiresAt),
+		scanSqliteTime(&t.RevokedAt), &t.MaxConnections, &t.MaxUses, &t.UseCount, scanSqliteCidrs(&t.AllowedCidrs), &t.BindFirstIp, scanSqlitePrefix(&t.BoundIp))
+	if errors.Is(err, sql.ErrNoRows) {
+		return t, ErrNotFound
+	}
+	if createdAt != nil {
+		t.CreatedAt = *createdAt
+	}
+	return t, err
+}
+
+func scanSqliteTokens(rows *sql.Rows) ([]Token, error) {
+	defer rows.Close()
+	tokens := []Token{}
+	for rows.Next() {
+		t, err := scanSqliteToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *SqliteStore) CreateToken(ctx context.Context, t Token) (Token, error) {
+	cidrs, err := sqliteCidrs(t.AllowedCidrs)
+	if err != nil {
+		return Token{}, err
+	}
+	return scanSqliteToken(s.db.QueryRowContext(ctx, `INSERT INTO stream_auth
+		(path, action, queryToken, valid_from, expires_at, max_connections, max_uses, allowed_cidrs, bind_first_ip)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING `+tokenColumns,
+		t.Path, t.Action, t.QueryToken, sqliteTime(t.ValidFrom), sqliteTime(t.ExpiresAt), t.MaxConnections, t.MaxUses, cidrs, t.BindFirstIp))
+}
+
+func (s *SqliteStore) GetToken(ctx context.Context, id int64) (Token, error) {
+	return scanSqliteToken(s.db.QueryRowContext(ctx, "SELECT "+tokenColumns+" FROM stream_auth WHERE id = ?", id))
+}
+
+func (s *SqliteStore) ListTokens(ctx context.Context, filter TokenFilter) ([]Token, error) {
+	conditions := []string{"id > ?1"}
+	args := []any{filter.After}
+	if len(filter.Path) > 0 {
+		args = append(args, filter.Path)
+		conditions = append(conditions, fmt.Sprintf("path = ?%d", len(args)))
+	}
+	if len(filter.Action) > 0 {
+		args = append(args, filter.Action)
+		conditions = append(conditions, fmt.Sprintf("action = ?%d", len(args)))
+	}
+	if filter.Active != nil {
+		now := time.Now()
+		args = append(args, sqliteTime(&now))
+		active := fmt.Sprintf("(revoked_at IS NULL AND (valid_from IS NULL OR valid_from <= ?%[1]d) AND (expires_at IS NULL OR expires_at > ?%[1]d))", len(args))
+		if *filter.Active {
+			conditions = append(conditions, active)
+		} else {
+			conditions = append(conditions, "NOT "+active)
+		}
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		// Negative limits are unlimited in SQLite
+		limit = -1
+	}
+	args = append(args, limit)
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf("SELECT %v FROM stream_auth WHERE %v ORDER BY id LIMIT ?%d",
+		tokenColumns, strings.Join(conditions, " AND "), len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanSqliteTokens(rows)
+}
+
+func (s *SqliteStore) UpdateToken(ctx context.Context, id int64, update TokenUpdate) (Token, error) {
+	sets := []string{}
+	args := []any{id}
+	add := func(column string, set bool, value any) {
+		if set {
+			args = append(args, value)
+			sets = append(sets, fmt.Sprintf("%v = ?%d", column, len(args)))
+		}
+	}
+	add("valid_from", update.ValidFrom.Set, sqliteTime(update.ValidFrom.Value))
+	add("expires_at", update.ExpiresAt.Set, sqliteTime(update.ExpiresAt.Value))
+	add("max_connections", update.MaxConnections.Set, update.MaxConnections.Value)
+	add("max_uses", update.MaxUses.Set, update.MaxUses.Value)
+	if update.AllowedCidrs.Set {
+		var cidrs any
+		if update.AllowedCidrs.Value != nil {
+			var err error
+			if cidrs, err = sqliteCidrs(*update.AllowedCidrs.Value); err != nil {
+				return Token{}, err
+			}
+		}
+		add("allowed_cidrs", true, cidrs)
+	}
+	add("bind_first_ip", update.BindFirstIp.Set && update.BindFirstIp.Value != nil, update.BindFirstIp.Value)
+	add("bound_ip", update.BoundIp.Set, sqlitePrefix(update.BoundIp.Value))
+	if len(sets) == 0 {
+		return s.GetToken(ctx, id)
+	}
+	return scanSqliteToken(s.db.QueryRowContext(ctx, fmt.Sprintf("UPDATE stream_auth SET %v WHERE id = ?1 RETURNING %v",
+		strings.Join(sets, ", "), tokenColumns), args...))
+}
+
+func (s *SqliteStore) RevokeToken(ctx context.Context, id int64) (Token, error) {
+	return scanSqliteToken(s.db.QueryRowContext(ctx, `UPDATE stream_auth SET revoked_at = COALESCE(revoked_at, strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+		WHERE id = ? RETURNING `+tokenColumns, id))
+}
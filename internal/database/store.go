@@ -0,0 +1,78 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"time"
+)
+
+var ErrNotSupported = errors.New("not supported by the credential store")
+
+/*
+Storage backend holding credentials, which the cache and connection tracking sit on top of
+*/
+type CredentialStore interface {
+	// Active (not revoked) rows matching token credentials
+	LookupToken(ctx context.Context, creds Credentials) ([]Token, error)
+	// Password hash of an active user and whether they are granted the path and action, empty if there is no such user
+	LookupUser(ctx context.Context, creds Credentials) (string, bool, error)
+	// Atomically consume a use of limited use credentials, false if all uses have been consumed
+	ConsumeUse(ctx context.Context, creds Credentials) (bool, error)
+	// Bind credentials to the given prefix if not yet bound, returning the prefix they are bound to
+	BindIp(ctx context.Context, creds Credentials, prefix netip.Prefix) (netip.Prefix, error)
+	// Token credentials with rows created or changed after the given time, including revoked rows
+	ChangedSince(ctx context.Context, since time.Time) ([]Credentials, error)
+	// Subset of the given token credentials which still have an active row
+	ActiveTokens(ctx context.Context, creds []Credentials) ([]Credentials, error)
+	Close()
+}
+
+/*
+Change to credentials pushed by a store, either token credentials or a user
+*/
+type Change struct {
+	Creds Credentials
+	User  string
+}
+
+/*
+Store which pushes changes to credentials as they happen, rather than being polled
+*/
+type ChangeNotifier interface {
+	// Check the store can send changes, returning an error if they are unavailable
+	EnableNotify(ctx context.Context) error
+	// Deliver changes until the context is cancelled or the store disconnects, calling ready once listening has started
+	Listen(ctx context.Context, ready func(), changed func(Change)) error
+}
+
+/*
+Store which can manage token credentials
+*/
+type TokenStore interface {
+	CreateToken(ctx context.Context, t Token) (Token, error)
+	GetToken(ctx context.Context, id int64) (Token, error)
+	ListTokens(ctx context.Context, filter TokenFilter) ([]Token, error)
+	UpdateToken(ctx context.Context, id int64, update TokenUpdate) (Token, error)
+	RevokeToken(ctx context.Context, id int64) (Token, error)
+}
+
+/*
+Store with a versioned schema
+*/
+type Migrator interface {
+	MigrationStatus(ctx context.Context) ([]MigrationStatus, error)
+	MigrateUp(ctx context.Context) ([]Migration, error)
+	MigrateDown(ctx context.Context, steps int) ([]Migration, error)
+}
+
+/*
+Store which can persist tracked connections, so they can still be kicked after a restart
+*/
+type SessionStore interface {
+	// Create or update a session
+	SaveSession(ctx context.Context, s Session) error
+	DeleteSession(ctx context.Context, id string) error
+	// All sessions, oldest first
+	ListSessions(ctx context.Context) ([]Session, error)
+}
@@ -0,0 +1,175 @@
+package database
+
+import (
+	"cmp"
+	"log/slog"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pseudoresonance/authserver/internal/mediamtx"
+)
+
+/*
+Stream on a MediaMTX path, from the ready and read webhooks
+*/
+type StreamState struct {
+	Instance   string    `json:"instance"` // Empty if the webhook URL has no instance
+	Path       string    `json:"path"`
+	SourceType string    `json:"sourceType"` // Publishing connection (ex: rtspSession) or other source (ex: rtspSource), empty until ready
+	SourceId   string    `json:"sourceId"`
+	ReadySince time.Time `json:"readySince"`
+	Readers    int       `json:"readers"`
+}
+
+type streamKey struct {
+	instance string
+	path     string
+}
+
+type trackedStream struct {
+	state   StreamState
+	ready   bool
+	readers map[string]struct{}
+}
+
+/*
+Streams which are ready or being read, safe to use without initialisation
+*/
+type streamTracker struct {
+	mutex   sync.Mutex
+	streams map[streamKey]*trackedStream
+}
+
+/*
+Get a stream, adding it if not tracked yet, as a read webhook may arrive before the ready webhook
+*/
+func (s *streamTracker) get(key streamKey) *trackedStream {
+	if s.streams == nil {
+		s.streams = map[streamKey]*trackedStream{}
+	}
+	stream, ok := s.streams[key]
+	if !ok {
+		stream = &trackedStream{state: StreamState{Instance: key.instance, Path: key.path, ReadySince: time.Now()}, readers: map[string]struct{}{}}
+		s.streams[key] = stream
+	}
+	return stream
+}
+
+/*
+Called by MediaMTX runOnReady webhook, with the connection publishing the stream if any
+*/
+func (d *DatabaseManager) StreamReady(instance string, path string, source Connection) {
+	d.streams.mutex.Lock()
+	stream := d.streams.get(streamKey{instance, path})
+	stream.state.SourceType = source.Protocol
+	stream.state.SourceId = source.Id
+	stream.state.ReadySince = time.Now()
+	stream.ready = true
+	d.streams.mutex.Unlock()
+
+	if len(source.Id) > 0 {
+		// Same as the connect webhook, in case it was missed
+		d.Connect(source)
+	}
+}
+
+/*
+Called by MediaMTX runOnNotReady webhook
+*/
+func (d *DatabaseManager) StreamNotReady(instance string, path string) {
+	d.streams.mutex.Lock()
+	defer d.streams.mutex.Unlock()
+	delete(d.streams.streams, streamKey{instance, path})
+}
+
+/*
+Called by MediaMTX runOnRead webhook, with the query the reader connected with
+*/
+func (d *DatabaseManager) StartRead(instance string, path string, reader Connection, query string) {
+	d.streams.mutex.Lock()
+	stream := d.streams.get(streamKey{instance, path})
+	stream.readers[reader.Id] = struct{}{}
+	stream.state.Readers = len(stream.readers)
+	d.streams.mutex.Unlock()
+
+	if d.connections.Get(reader.Id) == nil {
+		d.trackReader(instance, path, reader, query)
+	}
+	// Same as the connect webhook, in case it was missed
+	d.Connect(reader)
+}
+
+/*
+Track a reader whose auth request was not tracked (ex: made during a restart) by the token in its query, as reconciling does
+
+Readers without a valid token are left alone, as they were accepted by other means (ex: private IP, signed token).
+As the webhook is not authenticated, the reader is only tracked once MediaMTX confirms it is reading the path with the same
+query, and counts towards the connection limit like an auth request, so it is kicked if over the limit.
+*/
+func (d *DatabaseManager) trackReader(instance string, path string, reader Connection, query string) {
+	if kinds, ok := mediamtx.KindsForProtocol(reader.Protocol); !ok || len(kinds) == 0 {
+		// Not a persistent connection (ex: HLS)
+		return
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil || len(values.Get(d.conf.QueryTokenKey)) == 0 {
+		return
+	}
+
+	creds := &Credentials{Path: path, Action: "read", QueryToken: values.Get(d.conf.QueryTokenKey)}
+	credData, err := d.lookupCached(creds, func(credData *CredentialData) (credentialWindow, error) {
+		return d.validateAuth(creds)
+	})
+	if err != nil {
+		slog.Error("Error while validating auth", "creds", creds, "err", err)
+		return
+	}
+	if credData == nil {
+		return
+	}
+	record := ConnectionRecord{Info: reader, Creds: creds, Instance: instance, Started: time.Now()}
+	live, state := d.getConnection(record)
+	if state != connectionAlive || live.State != "read" || live.Path != path || live.Query != query {
+		slog.Warn("Reader to track not found on MediaMTX", "instance", instance, "path", path, "id", reader.Id)
+		return
+	}
+	if !d.registerConnection(creds, credData, Client{Connection: &reader, Instance: instance}) {
+		d.kicks.add(record)
+	}
+}
+
+/*
+Called by MediaMTX runOnUnread webhook
+*/
+func (d *DatabaseManager) StopRead(instance string, path string, reader Connection) {
+	d.streams.mutex.Lock()
+	defer d.streams.mutex.Unlock()
+	stream, ok := d.streams.streams[streamKey{instance, path}]
+	if !ok {
+		return
+	}
+	delete(stream.readers, reader.Id)
+	stream.state.Readers = len(stream.readers)
+	if len(stream.readers) == 0 && !stream.ready {
+		// Only tracked for its readers, as the ready webhook never arrived
+		delete(d.streams.streams, streamKey{instance, path})
+	}
+}
+
+/*
+Streams which are ready or being read, by instance and path
+*/
+func (d *DatabaseManager) Streams() []StreamState {
+	d.streams.mutex.Lock()
+	defer d.streams.mutex.Unlock()
+	streams := make([]StreamState, 0, len(d.streams.streams))
+	for _, stream := range d.streams.streams {
+		streams = append(streams, stream.state)
+	}
+	slices.SortFunc(streams, func(a StreamState, b StreamState) int {
+		return cmp.Or(cmp.Compare(a.Instance, b.Instance), cmp.Compare(a.Path, b.Path))
+	})
+	return streams
+}
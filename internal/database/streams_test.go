@@ -0,0 +1,97 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+	"github.com/pseudoresonance/authserver/internal/mediamtx"
+)
+
+/*
+Start a manager on a memory store with a fake MediaMTX API listing the given WebRTC readers, with kick requests sent to the
+returned channel
+*/
+func newTestReaders(t *testing.T, readers map[string]mediamtx.Conn) (*DatabaseManager, *MemoryStore, chan string) {
+	kicks := make(chan string, 16)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			kicks <- r.URL.Path
+			return
+		}
+		reader, ok := readers[strings.TrimPrefix(r.URL.Path, "/v3/webrtcsessions/get/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(reader)
+	}))
+	t.Cleanup(api.Close)
+	conf := config.NewMainConfig()
+	conf.MediaMtxUrlBase = api.URL
+	conf.MediaMtxUrlBasePublish = api.URL
+	store := NewMemoryStore()
+	db := &DatabaseManager{}
+	db.InitWithStore(&conf, store)
+	t.Cleanup(db.Close)
+	return db, store, kicks
+}
+
+func TestReadTracked(t *testing.T) {
+	db, store, kicks := newTestReaders(t, map[string]mediamtx.Conn{
+		"conn1": {Id: "conn1", State: "read", Path: "stream", Query: "token=a"},
+		"conn2": {Id: "conn2", State: "read", Path: "stream", Query: "token=b"},
+		"conn4": {Id: "conn4", State: "read", Path: "stream", Query: "token=c"},
+		"conn5": {Id: "conn5", State: "read", Path: "stream", Query: "token=a"},
+	})
+	maxConnections := 1
+	token := createToken(t, store, Token{Path: "stream", Action: "read", QueryToken: "a", MaxConnections: &maxConnections})
+
+	// Readers whose auth request was not tracked are tracked from the read webhook
+	read := func(id string, query string) {
+		db.StartRead("", "stream", Connection{Id: id, Protocol: "webRTCSession"}, query)
+	}
+	read("conn1", "token=a")
+	read("conn2", "token=b")
+	// The webhook is not authenticated, so readers must exist on MediaMTX with the same query
+	read("conn3", "token=a")
+	read("conn4", "token=a")
+	if db.connections.Get("conn1") == nil {
+		t.Fatalf("Reader with valid token not tracked\n")
+	}
+	for _, id := range []string{"conn2", "conn3", "conn4"} {
+		if db.connections.Get(id) != nil {
+			t.Errorf("Reader %v tracked\n", id)
+		}
+	}
+
+	// Readers over the connection limit are kicked
+	read("conn5", "token=a")
+	waitForKick(t, kicks, "/v3/webrtcsessions/kick/conn5")
+	if db.connections.Get("conn5") != nil {
+		t.Errorf("Reader over the connection limit tracked\n")
+	}
+	if _, err := db.RevokeToken(context.Background(), token.Id); err != nil {
+		t.Fatal(err)
+	}
+	waitForKick(t, kicks, "/v3/webrtcsessions/kick/conn1")
+}
+
+func TestUnreadStream(t *testing.T) {
+	db, _, _ := newTestManager(t)
+	db.StreamReady("", "ready", Connection{Id: "pub1", Protocol: "rtmpConn"})
+	db.StartRead("", "ready", Connection{Id: "conn1", Protocol: "webRTCSession"}, "")
+	db.StartRead("", "unready", Connection{Id: "conn2", Protocol: "webRTCSession"}, "")
+	db.StopRead("", "ready", Connection{Id: "conn1", Protocol: "webRTCSession"})
+	db.StopRead("", "unready", Connection{Id: "conn2", Protocol: "webRTCSession"})
+
+	// Streams which never became ready are removed with their last reader
+	streams := db.Streams()
+	if len(streams) != 1 || streams[0].Path != "ready" || streams[0].Readers != 0 {
+		t.Errorf("Wrong streams: %+v\n", streams)
+	}
+}
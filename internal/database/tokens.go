@@ -0,0 +1,161 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"time"
+)
+
+var ErrNotFound = errors.New("not found")
+
+/*
+Credentials row in stream_auth
+*/
+type Token struct {
+	Id             int64          `json:"id"`
+	Path           string         `json:"path"`
+	Action         string         `json:"action"`
+	QueryToken     string         `json:"token"`
+	CreatedAt      time.Time      `json:"createdAt"`
+	ValidFrom      *time.Time     `json:"validFrom"`
+	ExpiresAt      *time.Time     `json:"expiresAt"`
+	RevokedAt      *time.Time     `json:"revokedAt"`
+	MaxConnections *int           `json:"maxConnections"`
+	MaxUses        *int           `json:"maxUses"`
+	UseCount       int            `json:"useCount"`
+	AllowedCidrs   []netip.Prefix `json:"allowedCidrs"`
+	BindFirstIp    bool           `json:"bindFirstIp"`
+	BoundIp        *netip.Prefix  `json:"boundIp"`
+}
+
+func (t *Token) Credentials() Credentials {
+	return Credentials{Path: t.Path, Action: t.Action, QueryToken: t.QueryToken}
+}
+
+/*
+Value which tracks whether it was set at all, to distinguish unchanged fields from fields set to null
+*/
+type Optional[T any] struct {
+	Set   bool
+	Value *T
+}
+
+func (o *Optional[T]) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	if string(data) == "null" {
+		o.Value = nil
+		return nil
+	}
+	o.Value = new(T)
+	return json.Unmarshal(data, o.Value)
+}
+
+/*
+Fields which can be changed on existing credentials
+*/
+type TokenUpdate struct {
+	ValidFrom      Optional[time.Time]      `json:"validFrom"`
+	ExpiresAt      Optional[time.Time]      `json:"expiresAt"`
+	MaxConnections Optional[int]            `json:"maxConnections"`
+	MaxUses        Optional[int]            `json:"maxUses"`
+	AllowedCidrs   Optional[[]netip.Prefix] `json:"allowedCidrs"`
+	BindFirstIp    Optional[bool]           `json:"bindFirstIp"`
+	BoundIp        Optional[netip.Prefix]   `json:"boundIp"`
+}
+
+/*
+Filter and pagination for listing credentials
+*/
+type TokenFilter struct {
+	Path   string
+	Action string
+	Active *bool // Only credentials which are (or are not) currently usable
+	After  int64 // Only IDs after this, for pagination
+	Limit  int
+}
+
+/*
+Generate a cryptographically random query token
+*/
+func NewQueryToken() string {
+	return rand.Text()
+}
+
+func (d *DatabaseManager) tokenStore() (TokenStore, error) {
+	store, ok := d.store.(TokenStore)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return store, nil
+}
+
+/*
+Create credentials, generating a random query token if none is given
+*/
+func (d *DatabaseManager) CreateToken(ctx context.Context, t Token) (Token, error) {
+	store, err := d.tokenStore()
+	if err != nil {
+		return Token{}, err
+	}
+	if len(t.QueryToken) == 0 {
+		t.QueryToken = NewQueryToken()
+	}
+	created, err := store.CreateToken(ctx, t)
+	if err != nil {
+		return created, err
+	}
+	// Apply immediately in case the credentials were already cached as invalid
+	d.refresh(created.Credentials())
+	return created, nil
+}
+
+func (d *DatabaseManager) GetToken(ctx context.Context, id int64) (Token, error) {
+	store, err := d.tokenStore()
+	if err != nil {
+		return Token{}, err
+	}
+	return store.GetToken(ctx, id)
+}
+
+func (d *DatabaseManager) ListTokens(ctx context.Context, filter TokenFilter) ([]Token, error) {
+	store, err := d.tokenStore()
+	if err != nil {
+		return nil, err
+	}
+	return store.ListTokens(ctx, filter)
+}
+
+/*
+Update credentials, applying the change to the cache and tracked connections immediately
+*/
+func (d *DatabaseManager) UpdateToken(ctx context.Context, id int64, update TokenUpdate) (Token, error) {
+	store, err := d.tokenStore()
+	if err != nil {
+		return Token{}, err
+	}
+	updated, err := store.UpdateToken(ctx, id, update)
+	if err != nil {
+		return updated, err
+	}
+	d.refresh(updated.Credentials())
+	return updated, nil
+}
+
+/*
+Revoke credentials, invalidating the cache and kicking tracked connections immediately
+*/
+func (d *DatabaseManager) RevokeToken(ctx context.Context, id int64) (Token, error) {
+	store, err := d.tokenStore()
+	if err != nil {
+		return Token{}, err
+	}
+	revoked, err := store.RevokeToken(ctx, id)
+	if err != nil {
+		return revoked, err
+	}
+	d.refresh(revoked.Credentials())
+	return revoked, nil
+}
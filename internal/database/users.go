@@ -0,0 +1,127 @@
+package database
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+
+	ttlcache "github.com/jellydator/ttlcache/v3"
+
+	"github.com/pseudoresonance/authserver/internal/password"
+)
+
+/*
+Per-process key for password digests, so cache keys cannot be used to recover passwords
+*/
+var passwordDigestKey = rand.Text()
+
+func passwordDigest(password string) string {
+	mac := hmac.New(sha256.New, []byte(passwordDigestKey))
+	mac.Write([]byte(password))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+Key for rejected username/password credentials, per user, path and action rather than per password
+*/
+func rejectedUserKey(req *Credentials) Credentials {
+	return Credentials{Action: req.Action, Path: req.Path, User: req.User}
+}
+
+/*
+Whether username/password credentials were recently rejected, with the same password or with any password if the user
+does not exist or is not granted the path and action
+*/
+func (d *DatabaseManager) userRejected(req *Credentials) bool {
+	rejection := d.rejections.Get(rejectedUserKey(req))
+	return rejection != nil && (len(rejection.Value()) == 0 || rejection.Value() == req.PasswordDigest)
+}
+
+/*
+Remember rejected username/password credentials, replacing any earlier rejection for the user, path and action
+*/
+func (d *DatabaseManager) rejectUser(req *Credentials, credData *CredentialData) {
+	digest := ""
+	if len(credData.getPasswordHash()) > 0 {
+		// The user exists and is granted access, so only this password was wrong
+		digest = req.PasswordDigest
+	}
+	d.rejections.Set(rejectedUserKey(req), digest, ttlcache.DefaultTTL)
+}
+
+/*
+Validate username/password credentials against the cache and database and handle new connections
+*/
+func (d *DatabaseManager) ValidateUser(user string, pass string, path string, action string, client Client) (bool, error) {
+	req := &Credentials{Action: action, Path: path, User: user, PasswordDigest: passwordDigest(pass)}
+	return d.validateCached(req, client, func(credData *CredentialData) (credentialWindow, error) {
+		window, hash, err := d.validateUser(req, pass)
+		credData.setPasswordHash(hash)
+		return window, err
+	})
+}
+
+/*
+Check username/password credentials are valid without registering a connection
+*/
+func (d *DatabaseManager) CheckUser(user string, pass string, path string, action string) (bool, error) {
+	req := &Credentials{Action: action, Path: path, User: user, PasswordDigest: passwordDigest(pass)}
+	credData, err := d.lookupCached(req, func(credData *CredentialData) (credentialWindow, error) {
+		window, hash, err := d.validateUser(req, pass)
+		credData.setPasswordHash(hash)
+		return window, err
+	})
+	return credData != nil, err
+}
+
+/*
+Internal function to validate a user's password and grants against the database, returning the password hash used
+*/
+func (d *DatabaseManager) validateUser(req *Credentials, pass string) (credentialWindow, string, error) {
+	hash, granted, err := d.lookupUser(req)
+	if err != nil || !granted {
+		return credentialWindow{}, "", err
+	}
+	valid, err := password.Verify(hash, pass)
+	if err != nil {
+		return credentialWindow{}, "", err
+	}
+	return credentialWindow{Valid: valid}, hash, nil
+}
+
+/*
+Internal function to revalidate a user against the database, which is valid if the password hash is unchanged
+*/
+func (d *DatabaseManager) validateUserHash(req *Credentials, verifiedHash string) (credentialWindow, error) {
+	hash, granted, err := d.lookupUser(req)
+	if err != nil {
+		return credentialWindow{}, err
+	}
+	return credentialWindow{Valid: granted && len(verifiedHash) > 0 && hash == verifiedHash}, nil
+}
+
+/*
+Fetch an active user's password hash and whether they are granted the requested path and action
+*/
+func (d *DatabaseManager) lookupUser(req *Credentials) (string, bool, error) {
+	return d.store.LookupUser(context.Background(), *req)
+}
+
+/*
+Revalidate all cached credentials for the given user
+*/
+func (d *DatabaseManager) refreshUser(user string) {
+	// The rejected password or missing grant may now be valid
+	for _, creds := range d.rejections.Keys() {
+		if creds.User == user {
+			d.rejections.Delete(creds)
+		}
+	}
+	for _, creds := range d.cache.Keys() {
+		if creds.User == user {
+			d.refresh(creds)
+		}
+	}
+}
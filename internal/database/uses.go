@@ -0,0 +1,61 @@
+package database
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	ttlcache "github.com/jellydator/ttlcache/v3"
+)
+
+/*
+A client which has consumed a use of limited use credentials
+*/
+type consumerKey struct {
+	Creds    Credentials
+	Consumer string
+}
+
+/*
+Identify the client for counting uses, by connection ID if available, otherwise by IP (ex: HLS)
+*/
+func (c Client) consumer() string {
+	if c.Connection != nil && len(c.Connection.Id) > 0 {
+		return "id:" + c.Connection.Id
+	}
+	return "ip:" + c.Ip.String()
+}
+
+/*
+Consume a use of limited use credentials for a new client
+
+Repeated requests from a client which already consumed a use (ex: HLS segments, reconnecting WebRTC) do not consume another.
+*/
+func (d *DatabaseManager) consumeUse(req *Credentials, credData *CredentialData, client Client) bool {
+	if !credData.hasLimitedUses() {
+		return true
+	}
+	key := consumerKey{Creds: *req, Consumer: client.consumer()}
+	if d.consumers.Get(key) != nil {
+		return true
+	}
+
+	// Concurrent requests from the same client share a single attempt
+	group := strings.Join([]string{req.Path, req.Action, req.QueryToken, key.Consumer}, "\x00")
+	consumed, _, _ := d.consumeGroup.Do(group, func() (any, error) {
+		if d.consumers.Get(key) != nil {
+			return true, nil
+		}
+		// Always checked in the store so a use cannot be granted from the cache
+		consumed, err := d.store.ConsumeUse(context.Background(), *req)
+		if err != nil {
+			slog.Error("Error while consuming credential use", "creds", *req, "err", err)
+		}
+		if !consumed {
+			return false, nil
+		}
+		d.consumers.Set(key, struct{}{}, ttlcache.DefaultTTL)
+		return true, nil
+	})
+	return consumed.(bool)
+}
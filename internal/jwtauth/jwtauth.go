@@ -0,0 +1,184 @@
+package jwtauth
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pseudoresonance/authserver/internal/config"
+)
+
+var (
+	ErrNoExpiry   = errors.New("token has no expiry")
+	ErrExpired    = errors.New("token expired")
+	ErrPath       = errors.New("token not valid for this path")
+	ErrAction     = errors.New("token not valid for this action")
+	ErrUnknownKey = errors.New("unknown key id")
+)
+
+/*
+Validates JWTs against a set of public keys and maps their claims to allowed paths and actions
+*/
+type Validator struct {
+	conf config.JwtConfig
+	keys map[string]crypto.PublicKey
+	all  []crypto.PublicKey
+}
+
+func NewValidator(conf config.JwtConfig) (*Validator, error) {
+	keys := slices.Clone(conf.Keys)
+	if len(conf.JwksFile) > 0 {
+		fileKeys, err := readJwksFile(conf.JwksFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading JWKS file %v: %w", conf.JwksFile, err)
+		}
+		keys = append(keys, fileKeys...)
+	}
+
+	// No algorithms would accept every algorithm, so configs from before algorithms were added get the defaults
+	if len(conf.Algorithms) == 0 {
+		conf.Algorithms = slices.Clone(config.DefaultJwtAlgorithms)
+	}
+	v := &Validator{conf: conf, keys: map[string]crypto.PublicKey{}}
+	for _, key := range keys {
+		if len(key.Use) > 0 && key.Use != "sig" {
+			continue
+		}
+		pub, err := parseJwk(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWK %v: %w", key.Kid, err)
+		}
+		if len(key.Kid) > 0 {
+			v.keys[key.Kid] = pub
+		}
+		v.all = append(v.all, pub)
+	}
+	return v, nil
+}
+
+/*
+Check if any keys are configured
+*/
+func (v *Validator) Enabled() bool {
+	return v != nil && len(v.all) > 0
+}
+
+/*
+Validate a JWT grants the given action on the given path at the given time, returning its expiry
+*/
+func (v *Validator) Validate(token string, streamPath string, action string, now time.Time) (time.Time, error) {
+	if !v.Enabled() {
+		return time.Time{}, ErrUnknownKey
+	}
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(v.conf.Algorithms),
+		jwt.WithLeeway(time.Duration(v.conf.Leeway) * time.Second),
+		jwt.WithTimeFunc(func() time.Time { return now }),
+	}
+	if len(v.conf.Issuer) > 0 {
+		options = append(options, jwt.WithIssuer(v.conf.Issuer))
+	}
+	if len(v.conf.Audience) > 0 {
+		options = append(options, jwt.WithAudience(v.conf.Audience))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.NewParser(options...).ParseWithClaims(token, claims, v.keyFunc)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	expiresAt, err := v.expiry(claims, now)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !slices.Contains(claimStrings(claims[v.conf.ActionsClaim]), action) {
+		return time.Time{}, ErrAction
+	}
+	if !slices.ContainsFunc(claimStrings(claims[v.conf.PathsClaim]), func(pattern string) bool {
+		return matchPath(pattern, streamPath)
+	}) {
+		return time.Time{}, ErrPath
+	}
+	return expiresAt, nil
+}
+
+/*
+Select the verification key by key ID, or try all keys if the token has none
+*/
+func (v *Validator) keyFunc(token *jwt.Token) (any, error) {
+	if kid, ok := token.Header["kid"].(string); ok && len(kid) > 0 {
+		key, exists := v.keys[kid]
+		if !exists {
+			return nil, ErrUnknownKey
+		}
+		return key, nil
+	}
+	set := jwt.VerificationKeySet{}
+	for _, key := range v.all {
+		set.Keys = append(set.Keys, key)
+	}
+	return set, nil
+}
+
+/*
+Check if a token is shaped like a JWT, without verifying it
+*/
+func IsJwt(token string) bool {
+	_, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	return err == nil
+}
+
+/*
+Read the configured expiry claim, which is required
+*/
+func (v *Validator) expiry(claims jwt.MapClaims, now time.Time) (time.Time, error) {
+	var expiresAt time.Time
+	switch exp := claims[v.conf.ExpiryClaim].(type) {
+	case float64:
+		expiresAt = time.Unix(0, int64(exp*float64(time.Second)))
+	default:
+		return time.Time{}, ErrNoExpiry
+	}
+	if !now.Before(expiresAt.Add(time.Duration(v.conf.Leeway) * time.Second)) {
+		return time.Time{}, ErrExpired
+	}
+	return expiresAt, nil
+}
+
+/*
+Read a claim which is either a single string or a list of strings
+*/
+func claimStrings(claim any) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []any:
+		ret := make([]string, 0, len(value))
+		for _, entry := range value {
+			if str, ok := entry.(string); ok {
+				ret = append(ret, str)
+			}
+		}
+		return ret
+	}
+	return nil
+}
+
+/*
+Match a path against an exact path, glob pattern, or regular expression prefixed with ~ which must match the whole path
+*/
+func matchPath(pattern string, streamPath string) bool {
+	if expr, found := strings.CutPrefix(pattern, "~"); found {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		return err == nil && re.MatchString(streamPath)
+	}
+	matched, err := path.Match(pattern, streamPath)
+	return err == nil && matched
+}
@@ -0,0 +1,176 @@
+package jwtauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pseudoresonance/authserver/internal/config"
+)
+
+func newTestKey(t *testing.T) (*ecdsa.PrivateKey, config.Jwk) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	point, err := key.PublicKey.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, config.Jwk{
+		Kty: "EC",
+		Kid: "test",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(point[1:33]),
+		Y:   base64.RawURLEncoding.EncodeToString(point[33:]),
+	}
+}
+
+func newTestValidator(t *testing.T, jwk config.Jwk) *Validator {
+	conf := config.NewMainConfig().Jwt
+	conf.Keys = []config.Jwk{jwk}
+	conf.Issuer = "sso"
+	v, err := NewValidator(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func signToken(t *testing.T, key *ecdsa.PrivateKey, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = "test"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func checkErr(t *testing.T, test error, target error) {
+	if !errors.Is(test, target) {
+		t.Errorf("Wrong error: need (%v) got (%v)\n", target, test)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	key, jwk := newTestKey(t)
+	v := newTestValidator(t, jwk)
+	now := time.Now()
+	token := signToken(t, key, jwt.MapClaims{
+		"iss":              "sso",
+		"exp":              now.Add(time.Hour).Unix(),
+		"mediamtx_paths":   []string{"cameras/*", "lobby"},
+		"mediamtx_actions": "read",
+	})
+
+	expiresAt, err := v.Validate(token, "cameras/front", "read", now)
+	checkErr(t, err, nil)
+	if expiresAt.Unix() != now.Add(time.Hour).Unix() {
+		t.Errorf("Wrong expiry: need (%v) got (%v)\n", now.Add(time.Hour), expiresAt)
+	}
+	_, err = v.Validate(token, "lobby", "read", now)
+	checkErr(t, err, nil)
+	_, err = v.Validate(token, "cameras/front/sub", "read", now)
+	checkErr(t, err, ErrPath)
+	_, err = v.Validate(token, "lobby", "publish", now)
+	checkErr(t, err, ErrAction)
+	_, err = v.Validate(token, "lobby", "read", now.Add(2*time.Hour))
+	checkErr(t, err, jwt.ErrTokenExpired)
+}
+
+func TestValidateClaims(t *testing.T) {
+	key, jwk := newTestKey(t)
+	v := newTestValidator(t, jwk)
+	now := time.Now()
+
+	noExpiry := signToken(t, key, jwt.MapClaims{"iss": "sso", "mediamtx_paths": "lobby", "mediamtx_actions": "read"})
+	_, err := v.Validate(noExpiry, "lobby", "read", now)
+	checkErr(t, err, ErrNoExpiry)
+
+	wrongIssuer := signToken(t, key, jwt.MapClaims{"iss": "other", "exp": now.Add(time.Hour).Unix(), "mediamtx_paths": "lobby", "mediamtx_actions": "read"})
+	_, err = v.Validate(wrongIssuer, "lobby", "read", now)
+	checkErr(t, err, jwt.ErrTokenInvalidIssuer)
+
+	otherKey, _ := newTestKey(t)
+	wrongKey := signToken(t, otherKey, jwt.MapClaims{"iss": "sso", "exp": now.Add(time.Hour).Unix(), "mediamtx_paths": "lobby", "mediamtx_actions": "read"})
+	_, err = v.Validate(wrongKey, "lobby", "read", now)
+	checkErr(t, err, jwt.ErrTokenSignatureInvalid)
+}
+
+func TestMatchPath(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		path    string
+		target  bool
+	}{
+		{"~^cam[0-9]+$", "cam12", true},
+		{"~cam[0-9]+", "cam12", true},
+		// Regular expressions must match the whole path
+		{"~cam[0-9]+", "private/cam12", false},
+		{"~cam[0-9]+", "cam12/private", false},
+		{"~cam1|cam2", "cam2", true},
+		{"~cam1|cam2", "cam2/private", false},
+		{"cam", "cam12", false},
+		{"cameras/*", "cameras/front", true},
+	} {
+		if matched := matchPath(c.pattern, c.path); matched != c.target {
+			t.Errorf("Wrong match of (%v) against (%v): need (%v) got (%v)\n", c.path, c.pattern, c.target, matched)
+		}
+	}
+}
+
+func TestNoAlgorithms(t *testing.T) {
+	key, jwk := newTestKey(t)
+	conf := config.NewMainConfig().Jwt
+	conf.Keys = []config.Jwk{jwk}
+	conf.Algorithms = nil
+	v, err := NewValidator(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(v.conf.Algorithms, config.DefaultJwtAlgorithms) {
+		t.Errorf("Wrong algorithms: need (%v) got (%v)\n", config.DefaultJwtAlgorithms, v.conf.Algorithms)
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{"exp": now.Add(time.Hour).Unix(), "mediamtx_paths": "lobby", "mediamtx_actions": "read"}
+	if _, err := v.Validate(signToken(t, key, claims), "lobby", "read", now); err != nil {
+		t.Errorf("Default algorithm rejected: %v\n", err)
+	}
+	// Symmetric algorithms are not among the defaults
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = "test"
+	signed, err := token.SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = v.Validate(signed, "lobby", "read", now)
+	checkErr(t, err, jwt.ErrTokenSignatureInvalid)
+}
+
+func TestIsJwt(t *testing.T) {
+	key, _ := newTestKey(t)
+	signed := signToken(t, key, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()})
+	for _, c := range []struct {
+		token  string
+		target bool
+	}{
+		{signed, true},
+		// The signature is not verified
+		{signed[:len(signed)-4], true},
+		{"TOKENHERE", false},
+		{"a.b.c", false},
+		{"", false},
+	} {
+		if isJwt := IsJwt(c.token); isJwt != c.target {
+			t.Errorf("Wrong result for (%v): need (%v) got (%v)\n", c.token, c.target, isJwt)
+		}
+	}
+}
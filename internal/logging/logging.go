@@ -0,0 +1,92 @@
+package logging
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+)
+
+/*
+Configure the default logger, which the standard log package writes through as well
+*/
+func Setup(level string, format string) error {
+	parsed, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	options := &slog.HandlerOptions{Level: parsed}
+	var handler slog.Handler
+	switch format {
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("unknown log format %v", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+func ParseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %v", level)
+	}
+}
+
+/*
+Log an error and exit
+*/
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+/*
+Hash a token so it can be correlated across log lines without being usable, empty if there is no token
+*/
+func Token(token string) string {
+	if len(token) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+/*
+Replace the token in a query string with its hash, or the whole query if it cannot be parsed
+*/
+func Query(query string, key string) string {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "<redacted>"
+	}
+	for i, token := range values[key] {
+		values[key][i] = Token(token)
+	}
+	return values.Encode()
+}
+
+/*
+Replace the token in the query string of a URI with its hash
+*/
+func Uri(uri string, key string) string {
+	path, query, found := strings.Cut(uri, "?")
+	if !found {
+		return uri
+	}
+	return path + "?" + Query(query, key)
+}
@@ -0,0 +1,30 @@
+package logging
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestToken(t *testing.T) {
+	if Token("") != "" {
+		t.Errorf("Empty token should not be hashed\n")
+	}
+	hash := Token("TOKENHERE")
+	if !strings.HasPrefix(hash, "sha256:") || hash != Token("TOKENHERE") || hash == Token("OTHER") {
+		t.Errorf("Bad token hash: %v\n", hash)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	query := Query("token=TOKENHERE&_HLS_msn=49", "token")
+	if strings.Contains(query, "TOKENHERE") || !strings.Contains(query, "_HLS_msn=49") {
+		t.Errorf("Bad redacted query: %v\n", query)
+	}
+	if Query("token=TOKEN%ZZ", "token") != "<redacted>" {
+		t.Errorf("Unparseable query should be redacted entirely\n")
+	}
+	uri := Uri("/thumbnails/stream.jpg?token=TOKENHERE", "token")
+	if !strings.HasPrefix(uri, "/thumbnails/stream.jpg?token=sha256") {
+		t.Errorf("Bad redacted URI: %v\n", uri)
+	}
+}
@@ -0,0 +1,89 @@
+package mediamtx
+
+import (
+	"time"
+)
+
+/*
+Kind of authenticated connection, named by its API path
+*/
+type Kind string
+
+const (
+	RtspSession   Kind = "rtspsessions"
+	RtspsSession  Kind = "rtspssessions"
+	RtmpConn      Kind = "rtmpconns"
+	RtmpsConn     Kind = "rtmpsconns"
+	SrtConn       Kind = "srtconns"
+	WebRtcSession Kind = "webrtcsessions"
+)
+
+/*
+All kinds of authenticated connection which can be kicked
+*/
+var Kinds = []Kind{RtspSession, RtspsSession, RtmpConn, RtmpsConn, SrtConn, WebRtcSession}
+
+/*
+Protocol name of the kind used by the connect webhook
+*/
+func (k Kind) Protocol() string {
+	switch k {
+	case RtspSession:
+		return "rtspSession"
+	case RtspsSession:
+		return "rtspsSession"
+	case RtmpConn:
+		return "rtmpConn"
+	case RtmpsConn:
+		return "rtmpsConn"
+	case SrtConn:
+		return "srtConn"
+	case WebRtcSession:
+		return "webRTCSession"
+	}
+	return string(k)
+}
+
+/*
+Kinds a connection may be from its protocol name, false if unknown
+
+Empty for HLS as it is not persistent. The auth request protocol names (ex: rtsp) are accepted as well, in case the connect webhook is missed, and may match either the plain or TLS kind.
+*/
+func KindsForProtocol(protocol string) ([]Kind, bool) {
+	switch protocol {
+	case "hls", "hlsMuxer":
+		return nil, true
+	case "rtmp":
+		return []Kind{RtmpConn, RtmpsConn}, true
+	case "rtsp":
+		return []Kind{RtspSession, RtspsSession}, true
+	case "srt":
+		return []Kind{SrtConn}, true
+	case "webrtc":
+		return []Kind{WebRtcSession}, true
+	}
+	for _, kind := range Kinds {
+		if kind.Protocol() == protocol {
+			return []Kind{kind}, true
+		}
+	}
+	return nil, false
+}
+
+/*
+Fields shared by every kind of connection
+*/
+type Conn struct {
+	Id         string    `json:"id"`
+	Created    time.Time `json:"created"`
+	RemoteAddr string    `json:"remoteAddr"`
+	State      string    `json:"state"` // idle, read or publish
+	Path       string    `json:"path"`
+	Query      string    `json:"query"`
+}
+
+type connList struct {
+	PageCount int    `json:"pageCount"`
+	ItemCount int    `json:"itemCount"`
+	Items     []Conn `json:"items"`
+}
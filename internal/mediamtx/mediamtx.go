@@ -0,0 +1,219 @@
+package mediamtx
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/pseudoresonance/authserver/internal/metrics"
+)
+
+/*
+The connection does not exist on the server, as opposed to an error where its state is unknown
+*/
+var ErrNotFound = errors.New("not found on MediaMTX")
+
+const (
+	DefaultTimeout = 5 * time.Second
+	DefaultRetries = 2
+	DefaultBackoff = 250 * time.Millisecond
+)
+
+/*
+Unexpected HTTP status returned by the API
+*/
+type StatusError struct {
+	Status int
+	Body   string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("MediaMTX API returned %v: %v", e.Status, e.Body)
+}
+
+/*
+Options for the API client, with zero values replaced by the defaults
+*/
+type Options struct {
+	Timeout time.Duration // For each attempt
+	Retries int           // Attempts after the first for transport errors and server errors, negative for none
+	Backoff time.Duration // Before the first retry, doubling with each further retry
+
+	Username    string // Basic auth, if set
+	Password    string
+	BearerToken string      // Sent instead of basic auth if set
+	Tls         *tls.Config // For HTTPS, the defaults if nil
+}
+
+/*
+Client for the control API of a single MediaMTX server
+*/
+type Client struct {
+	baseUrl     string
+	http        *http.Client
+	retries     int
+	backoff     time.Duration
+	username    string
+	password    string
+	bearerToken string
+}
+
+/*
+Create a client for the API at the given base URL without a trailing slash (ex: http://localhost:9997)
+*/
+func NewClient(baseUrl string, options Options) *Client {
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultTimeout
+	}
+	if options.Retries == 0 {
+		options.Retries = DefaultRetries
+	}
+	if options.Backoff <= 0 {
+		options.Backoff = DefaultBackoff
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if options.Tls != nil {
+		transport.TLSClientConfig = options.Tls
+	}
+	return &Client{
+		baseUrl:     baseUrl,
+		http:        &http.Client{Timeout: options.Timeout, Transport: transport},
+		retries:     max(options.Retries, 0),
+		backoff:     options.Backoff,
+		username:    options.Username,
+		password:    options.Password,
+		bearerToken: options.BearerToken,
+	}
+}
+
+/*
+Load the TLS config for an API served over HTTPS, trusting the CA file instead of the system CAs and presenting the client certificate if given
+*/
+func LoadTls(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(caFile) > 0 {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", caFile)
+		}
+	}
+	if len(certFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+func (c *Client) BaseUrl() string {
+	return c.baseUrl
+}
+
+func (c *Client) Close() {
+	c.http.CloseIdleConnections()
+}
+
+/*
+Get a connection, returning ErrNotFound if it does not exist
+*/
+func (c *Client) Get(ctx context.Context, kind Kind, id string) (Conn, error) {
+	var conn Conn
+	err := c.do(ctx, "get", http.MethodGet, fmt.Sprintf("/v3/%v/get/%v", kind, url.PathEscape(id)), &conn)
+	return conn, err
+}
+
+/*
+List all connections of a kind, returning ErrNotFound if the kind is disabled on the server
+*/
+func (c *Client) List(ctx context.Context, kind Kind) ([]Conn, error) {
+	conns := []Conn{}
+	for page := 0; ; page++ {
+		var list connList
+		if err := c.do(ctx, "list", http.MethodGet, fmt.Sprintf("/v3/%v/list?page=%d", kind, page), &list); err != nil {
+			return nil, err
+		}
+		conns = append(conns, list.Items...)
+		if page+1 >= list.PageCount {
+			return conns, nil
+		}
+	}
+}
+
+/*
+Forcefully close a connection, returning ErrNotFound if it does not exist
+*/
+func (c *Client) Kick(ctx context.Context, kind Kind, id string) error {
+	return c.do(ctx, "kick", http.MethodPost, fmt.Sprintf("/v3/%v/kick/%v", kind, url.PathEscape(id)), nil)
+}
+
+/*
+Make a request, retrying transport and server errors with backoff, and decoding the JSON response into result if given
+*/
+func (c *Client) do(ctx context.Context, request string, method string, path string, result any) error {
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		err := c.attempt(ctx, request, method, path, result)
+		var status *StatusError
+		retry := err != nil && !errors.Is(err, ErrNotFound) && (!errors.As(err, &status) || status.Status >= http.StatusInternalServerError)
+		if !retry || attempt >= c.retries || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, request string, method string, path string, result any) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseUrl+path, nil)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(c.bearerToken) > 0:
+		req.Header.Set("Authorization", "Bearer "+c.bearerToken)
+	case len(c.username) > 0:
+		req.SetBasicAuth(c.username, c.password)
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		record(request, "error")
+		return err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		record(request, "not_found")
+		return ErrNotFound
+	case res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusMultipleChoices:
+		record(request, "failed")
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return &StatusError{Status: res.StatusCode, Body: string(body)}
+	}
+	record(request, "ok")
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+func record(request string, outcome string) {
+	metrics.MediaMtxRequests.WithLabelValues(request, outcome).Inc()
+}
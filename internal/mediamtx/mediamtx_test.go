@@ -0,0 +1,172 @@
+package mediamtx
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testOptions = Options{Timeout: time.Second, Retries: 2, Backoff: time.Millisecond}
+
+func TestRetry(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(Conn{Id: "a", State: "read"})
+	}))
+	defer server.Close()
+
+	conn, err := NewClient(server.URL, testOptions).Get(context.Background(), RtspSession, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.Id != "a" || attempts.Load() != 3 {
+		t.Errorf("Wrong result: need (a, 3 attempts) got (%v, %v attempts)\n", conn.Id, attempts.Load())
+	}
+
+	// Retries are exhausted with the last error returned
+	attempts.Store(0)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	var status *StatusError
+	if err := NewClient(failing.URL, testOptions).Kick(context.Background(), RtspSession, "a"); !errors.As(err, &status) || status.Status != http.StatusBadGateway {
+		t.Errorf("Wrong error: need (502) got (%v)\n", err)
+	}
+	if attempts.Load() != 3 {
+		t.Errorf("Wrong number of attempts: need (3) got (%v)\n", attempts.Load())
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		if r.URL.Path != "/v3/srtconns/kick/gone" || r.Method != http.MethodPost {
+			t.Errorf("Wrong request: %v %v\n", r.Method, r.URL.Path)
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	if err := NewClient(server.URL, testOptions).Kick(context.Background(), SrtConn, "gone"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Wrong error: need (%v) got (%v)\n", ErrNotFound, err)
+	}
+	if attempts.Load() != 1 {
+		t.Errorf("Not found retried: %v attempts\n", attempts.Load())
+	}
+
+	// A server which cannot be reached is not the same as a connection which is gone
+	server.Close()
+	if _, err := NewClient(server.URL, testOptions).Get(context.Background(), SrtConn, "gone"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Wrong error for unreachable server: %v\n", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		list := connList{PageCount: 3, Items: []Conn{{Id: r.URL.Query().Get("page")}}}
+		json.NewEncoder(w).Encode(list)
+	}))
+	defer server.Close()
+
+	conns, err := NewClient(server.URL, testOptions).List(context.Background(), WebRtcSession)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 3 || conns[0].Id != "0" || conns[2].Id != "2" {
+		t.Errorf("Wrong connections: %v\n", conns)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	// Cancelled during the backoff, long before the retries would finish
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := NewClient(server.URL, Options{Retries: 5, Backoff: time.Second}).Get(ctx, RtmpConn, "a")
+	if err == nil {
+		t.Fatalf("Request succeeded\n")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Cancellation not respected: took %v\n", elapsed)
+	}
+
+	if _, err := NewClient(server.URL, testOptions).Get(ctx, RtmpConn, "a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wrong error for expired context: %v\n", err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	headers := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	for options, target := range map[Options]string{
+		{Username: "user", Password: "pass"}:                       "Basic dXNlcjpwYXNz",
+		{BearerToken: "token"}:                                     "Bearer token",
+		{Username: "user", Password: "pass", BearerToken: "token"}: "Bearer token",
+		{}: "", // Unauthenticated
+	} {
+		if err := NewClient(server.URL, options).Kick(context.Background(), RtspSession, "a"); err != nil {
+			t.Fatal(err)
+		}
+		if header := <-headers; header != target {
+			t.Errorf("Wrong authorization: need (%v) got (%v)\n", target, header)
+		}
+	}
+}
+
+func TestTls(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// Not trusted by the system CAs
+	if err := NewClient(server.URL, testOptions).Kick(context.Background(), RtspSession, "a"); err == nil {
+		t.Errorf("Untrusted certificate accepted\n")
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := LoadTls(caFile, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewClient(server.URL, Options{Tls: conf}).Kick(context.Background(), RtspSession, "a"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKindsForProtocol(t *testing.T) {
+	for protocol, target := range map[string]int{"rtsp": 2, "rtspsSession": 1, "webRTCSession": 1, "srt": 1, "hlsMuxer": 0} {
+		kinds, ok := KindsForProtocol(protocol)
+		if !ok || len(kinds) != target {
+			t.Errorf("Wrong kinds for %v: need (%v) got (%v)\n", protocol, target, kinds)
+		}
+	}
+	if _, ok := KindsForProtocol("unknown"); ok {
+		t.Errorf("Unknown protocol accepted\n")
+	}
+}
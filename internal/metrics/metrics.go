@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "mediamtxauth"
+
+/*
+Registry holding all metrics of the auth server, served on /metrics
+*/
+var Registry = prometheus.NewRegistry()
+
+var (
+	AuthDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_decisions_total",
+		Help:      "Auth requests answered, by action, protocol, result (allow or deny) and the reason for the result.",
+	}, []string{"action", "protocol", "result", "reason"})
+
+	MediaMtxRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mediamtx_requests_total",
+		Help:      "Requests made to the MediaMTX API, by request (get, list or kick) and outcome (ok, not_found, failed or error), counting each attempt.",
+	}, []string{"request", "outcome"})
+
+	AuditDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audit_dropped_total",
+		Help:      "Audit entries dropped as the queue was full or the database write failed.",
+	})
+
+	QueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "postgres_query_duration_seconds",
+		Help:      "Duration of PostgreSQL queries, by result (ok or error).",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		AuthDecisions,
+		MediaMtxRequests,
+		AuditDropped,
+		QueryDuration,
+	)
+}
+
+/*
+Serve all registered metrics in the Prometheus text format
+*/
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+/*
+Label value for a MediaMTX protocol, limited to known protocols to bound the number of series
+*/
+func Protocol(protocol string) string {
+	switch protocol {
+	case "":
+		return "none"
+	case "rtsp", "rtsps", "rtmp", "rtmps", "hls", "webrtc", "srt":
+		return protocol
+	default:
+		return "other"
+	}
+}
+
+/*
+Label value for a MediaMTX action, limited to known actions to bound the number of series
+*/
+func Action(action string) string {
+	switch action {
+	case "read", "publish", "playback", "api", "metrics", "pprof":
+		return action
+	default:
+		return "other"
+	}
+}
+
+/*
+Namespaced metric name, for collectors which build metrics at scrape time
+*/
+func Name(subsystem string, name string) string {
+	return prometheus.BuildFQName(namespace, subsystem, name)
+}
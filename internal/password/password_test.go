@@ -0,0 +1,39 @@
+package password
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestArgon2id(t *testing.T) {
+	hash, err := Hash("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := Verify(hash, "hunter2"); !ok || err != nil {
+		t.Errorf("Correct password rejected (%v)\n", err)
+	}
+	if ok, err := Verify(hash, "hunter3"); ok || err != nil {
+		t.Errorf("Wrong password accepted (%v)\n", err)
+	}
+}
+
+func TestBcrypt(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := Verify(string(hash), "hunter2"); !ok || err != nil {
+		t.Errorf("Correct password rejected (%v)\n", err)
+	}
+	if ok, err := Verify(string(hash), "hunter3"); ok || err != nil {
+		t.Errorf("Wrong password accepted (%v)\n", err)
+	}
+}
+
+func TestUnknownHash(t *testing.T) {
+	if ok, err := Verify("hunter2", "hunter2"); ok || err != ErrUnknownHash {
+		t.Errorf("Plaintext password accepted (%v)\n", err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+	"github.com/pseudoresonance/authserver/internal/database"
+)
+
+type ApiHandler struct {
+	Keys     []config.ApiKey
+	Database *database.DatabaseManager
+
+	mux *http.ServeMux
+}
+
+func (a *ApiHandler) Init() {
+	a.mux = http.NewServeMux()
+	a.mux.HandleFunc("POST /api/v1/tokens", a.createToken)
+	a.mux.HandleFunc("GET /api/v1/tokens", a.listTokens)
+	a.mux.HandleFunc("GET /api/v1/tokens/{id}", a.getToken)
+	a.mux.HandleFunc("PATCH /api/v1/tokens/{id}", a.updateToken)
+	a.mux.HandleFunc("DELETE /api/v1/tokens/{id}", a.revokeToken)
+	a.mux.HandleFunc("POST /api/v1/tokens/{id}/revoke", a.revokeToken)
+	a.mux.HandleFunc("GET /api/v1/audit", a.searchAudit)
+	a.mux.HandleFunc("GET /api/v1/streams", a.listStreams)
+}
+
+func (a ApiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, ok := a.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "invalid API key")
+		return
+	}
+	if r.Method != http.MethodGet {
+		slog.Info("API request", "method", r.Method, "path", r.URL.Path, "key", name)
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+/*
+Check the request has a valid API key, returning the key's name
+*/
+func (a ApiHandler) authenticate(r *http.Request) (string, bool) {
+	key, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || len(key) == 0 {
+		return "", false
+	}
+	for _, k := range a.Keys {
+		if len(k.Key) > 0 && subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1 {
+			return k.Name, true
+		}
+	}
+	return "", false
+}
+
+type errorResponseBody struct {
+	Error string `json:"error"`
+}
+
+func writeJson(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Error("Error while writing response", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJson(w, status, errorResponseBody{Error: message})
+}
+
+/*
+Decode a JSON request body, rejecting unknown fields
+*/
+func readJson(r *http.Request, body any) error {
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+	return d.Decode(body)
+}
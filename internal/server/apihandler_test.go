@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+	"github.com/pseudoresonance/authserver/internal/database"
+)
+
+func TestApiNoKey(t *testing.T) {
+	apiHandler := ApiHandler{Keys: []config.ApiKey{{Name: "test", Key: "secret"}}}
+	apiHandler.Init()
+	req, err := http.NewRequest("GET", "/api/v1/tokens", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	apiHandler.ServeHTTP(rr, req)
+	checkStatus(t, rr.Code, http.StatusUnauthorized)
+}
+
+func TestApiWrongKey(t *testing.T) {
+	apiHandler := ApiHandler{Keys: []config.ApiKey{{Name: "test", Key: "secret"}}}
+	apiHandler.Init()
+	req, err := http.NewRequest("GET", "/api/v1/tokens", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer wrong")
+	rr := httptest.NewRecorder()
+	apiHandler.ServeHTTP(rr, req)
+	checkStatus(t, rr.Code, http.StatusUnauthorized)
+}
+
+func TestApiBadRequest(t *testing.T) {
+	apiHandler := ApiHandler{Keys: []config.ApiKey{{Name: "test", Key: "secret"}}}
+	apiHandler.Init()
+	req, err := http.NewRequest("GET", "/api/v1/tokens/abc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	rr := httptest.NewRecorder()
+	apiHandler.ServeHTTP(rr, req)
+	checkStatus(t, rr.Code, http.StatusBadRequest)
+}
+
+func TestApiUpdateToken(t *testing.T) {
+	validFrom := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	expiresAt := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		id     string
+		body   string
+		status int
+	}{
+		// Checked against the stored end of the validity window which is not changed
+		{"1", `{"expiresAt": "2025-12-01T00:00:00Z"}`, http.StatusBadRequest},
+		{"1", `{"validFrom": "2026-07-01T00:00:00Z"}`, http.StatusBadRequest},
+		{"1", `{"validFrom": "2026-07-01T00:00:00Z", "expiresAt": "2026-08-01T00:00:00Z"}`, http.StatusOK},
+		{"1", `{"validFrom": "2026-07-01T00:00:00Z", "expiresAt": null}`, http.StatusOK},
+		{"1", `{"expiresAt": "2026-02-01T00:00:00Z"}`, http.StatusOK},
+		{"1", `{"maxUses": 0}`, http.StatusBadRequest},
+		{"1", `{"maxConnections": 2}`, http.StatusOK},
+		{"2", `{"maxConnections": 2}`, http.StatusNotFound},
+	} {
+		apiHandler := ApiHandler{Keys: []config.ApiKey{{Name: "test", Key: "secret"}},
+			Database: newTestDatabase(t, database.Token{Path: "stream", Action: "read", QueryToken: "a", ValidFrom: &validFrom, ExpiresAt: &expiresAt})}
+		apiHandler.Init()
+		req, err := http.NewRequest("PATCH", "/api/v1/tokens/"+c.id, strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		apiHandler.ServeHTTP(rr, req)
+		checkStatus(t, rr.Code, c.status)
+
+		// Rejected updates leave the stored credentials alone
+		if token, err := apiHandler.Database.GetToken(context.Background(), 1); c.status == http.StatusBadRequest && (err != nil || !token.ExpiresAt.Equal(expiresAt) || !token.ValidFrom.Equal(validFrom)) {
+			t.Errorf("Wrong token after (%v): %+v (%v)\n", c.body, token, err)
+		}
+	}
+}
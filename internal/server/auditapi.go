@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pseudoresonance/authserver/internal/database"
+	"github.com/pseudoresonance/authserver/internal/logging"
+)
+
+type searchAuditResponseBody struct {
+	Entries []database.AuditEntry `json:"entries"`
+	Next    *int64                `json:"next,omitempty"` // Pass as before to get the next page
+}
+
+func (a ApiHandler) searchAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := auditFilter(query.Get("token"), query.Get("path"), query.Get("ip"), query.Get("from"), query.Get("to"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter.Limit = defaultPageSize
+	if before := query.Get("before"); len(before) > 0 {
+		if filter.Before, err = strconv.ParseInt(before, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid before")
+			return
+		}
+	}
+	if limit := query.Get("limit"); len(limit) > 0 {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit <= 0 || filter.Limit > maxPageSize {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %v", maxPageSize))
+			return
+		}
+	}
+
+	entries, err := a.Database.SearchAudit(r.Context(), filter)
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	response := searchAuditResponseBody{Entries: entries}
+	if len(entries) == filter.Limit {
+		response.Next = &entries[len(entries)-1].Id
+	}
+	writeJson(w, http.StatusOK, response)
+}
+
+/*
+Build an audit search filter, hashing the token unless given as a hash from the logs
+*/
+func auditFilter(token string, path string, ip string, from string, to string) (database.AuditFilter, error) {
+	filter := database.AuditFilter{Token: token, Path: path, Ip: ip}
+	if len(token) > 0 && !strings.HasPrefix(token, "sha256:") {
+		filter.Token = logging.Token(token)
+	}
+	if len(ip) > 0 {
+		if _, err := netip.ParseAddr(ip); err != nil {
+			return filter, fmt.Errorf("invalid ip %v", ip)
+		}
+		filter.Ip = database.NormalizeIp(ip)
+	}
+	for _, t := range []struct {
+		name  string
+		text  string
+		value **time.Time
+	}{{"from", from, &filter.From}, {"to", to, &filter.To}} {
+		if len(t.text) == 0 {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, t.text)
+		if err != nil {
+			return filter, fmt.Errorf("invalid %v %v", t.name, t.text)
+		}
+		*t.value = &parsed
+	}
+	return filter, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pseudoresonance/authserver/internal/database"
+	"github.com/pseudoresonance/authserver/internal/logging"
+)
+
+const auditUsage = `Usage: audit <command> [flags]
+
+Commands:
+  search    Search recorded auth decisions, newest first
+  prune     Delete recorded auth decisions older than a number of days
+`
+
+/*
+Search and prune the auth decision audit log from the command line
+*/
+func auditCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, auditUsage)
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "search":
+		auditSearchCommand(args[1:])
+	case "prune":
+		auditPruneCommand(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown audit command %v\n\n%v", args[0], auditUsage)
+		os.Exit(2)
+	}
+}
+
+func auditSearchCommand(args []string) {
+	flags := flag.NewFlagSet("audit search", flag.ExitOnError)
+	configPath := flags.String("c", "config.yaml", "path to YAML config file or directory")
+	jsonOutput := flags.Bool("json", false, "print JSON instead of a table")
+	token := flags.String("token", "", "only decisions for this query token, or its sha256: hash from the logs")
+	path := flags.String("path", "", "only decisions for this path")
+	ip := flags.String("ip", "", "only decisions for this client IP")
+	from := flags.String("from", "", "only decisions at or after this RFC 3339 time")
+	to := flags.String("to", "", "only decisions before this RFC 3339 time")
+	limit := flags.Int("limit", defaultPageSize, "maximum number of decisions to list, all if 0")
+	flags.Parse(args)
+
+	filter, err := auditFilter(*token, *path, *ip, *from, *to)
+	if err == nil && *limit < 0 {
+		err = errors.New("limit must not be negative")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	db := openDatabase(loadConfig(*configPath))
+	defer db.Close()
+	entries := []database.AuditEntry{}
+	for *limit == 0 || len(entries) < *limit {
+		filter.Limit = maxPageSize
+		if *limit > 0 {
+			filter.Limit = min(maxPageSize, *limit-len(entries))
+		}
+		page, err := db.SearchAudit(context.Background(), filter)
+		if err != nil {
+			logging.Fatal("Error while searching audit log", "err", err)
+		}
+		entries = append(entries, page...)
+		if len(page) < filter.Limit {
+			break
+		}
+		filter.Before = page[len(page)-1].Id
+	}
+
+	if *jsonOutput {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		e.Encode(entries)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tRESULT\tREASON\tACTION\tPATH\tPROTOCOL\tIP\tUSER\tTOKEN\tCONNECTION")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", formatTime(&e.Time), e.Result, e.Reason, e.Action, e.Path,
+			formatString(e.Protocol), formatString(e.Ip), formatString(e.User), formatString(e.Token), formatString(e.ConnectionId))
+	}
+	w.Flush()
+}
+
+func auditPruneCommand(args []string) {
+	flags := flag.NewFlagSet("audit prune", flag.ExitOnError)
+	configPath := flags.String("c", "config.yaml", "path to YAML config file or directory")
+	days := flags.Int("days", 0, "delete decisions older than this many days, audit.retentionDays if 0")
+	flags.Parse(args)
+	if *days < 0 {
+		fmt.Fprintln(os.Stderr, "days must not be negative")
+		os.Exit(2)
+	}
+
+	conf := loadConfig(*configPath)
+	if *days == 0 {
+		*days = conf.Audit.RetentionDays
+	}
+	if *days == 0 {
+		fmt.Fprintln(os.Stderr, "No retention period configured, pass -days")
+		os.Exit(2)
+	}
+	db := openDatabase(conf)
+	defer db.Close()
+	deleted, err := db.PruneAudit(context.Background(), time.Now().AddDate(0, 0, -*days))
+	if err != nil {
+		logging.Fatal("Error while pruning audit log", "err", err)
+	}
+	fmt.Printf("Deleted %v audit entries\n", deleted)
+}
+
+func formatString(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
@@ -1,19 +1,26 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
-	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"slices"
+	"time"
 
+	"github.com/pseudoresonance/authserver/internal/config"
 	"github.com/pseudoresonance/authserver/internal/database"
+	"github.com/pseudoresonance/authserver/internal/jwtauth"
+	"github.com/pseudoresonance/authserver/internal/logging"
+	"github.com/pseudoresonance/authserver/internal/metrics"
+	"github.com/pseudoresonance/authserver/internal/signing"
 )
 
 const (
 	actionFilterQuery = "allowed"
+	instanceQuery     = "instance"
 )
 
 type AuthHandler struct {
@@ -24,7 +31,15 @@ type AuthHandler struct {
 	MonitoringIps    []string
 	NetMonitoringIps []net.IPNet
 
+	// MediaMTX servers which may identify themselves in the auth URL
+	Instances []config.MediaMtxInstance
+	instances map[string]config.MediaMtxInstance
+	// Identity this server calls the MediaMTX API with
+	Service config.ServiceIdentityConfig
+
 	QueryTokenKey string
+	Signer        *signing.Signer
+	Jwt           *jwtauth.Validator
 	Database      *database.DatabaseManager
 }
 
@@ -34,7 +49,7 @@ func (a *AuthHandler) Init() {
 	for i, entry := range a.PrivateIps {
 		_, cidr, err := net.ParseCIDR(entry)
 		if err != nil {
-			log.Fatalf("Invalid CIDR %v\n", entry)
+			logging.Fatal("Invalid CIDR", "cidr", entry)
 		}
 		a.NetPrivateIps[i] = *cidr
 	}
@@ -43,7 +58,7 @@ func (a *AuthHandler) Init() {
 	for i, entry := range a.ApiIps {
 		_, cidr, err := net.ParseCIDR(entry)
 		if err != nil {
-			log.Fatalf("Invalid CIDR %v\n", entry)
+			logging.Fatal("Invalid CIDR", "cidr", entry)
 		}
 		a.NetApiIps[i] = *cidr
 	}
@@ -52,16 +67,21 @@ func (a *AuthHandler) Init() {
 	for i, entry := range a.MonitoringIps {
 		_, cidr, err := net.ParseCIDR(entry)
 		if err != nil {
-			log.Fatalf("Invalid CIDR %v\n", entry)
+			logging.Fatal("Invalid CIDR", "cidr", entry)
 		}
 		a.NetMonitoringIps[i] = *cidr
 	}
+
+	a.instances = make(map[string]config.MediaMtxInstance, len(a.Instances))
+	for _, instance := range a.Instances {
+		a.instances[instance.Name] = instance
+	}
 }
 
 type authRequestBody struct {
-	User     *string `json:"user,omitempty"`     // Ignored
-	Password *string `json:"password,omitempty"` // Ignored
-	Token    *string `json:"token,omitempty"`    // Ignored
+	User     *string `json:"user,omitempty"`
+	Password *string `json:"password,omitempty"`
+	Token    *string `json:"token,omitempty"` // Bearer JWT
 	Ip       *string `json:"ip,omitempty"`
 	Action   *string `json:"action,omitempty"`
 	Path     *string `json:"path,omitempty"`
@@ -83,12 +103,21 @@ func (a AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			switch v {
 			case "read", "publish", "playback":
 			default:
-				log.Printf("Invalid action filter type: %v\n", v)
+				slog.Warn("Invalid action filter type", "action", v)
 				continue
 			}
 			actionFilter = append(actionFilter, v)
 		}
 	}
+	var instance *config.MediaMtxInstance
+	if name := r.URL.Query().Get(instanceQuery); len(name) > 0 {
+		if configured, ok := a.instances[name]; ok {
+			instance = &configured
+		} else {
+			// Connections are still tracked, but kicked from the server routed to by action
+			slog.Warn("Unknown MediaMTX instance in auth URL", "instance", name)
+		}
+	}
 
 	// Decode
 	request := authRequestBody{}
@@ -96,12 +125,12 @@ func (a AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	d.DisallowUnknownFields()
 	err := d.Decode(&request)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		a.respond(w, &request, http.StatusBadRequest, "bad_request")
 		return
 	}
 
 	if request.Ip == nil || request.Action == nil {
-		w.WriteHeader(http.StatusBadRequest)
+		a.respond(w, &request, http.StatusBadRequest, "bad_request")
 		return
 	}
 	ip := net.ParseIP(*request.Ip)
@@ -109,71 +138,183 @@ func (a AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Special logic for API access
 	switch *request.Action {
 	case "api":
-		if listContainsIp(a.NetApiIps, ip) {
-			w.WriteHeader(http.StatusOK)
+		if a.isService(&request, instance) {
+			a.respond(w, &request, http.StatusOK, "service_identity")
+		} else if listContainsIp(a.NetApiIps, ip) {
+			a.respond(w, &request, http.StatusOK, "api_ip")
 		} else {
-			w.WriteHeader(http.StatusForbidden)
+			a.respond(w, &request, http.StatusForbidden, "api_ip")
 		}
 		return
 	case "metrics", "pprof":
 		if listContainsIp(a.NetMonitoringIps, ip) {
-			w.WriteHeader(http.StatusOK)
+			a.respond(w, &request, http.StatusOK, "monitoring_ip")
 		} else {
-			w.WriteHeader(http.StatusForbidden)
+			a.respond(w, &request, http.StatusForbidden, "monitoring_ip")
 		}
 		return
 	}
 
 	// Other access from private networks is accepted - generally for container networks
 	if listContainsIp(a.NetPrivateIps, ip) {
-		w.WriteHeader(http.StatusOK)
+		a.respond(w, &request, http.StatusOK, "private_ip")
 		return
 	}
 
 	// Validate allowed actions
 	if len(actionFilter) > 0 && !slices.Contains(actionFilter, *request.Action) {
-		w.WriteHeader(http.StatusForbidden)
+		a.respond(w, &request, http.StatusForbidden, "action_filter")
 		return
 	}
-
-	// Other access
-	if request.Query == nil || len(*request.Query) == 0 {
-		w.WriteHeader(http.StatusForbidden)
+	if instance != nil && !instance.HasRole(*request.Action) {
+		a.respond(w, &request, http.StatusForbidden, "instance_role")
 		return
 	}
+
+	// Other access
 	if request.Path == nil || len(*request.Path) == 0 {
-		w.WriteHeader(http.StatusForbidden)
+		a.respond(w, &request, http.StatusForbidden, "no_path")
 		return
 	}
 
-	queryUrl, err := url.Parse(fmt.Sprintf("?%v", *request.Query))
-	if err != nil {
-		log.Printf("Error parsing query string: (%v)\n%v\n", *request.Query, err)
-	}
-	queryParsed, err := url.ParseQuery(queryUrl.RawQuery)
-	if err != nil {
-		log.Printf("Error parsing query string: (%v)\n%v\n", *request.Query, err)
+	// Bearer JWTs are verified against the configured keys without the database
+	if request.Token != nil && len(*request.Token) > 0 && a.Jwt.Enabled() {
+		if _, err := a.Jwt.Validate(*request.Token, *request.Path, *request.Action, time.Now()); err == nil {
+			a.respond(w, &request, http.StatusOK, "jwt")
+			return
+		}
 	}
-	token := queryParsed.Get(a.QueryTokenKey)
 
-	var conn *database.Connection
+	client := database.Client{Ip: ip}
+	if instance != nil {
+		client.Instance = instance.Name
+	}
 	if request.Protocol != nil && request.Id != nil {
-		conn = &database.Connection{Id: *request.Id, Protocol: *request.Protocol}
+		client.Connection = &database.Connection{Id: *request.Id, Protocol: *request.Protocol}
 	}
-	res, err := a.Database.ValidateAuth(&database.Credentials{
-		Action:     *request.Action,
-		Path:       *request.Path,
-		QueryToken: token,
-	}, conn)
-	if err != nil {
-		log.Printf("Error while validating auth\n%v\n", err)
+
+	// Query token
+	if request.Query != nil && len(*request.Query) > 0 {
+		token := a.queryToken(*request.Query)
+
+		// Signed tokens are verified without the database
+		if a.Signer.Enabled() && a.Signer.Verify(token, *request.Path, *request.Action, ip, time.Now()) == nil {
+			a.respond(w, &request, http.StatusOK, "signed")
+			return
+		}
+
+		res, err := a.Database.ValidateAuth(&database.Credentials{
+			Action:     *request.Action,
+			Path:       *request.Path,
+			QueryToken: token,
+		}, client)
+		if err != nil {
+			slog.Error("Error while validating auth", "err", err)
+		}
+		if res {
+			a.respond(w, &request, http.StatusOK, "token")
+			return
+		}
 	}
-	if res {
-		w.WriteHeader(http.StatusOK)
-		return
+
+	// Username/password for clients which cannot pass a query string
+	if request.User != nil && len(*request.User) > 0 && request.Password != nil {
+		res, err := a.Database.ValidateUser(*request.User, *request.Password, *request.Path, *request.Action, client)
+		if err != nil {
+			slog.Error("Error while validating user", "user", *request.User, "err", err)
+		}
+		if res {
+			a.respond(w, &request, http.StatusOK, "user")
+			return
+		}
+	}
+
+	a.respond(w, &request, http.StatusForbidden, "invalid_credentials")
+}
+
+/*
+Answer an auth request, logging, auditing and recording the decision
+*/
+func (a AuthHandler) respond(w http.ResponseWriter, request *authRequestBody, status int, reason string) {
+	result := "allow"
+	if status != http.StatusOK {
+		result = "deny"
+	}
+	value := func(field *string) string {
+		if field == nil {
+			return ""
+		}
+		return *field
+	}
+	entry := database.AuditEntry{Action: value(request.Action), Path: value(request.Path), Protocol: value(request.Protocol), Ip: value(request.Ip),
+		ConnectionId: value(request.Id), User: value(request.User), Result: result, Reason: reason}
+	if request.Query != nil {
+		entry.Token = logging.Token(a.queryToken(*request.Query))
+	}
+	slog.Info("Auth decision", "action", entry.Action, "path", entry.Path, "protocol", entry.Protocol, "ip", entry.Ip, "id", entry.ConnectionId,
+		"user", entry.User, "token", entry.Token, "result", result, "reason", reason)
+	a.Database.Audit(entry)
+	metrics.AuthDecisions.WithLabelValues(metrics.Action(value(request.Action)), metrics.Protocol(value(request.Protocol)), result, reason).Inc()
+	w.WriteHeader(status)
+}
+
+/*
+Check if a request carries the service identity used for calls to the MediaMTX API, or the API credentials of the
+instance which made it
+*/
+func (a AuthHandler) isService(request *authRequestBody, instance *config.MediaMtxInstance) bool {
+	if carriesIdentity(request, a.Service.Username, a.Service.Password, a.Service.Token) {
+		return true
+	}
+	return instance != nil && carriesIdentity(request, instance.Username, instance.Password, instance.BearerToken)
+}
+
+/*
+Check if a request carries a bearer token or username and password, ignoring whichever is not set
+*/
+func carriesIdentity(request *authRequestBody, username string, password string, token string) bool {
+	if len(token) > 0 && request.Token != nil && subtle.ConstantTimeCompare([]byte(token), []byte(*request.Token)) == 1 {
+		return true
 	}
+	return len(password) > 0 && request.User != nil && request.Password != nil && *request.User == username &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(*request.Password)) == 1
+}
+
+/*
+Extract the token from a MediaMTX query string
+*/
+func (a AuthHandler) queryToken(query string) string {
+	queryParsed, err := url.ParseQuery(query)
+	if err != nil {
+		slog.Warn("Error parsing query string", "query", logging.Query(query, a.QueryTokenKey), "err", err)
+	}
+	return queryParsed.Get(a.QueryTokenKey)
+}
 
-	w.WriteHeader(http.StatusForbidden)
+/*
+Check if a live connection is accepted without stored credentials, so reconciliation leaves it alone
+
+Users are not checked here, as their connections are tracked by their saved sessions.
+*/
+func (a AuthHandler) acceptsLive(conn database.LiveConnection) bool {
+	if listContainsIp(a.NetPrivateIps, conn.Ip) {
+		return true
+	}
+	token := a.queryToken(conn.Query)
+	if a.Signer.Enabled() && len(token) > 0 && a.Signer.Verify(token, conn.Path, conn.Action, conn.Ip, time.Now()) == nil {
+		return true
+	}
+	// MediaMTX also reads JWTs from the jwt query parameter
+	if a.Jwt.Enabled() {
+		values, _ := url.ParseQuery(conn.Query)
+		if jwt := values.Get("jwt"); len(jwt) > 0 {
+			if _, err := a.Jwt.Validate(jwt, conn.Path, conn.Action, time.Now()); err == nil {
+				return true
+			}
+		}
+	}
+	// Query tokens which are JWTs (ex: repeating a bearer token) are never stored credentials, so cannot be checked against them
+	return jwtauth.IsJwt(token)
 }
 
 func listContainsIp(list []net.IPNet, ip net.IP) bool {
@@ -2,10 +2,26 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pseudoresonance/authserver/internal/config"
+	"github.com/pseudoresonance/authserver/internal/database"
+	"github.com/pseudoresonance/authserver/internal/jwtauth"
+	"github.com/pseudoresonance/authserver/internal/logging"
+	"github.com/pseudoresonance/authserver/internal/signing"
 )
 
 func strPtr[T ~string](s T) *T {
@@ -71,28 +87,305 @@ func TestPrivateIp(t *testing.T) {
 	checkStatus(t, rr.Code, http.StatusOK)
 }
 
-//TODO mock database
-// func TestQueryParams(t *testing.T) {
-// 	authHandler := AuthHandler{PrivateIps: []string{}, QueryTokenKey: "token"}
-// 	authHandler.Init()
-// 	body := authRequestBody{
-// 		User:     strPtr(""),
-// 		Password: strPtr(""),
-// 		Ip:       strPtr("127.0.0.1"),
-// 		Query:    strPtr("token=TOKENHERE\u0026_HLS_msn=49\u0026_HLS_part=4\u0026_HLS_skip=YES"),
-// 		Action:   strPtr("read"),
-// 		Path:     strPtr("streamid"),
-// 	}
-// 	buf := bytes.Buffer{}
-// 	err := json.NewEncoder(&buf).Encode(body)
-// 	if err != nil {
-// 		t.Fatal(err)
-// 	}
-// 	req, err := http.NewRequest("POST", "/auth", &buf)
-// 	if err != nil {
-// 		t.Fatal(err)
-// 	}
-// 	rr := httptest.NewRecorder()
-// 	authHandler.ServeHTTP(rr, req)
-// 	checkStatus(t, rr.Code, http.StatusOK)
-// }
+func TestSignedToken(t *testing.T) {
+	signer, err := signing.NewSigner(config.SigningConfig{Keys: []config.SigningKey{{Id: "test", Secret: "secret"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := signer.Sign(signing.Claims{Path: "streamid", Action: "read", Expires: time.Now().Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authHandler := AuthHandler{PrivateIps: []string{}, QueryTokenKey: "token", Signer: signer}
+	authHandler.Init()
+	body := authRequestBody{
+		User:     strPtr(""),
+		Password: strPtr(""),
+		Ip:       strPtr("203.0.113.5"),
+		Query:    strPtr("token=" + token),
+		Action:   strPtr("read"),
+		Path:     strPtr("streamid"),
+	}
+	buf := bytes.Buffer{}
+	err = json.NewEncoder(&buf).Encode(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "/auth", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	authHandler.ServeHTTP(rr, req)
+	checkStatus(t, rr.Code, http.StatusOK)
+}
+
+func newTestDatabase(t *testing.T, tokens ...database.Token) *database.DatabaseManager {
+	store := database.NewMemoryStore()
+	for _, token := range tokens {
+		if _, err := store.CreateToken(context.Background(), token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf := config.NewMainConfig()
+	db := &database.DatabaseManager{}
+	db.InitWithStore(&conf, store)
+	t.Cleanup(db.Close)
+	return db
+}
+
+func TestQueryParams(t *testing.T) {
+	authHandler := AuthHandler{PrivateIps: []string{}, QueryTokenKey: "token",
+		Database: newTestDatabase(t, database.Token{Path: "streamid", Action: "read", QueryToken: "TOKENHERE"})}
+	authHandler.Init()
+	body := authRequestBody{
+		User:     strPtr(""),
+		Password: strPtr(""),
+		Ip:       strPtr("127.0.0.1"),
+		Query:    strPtr("token=TOKENHERE\u0026_HLS_msn=49\u0026_HLS_part=4\u0026_HLS_skip=YES"),
+		Action:   strPtr("read"),
+		Path:     strPtr("streamid"),
+	}
+	buf := bytes.Buffer{}
+	err := json.NewEncoder(&buf).Encode(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "/auth", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	authHandler.ServeHTTP(rr, req)
+	checkStatus(t, rr.Code, http.StatusOK)
+}
+
+func TestWrongToken(t *testing.T) {
+	authHandler := AuthHandler{PrivateIps: []string{}, QueryTokenKey: "token",
+		Database: newTestDatabase(t, database.Token{Path: "streamid", Action: "read", QueryToken: "TOKENHERE"})}
+	authHandler.Init()
+	for _, body := range []authRequestBody{
+		{Ip: strPtr("203.0.113.5"), Query: strPtr("token=WRONG"), Action: strPtr("read"), Path: strPtr("streamid")},
+		{Ip: strPtr("203.0.113.5"), Query: strPtr("token=TOKENHERE"), Action: strPtr("publish"), Path: strPtr("streamid")},
+		{Ip: strPtr("203.0.113.5"), Query: strPtr("token=TOKENHERE"), Action: strPtr("read"), Path: strPtr("other")},
+	} {
+		buf := bytes.Buffer{}
+		err := json.NewEncoder(&buf).Encode(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "/auth", &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		authHandler.ServeHTTP(rr, req)
+		checkStatus(t, rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestInstanceRole(t *testing.T) {
+	authHandler := AuthHandler{PrivateIps: []string{}, QueryTokenKey: "token", Instances: []config.MediaMtxInstance{{Name: "ingest", Roles: []string{"publish"}}},
+		Database: newTestDatabase(t, database.Token{Path: "streamid", Action: "read", QueryToken: "TOKENHERE"})}
+	authHandler.Init()
+	// Unknown instances are only logged, as the connection can still be routed by its action
+	for url, target := range map[string]int{"/auth?instance=ingest": http.StatusForbidden, "/auth?instance=unknown": http.StatusOK, "/auth": http.StatusOK} {
+		body := authRequestBody{Ip: strPtr("203.0.113.5"), Query: strPtr("token=TOKENHERE"), Action: strPtr("read"), Path: strPtr("streamid")}
+		buf := bytes.Buffer{}
+		err := json.NewEncoder(&buf).Encode(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", url, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		authHandler.ServeHTTP(rr, req)
+		checkStatus(t, rr.Code, target)
+	}
+}
+
+func TestServiceIdentity(t *testing.T) {
+	authHandler := AuthHandler{PrivateIps: []string{}, ApiIps: []string{"127.0.0.0/8"}, QueryTokenKey: "token",
+		Service: config.ServiceIdentityConfig{Username: "mediamtxauth", Password: "secret", Token: "servicetoken"}, Database: newTestDatabase(t)}
+	authHandler.Init()
+	for _, c := range []struct {
+		body   authRequestBody
+		target int
+	}{
+		{authRequestBody{Ip: strPtr("203.0.113.5"), Action: strPtr("api"), User: strPtr("mediamtxauth"), Password: strPtr("secret")}, http.StatusOK},
+		{authRequestBody{Ip: strPtr("203.0.113.5"), Action: strPtr("api"), Token: strPtr("servicetoken")}, http.StatusOK},
+		{authRequestBody{Ip: strPtr("203.0.113.5"), Action: strPtr("api"), User: strPtr("mediamtxauth"), Password: strPtr("wrong")}, http.StatusForbidden},
+		{authRequestBody{Ip: strPtr("203.0.113.5"), Action: strPtr("api"), User: strPtr("other"), Password: strPtr("secret")}, http.StatusForbidden},
+		// Only for the API
+		{authRequestBody{Ip: strPtr("203.0.113.5"), Action: strPtr("read"), Path: strPtr("streamid"), User: strPtr("mediamtxauth"), Password: strPtr("secret")}, http.StatusForbidden},
+		// IP ranges still apply without the identity
+		{authRequestBody{Ip: strPtr("127.0.0.1"), Action: strPtr("api")}, http.StatusOK},
+	} {
+		buf := bytes.Buffer{}
+		err := json.NewEncoder(&buf).Encode(c.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "/auth", &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		authHandler.ServeHTTP(rr, req)
+		checkStatus(t, rr.Code, c.target)
+	}
+}
+
+func TestInstanceIdentity(t *testing.T) {
+	authHandler := AuthHandler{PrivateIps: []string{}, QueryTokenKey: "token", Database: newTestDatabase(t),
+		Instances: []config.MediaMtxInstance{
+			{Name: "edge1", Username: "edge", Password: "edgesecret"},
+			{Name: "edge2", BearerToken: "edgetoken"},
+		}}
+	authHandler.Init()
+	for _, c := range []struct {
+		url    string
+		body   authRequestBody
+		target int
+	}{
+		{"/auth?instance=edge1", authRequestBody{Ip: strPtr("203.0.113.5"), Action: strPtr("api"), User: strPtr("edge"), Password: strPtr("edgesecret")}, http.StatusOK},
+		{"/auth?instance=edge2", authRequestBody{Ip: strPtr("203.0.113.5"), Action: strPtr("api"), Token: strPtr("edgetoken")}, http.StatusOK},
+		{"/auth?instance=edge1", authRequestBody{Ip: strPtr("203.0.113.5"), Action: strPtr("api"), User: strPtr("edge"), Password: strPtr("wrong")}, http.StatusForbidden},
+		// Only the credentials of the instance which made the request
+		{"/auth?instance=edge2", authRequestBody{Ip: strPtr("203.0.113.5"), Action: strPtr("api"), User: strPtr("edge"), Password: strPtr("edgesecret")}, http.StatusForbidden},
+		{"/auth", authRequestBody{Ip: strPtr("203.0.113.5"), Action: strPtr("api"), Token: strPtr("edgetoken")}, http.StatusForbidden},
+		// Only for the API
+		{"/auth?instance=edge2", authRequestBody{Ip: strPtr("203.0.113.5"), Action: strPtr("read"), Path: strPtr("streamid"), Token: strPtr("edgetoken")}, http.StatusForbidden},
+	} {
+		buf := bytes.Buffer{}
+		err := json.NewEncoder(&buf).Encode(c.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", c.url, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		authHandler.ServeHTTP(rr, req)
+		checkStatus(t, rr.Code, c.target)
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	maxConnections := 1
+	authHandler := AuthHandler{PrivateIps: []string{}, QueryTokenKey: "token",
+		Database: newTestDatabase(t, database.Token{Path: "streamid", Action: "read", QueryToken: "TOKENHERE", MaxConnections: &maxConnections})}
+	authHandler.Init()
+	for i, target := range []int{http.StatusOK, http.StatusOK, http.StatusForbidden} {
+		// The first connection authenticating again does not count towards the limit
+		id := []string{"conn1", "conn1", "conn2"}[i]
+		body := authRequestBody{
+			Ip:       strPtr("203.0.113.5"),
+			Query:    strPtr("token=TOKENHERE"),
+			Action:   strPtr("read"),
+			Path:     strPtr("streamid"),
+			Protocol: strPtr("rtsp"),
+			Id:       strPtr(id),
+		}
+		buf := bytes.Buffer{}
+		err := json.NewEncoder(&buf).Encode(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "/auth", &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		authHandler.ServeHTTP(rr, req)
+		checkStatus(t, rr.Code, target)
+	}
+}
+
+func TestDecisionLog(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+
+	authHandler := AuthHandler{PrivateIps: []string{}, QueryTokenKey: "token",
+		Database: newTestDatabase(t, database.Token{Path: "streamid", Action: "read", QueryToken: "TOKENHERE"})}
+	authHandler.Init()
+	body := authRequestBody{Ip: strPtr("203.0.113.5"), Id: strPtr("conn-1"), Query: strPtr("token=TOKENHERE"), Action: strPtr("read"),
+		Path: strPtr("streamid"), Protocol: strPtr("rtsp")}
+	buf := bytes.Buffer{}
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/auth", &buf)
+	authHandler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if strings.Contains(logs.String(), "TOKENHERE") {
+		t.Errorf("Token logged in the clear: %v\n", logs.String())
+	}
+	var decision map[string]any
+	for line := range strings.Lines(logs.String()) {
+		if err := json.Unmarshal([]byte(line), &decision); err != nil {
+			t.Fatal(err)
+		}
+		if decision["msg"] == "Auth decision" {
+			break
+		}
+	}
+	target := map[string]any{"action": "read", "path": "streamid", "protocol": "rtsp", "ip": "203.0.113.5", "id": "conn-1",
+		"token": logging.Token("TOKENHERE"), "result": "allow", "reason": "token"}
+	for key, value := range target {
+		if decision[key] != value {
+			t.Errorf("Wrong %v in decision log: need (%v) got (%v)\n", key, value, decision[key])
+		}
+	}
+}
+
+func TestAcceptsLive(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	point, err := key.PublicKey.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := config.NewMainConfig().Jwt
+	conf.Keys = []config.Jwk{{Kty: "EC", Kid: "test", Crv: "P-256",
+		X: base64.RawURLEncoding.EncodeToString(point[1:33]), Y: base64.RawURLEncoding.EncodeToString(point[33:])}}
+	validator, err := jwtauth.NewValidator(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix(), "mediamtx_paths": "stream", "mediamtx_actions": "read"})
+	token.Header["kid"] = "test"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authHandler := AuthHandler{PrivateIps: []string{"127.0.0.1/8"}, QueryTokenKey: "token", Jwt: validator}
+	authHandler.Init()
+	for _, c := range []struct {
+		ip     string
+		query  string
+		target bool
+	}{
+		{"127.0.0.1", "token=a", true},
+		{"203.0.113.5", "token=a", false},
+		{"203.0.113.5", "", false},
+		{"203.0.113.5", "jwt=" + signed, true},
+		{"203.0.113.5", "jwt=" + signed + "&token=a", true},
+		{"203.0.113.5", "jwt=a.b.c&token=a", false},
+		// A JWT repeated in the query token is left alone, whether or not it verifies
+		{"203.0.113.5", "token=" + signed, true},
+		{"203.0.113.5", "token=" + signed[:len(signed)-4], true},
+	} {
+		conn := database.LiveConnection{Id: "conn1", Path: "stream", Action: "read", Query: c.query, Ip: net.ParseIP(c.ip)}
+		if accepted := authHandler.acceptsLive(conn); accepted != c.target {
+			t.Errorf("Wrong acceptance of (%v) from (%v): need (%v) got (%v)\n", c.query, c.ip, c.target, accepted)
+		}
+	}
+}
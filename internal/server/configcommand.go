@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+	"github.com/pseudoresonance/authserver/internal/jwtauth"
+	"github.com/pseudoresonance/authserver/internal/logging"
+	"github.com/pseudoresonance/authserver/internal/signing"
+	"gopkg.in/yaml.v3"
+)
+
+const configUsage = `Usage: config <command> [flags]
+
+Commands:
+  validate  Check the config for errors
+  print     Print the merged config, including environment variable overrides
+`
+
+const redacted = "<redacted>"
+
+/*
+Inspect the config from the command line
+*/
+func configCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, configUsage)
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "validate":
+		configValidateCommand(args[1:])
+	case "print":
+		configPrintCommand(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown config command %v\n\n%v", args[0], configUsage)
+		os.Exit(2)
+	}
+}
+
+func configValidateCommand(args []string) {
+	flags := flag.NewFlagSet("config validate", flag.ExitOnError)
+	configPath := flags.String("c", "config.yaml", "path to YAML config file or directory")
+	flags.Parse(args)
+
+	if errs := validateConfig(loadConfig(*configPath)); len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+	fmt.Println("Config is valid")
+}
+
+/*
+Check the config and everything built from it at startup, returning every error found
+*/
+func validateConfig(conf *config.MainConfig) []error {
+	errs := []error{}
+	if err := conf.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := signing.NewSigner(conf.Signing); err != nil {
+		errs = append(errs, fmt.Errorf("signing: %w", err))
+	}
+	if _, err := jwtauth.NewValidator(conf.Jwt); err != nil {
+		errs = append(errs, fmt.Errorf("jwt: %w", err))
+	}
+	return errs
+}
+
+func configPrintCommand(args []string) {
+	flags := flag.NewFlagSet("config print", flag.ExitOnError)
+	configPath := flags.String("c", "config.yaml", "path to YAML config file or directory")
+	jsonOutput := flags.Bool("json", false, "print JSON instead of YAML")
+	showSecrets := flags.Bool("show-secrets", false, "print passwords, keys and secrets instead of redacting them")
+	flags.Parse(args)
+
+	if err := printConfig(os.Stdout, *loadConfig(*configPath), *jsonOutput, *showSecrets); err != nil {
+		logging.Fatal("Error while encoding config", "err", err)
+	}
+}
+
+/*
+Write the config as YAML or JSON, with secrets redacted unless shown
+*/
+func printConfig(w io.Writer, conf config.MainConfig, jsonOutput bool, showSecrets bool) error {
+	if !showSecrets {
+		redactConfig(&conf)
+	}
+	data, err := yaml.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	if !jsonOutput {
+		_, err := w.Write(data)
+		return err
+	}
+	// Converted through YAML so the keys match the config file
+	values := map[string]any{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(values)
+}
+
+/*
+Replace secrets in a copy of the config
+*/
+func redactConfig(conf *config.MainConfig) {
+	if len(conf.Database.Password) > 0 {
+		conf.Database.Password = redacted
+	}
+	if len(conf.ServiceIdentity.Password) > 0 {
+		conf.ServiceIdentity.Password = redacted
+	}
+	if len(conf.ServiceIdentity.Token) > 0 {
+		conf.ServiceIdentity.Token = redacted
+	}
+	conf.MediaMtxInstances = slices.Clone(conf.MediaMtxInstances)
+	for i := range conf.MediaMtxInstances {
+		if len(conf.MediaMtxInstances[i].Password) > 0 {
+			conf.MediaMtxInstances[i].Password = redacted
+		}
+		if len(conf.MediaMtxInstances[i].BearerToken) > 0 {
+			conf.MediaMtxInstances[i].BearerToken = redacted
+		}
+	}
+	conf.Signing.Keys = slices.Clone(conf.Signing.Keys)
+	for i := range conf.Signing.Keys {
+		conf.Signing.Keys[i].Secret = redacted
+	}
+	conf.Api.Keys = slices.Clone(conf.Api.Keys)
+	for i := range conf.Api.Keys {
+		conf.Api.Keys[i].Key = redacted
+	}
+	conf.Credentials.Tokens = slices.Clone(conf.Credentials.Tokens)
+	for i := range conf.Credentials.Tokens {
+		conf.Credentials.Tokens[i].Token = redacted
+	}
+	conf.Credentials.Users = slices.Clone(conf.Credentials.Users)
+	for i := range conf.Credentials.Users {
+		conf.Credentials.Users[i].PasswordHash = redacted
+	}
+}
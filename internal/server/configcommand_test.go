@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+	"gopkg.in/yaml.v3"
+)
+
+func TestRedactConfig(t *testing.T) {
+	conf := config.NewMainConfig()
+	conf.Database.Password = "dbsecret"
+	conf.ServiceIdentity.Password = "identitysecret"
+	conf.ServiceIdentity.Token = "identitytoken"
+	conf.MediaMtxInstances = []config.MediaMtxInstance{{Name: "edge", Username: "edge", Password: "edgesecret", BearerToken: "edgetoken"}}
+	conf.Signing.Keys = []config.SigningKey{{Id: "key", Secret: "signingsecret"}}
+	conf.Api.Keys = []config.ApiKey{{Key: "apikey"}}
+	instances := conf.MediaMtxInstances
+
+	redactConfig(&conf)
+	data, err := yaml.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"dbsecret", "identitysecret", "identitytoken", "edgesecret", "edgetoken", "signingsecret", "apikey"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("Secret %v not redacted\n", secret)
+		}
+	}
+	// The loaded config is left alone
+	if instances[0].Password != "edgesecret" {
+		t.Errorf("Wrong original password: need (%v) got (%v)\n", "edgesecret", instances[0].Password)
+	}
+}
+
+/*
+Collect every string field of a config by its path, growing empty lists of structs to one entry so their fields are included
+*/
+func configStrings(v reflect.Value, path string, fields map[string]reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		fields[path] = v
+	case reflect.Struct:
+		for i := range v.NumField() {
+			if field := v.Type().Field(i); field.IsExported() {
+				configStrings(v.Field(i), path+"."+field.Name, fields)
+			}
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Struct {
+			return
+		}
+		if v.Len() == 0 {
+			v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		}
+		for i := range v.Len() {
+			configStrings(v.Index(i), path, fields)
+		}
+	}
+}
+
+func TestRedactConfigFields(t *testing.T) {
+	conf := config.NewMainConfig()
+	fields := map[string]reflect.Value{}
+	configStrings(reflect.ValueOf(&conf).Elem(), "", fields)
+	for path, field := range fields {
+		field.SetString("value" + path)
+	}
+
+	redactConfig(&conf)
+	fields = map[string]reflect.Value{}
+	configStrings(reflect.ValueOf(&conf).Elem(), "", fields)
+	// Names of every field holding a secret, so a new secret field fails until it is redacted or listed here
+	secret := func(path string) bool {
+		name := strings.ToLower(path[strings.LastIndex(path, ".")+1:])
+		switch name {
+		case "querytokenkey", "activekey", "keyfile":
+			return false
+		}
+		return name == "key" || strings.Contains(name, "password") || strings.Contains(name, "secret") ||
+			strings.Contains(name, "token") || strings.Contains(name, "hash")
+	}
+	for path, field := range fields {
+		if isRedacted := field.String() == redacted; isRedacted != secret(path) {
+			t.Errorf("Wrong redaction of %v: need (%v) got (%v)\n", path, secret(path), isRedacted)
+		}
+	}
+	if len(fields) == 0 {
+		t.Error("No config fields found")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	conf := config.NewMainConfig()
+	if errs := validateConfig(&conf); len(errs) != 0 {
+		t.Errorf("Default config invalid: %v\n", errs)
+	}
+	conf.Database.Backend = "cassette"
+	conf.Signing.Keys = []config.SigningKey{{Id: "key", Secret: ""}}
+	if errs := validateConfig(&conf); len(errs) != 2 {
+		t.Errorf("Wrong errors: need (%v) got (%v)\n", 2, errs)
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	conf := config.NewMainConfig()
+	conf.Database.Password = "dbsecret"
+	for _, c := range []struct {
+		jsonOutput  bool
+		showSecrets bool
+	}{{false, false}, {true, false}, {false, true}, {true, true}} {
+		buf := bytes.Buffer{}
+		if err := printConfig(&buf, conf, c.jsonOutput, c.showSecrets); err != nil {
+			t.Fatal(err)
+		}
+		if shown := strings.Contains(buf.String(), "dbsecret"); shown != c.showSecrets {
+			t.Errorf("Wrong secret shown with json (%v): need (%v) got (%v)\n", c.jsonOutput, c.showSecrets, shown)
+		}
+		values := map[string]any{}
+		var err error
+		if c.jsonOutput {
+			err = json.Unmarshal(buf.Bytes(), &values)
+		} else {
+			err = yaml.Unmarshal(buf.Bytes(), &values)
+		}
+		// Keys match the config file in both formats
+		if _, ok := values["queryTokenKey"]; err != nil || !ok {
+			t.Errorf("Wrong output with json (%v): %v\n", c.jsonOutput, err)
+		}
+	}
+	// The given config is left alone
+	if conf.Database.Password != "dbsecret" {
+		t.Errorf("Wrong original password: need (%v) got (%v)\n", "dbsecret", conf.Database.Password)
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 
@@ -12,28 +12,103 @@ type ConnectHandler struct {
 	Database *database.DatabaseManager
 }
 
+/*
+MediaMTX hook posted as JSON, with the environment MediaMTX runs the hook command with (ex: MTX_PATH, MTX_CONN_ID)
+*/
+type hookRequestBody struct {
+	Event string            `json:"event"` // connect, disconnect, ready, notReady, read or unread
+	Env   map[string]string `json:"env"`
+}
+
 func (a ConnectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	switch r.Method {
+	case http.MethodGet:
+		a.serveLegacy(w, r)
+	case http.MethodPost:
+		a.serveHook(w, r)
+	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
 	}
+}
 
-	// Since no curl in container by default, just use GET with wget instead...
+/*
+Connect and disconnect webhooks as query parameters, for MediaMTX images with only wget
+*/
+func (a ConnectHandler) serveLegacy(w http.ResponseWriter, r *http.Request) {
 	parsed, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
-		log.Printf("Error parsing query string: (%v)\n%v\n", r.URL.RawQuery, err)
+		slog.Warn("Error parsing query string", "query", r.URL.RawQuery, "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	conn := database.Connection{Id: parsed.Get("id"), Protocol: parsed.Get("type")}
+
+	switch parsed.Get("action") {
+	case "connect":
+		a.Database.Connect(conn)
+	case "disconnect":
+		a.Database.Disconnect(conn)
+	default:
+		slog.Warn("Unknown connection action", "action", parsed.Get("action"), "id", conn.Id)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	action := parsed.Get("action")
-	id := parsed.Get("id")
-	connType := parsed.Get("type")
-
-	if action == "connect" {
-		a.Database.Connect(database.Connection{Id: id, Protocol: connType})
-	} else {
-		a.Database.Disconnect(database.Connection{Id: id, Protocol: connType})
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+Lifecycle webhooks, feeding connection tracking and stream state
+*/
+func (a ConnectHandler) serveHook(w http.ResponseWriter, r *http.Request) {
+	var request hookRequestBody
+	if err := readJson(r, &request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	instance := r.URL.Query().Get(instanceQuery)
+	env := request.Env
+	path := env["MTX_PATH"]
+
+	switch request.Event {
+	case "connect", "disconnect":
+		conn := database.Connection{Id: env["MTX_CONN_ID"], Protocol: env["MTX_CONN_TYPE"]}
+		if len(conn.Id) == 0 {
+			writeError(w, http.StatusBadRequest, "MTX_CONN_ID is required")
+			return
+		}
+		if request.Event == "connect" {
+			a.Database.Connect(conn)
+		} else {
+			a.Database.Disconnect(conn)
+		}
+	case "ready", "notReady":
+		if len(path) == 0 {
+			writeError(w, http.StatusBadRequest, "MTX_PATH is required")
+			return
+		}
+		if request.Event == "ready" {
+			a.Database.StreamReady(instance, path, database.Connection{Id: env["MTX_SOURCE_ID"], Protocol: env["MTX_SOURCE_TYPE"]})
+		} else {
+			a.Database.StreamNotReady(instance, path)
+		}
+	case "read", "unread":
+		reader := database.Connection{Id: env["MTX_READER_ID"], Protocol: env["MTX_READER_TYPE"]}
+		if len(path) == 0 || len(reader.Id) == 0 {
+			writeError(w, http.StatusBadRequest, "MTX_PATH and MTX_READER_ID are required")
+			return
+		}
+		if request.Event == "read" {
+			a.Database.StartRead(instance, path, reader, env["MTX_QUERY"])
+		} else {
+			a.Database.StopRead(instance, path, reader)
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "unknown event")
+		return
 	}
 
+	slog.Debug("MediaMTX webhook", "event", request.Event, "instance", instance, "path", path, "conn", env["MTX_CONN_ID"],
+		"source", env["MTX_SOURCE_ID"], "reader", env["MTX_READER_ID"])
 	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+	"github.com/pseudoresonance/authserver/internal/database"
+)
+
+func postHook(t *testing.T, handler ConnectHandler, url string, body hookRequestBody) int {
+	t.Helper()
+	buf := bytes.Buffer{}
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", url, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestStreamHooks(t *testing.T) {
+	connectHandler := ConnectHandler{Database: newTestDatabase(t)}
+	ready := map[string]string{"MTX_PATH": "stream", "MTX_QUERY": "", "MTX_SOURCE_TYPE": "rtmpConn", "MTX_SOURCE_ID": "pub1"}
+	checkStatus(t, postHook(t, connectHandler, "/connection?instance=ingest", hookRequestBody{Event: "ready", Env: ready}), http.StatusOK)
+	for _, c := range []struct {
+		event  string
+		reader string
+	}{{"read", "conn1"}, {"read", "conn2"}, {"read", "conn2"}, {"unread", "conn1"}} {
+		env := map[string]string{"MTX_PATH": "stream", "MTX_QUERY": "token=a", "MTX_READER_TYPE": "webRTCSession", "MTX_READER_ID": c.reader}
+		checkStatus(t, postHook(t, connectHandler, "/connection?instance=ingest", hookRequestBody{Event: c.event, Env: env}), http.StatusOK)
+	}
+
+	streams := connectHandler.Database.Streams()
+	if len(streams) != 1 || streams[0].Instance != "ingest" || streams[0].SourceType != "rtmpConn" || streams[0].SourceId != "pub1" || streams[0].Readers != 1 {
+		t.Fatalf("Wrong streams: %+v\n", streams)
+	}
+	checkStatus(t, postHook(t, connectHandler, "/connection?instance=ingest", hookRequestBody{Event: "notReady", Env: ready}), http.StatusOK)
+	if streams := connectHandler.Database.Streams(); len(streams) != 0 {
+		t.Errorf("Stream not removed: %+v\n", streams)
+	}
+}
+
+func TestBadHooks(t *testing.T) {
+	connectHandler := ConnectHandler{Database: newTestDatabase(t)}
+	for _, body := range []hookRequestBody{
+		{Event: "unknown", Env: map[string]string{"MTX_PATH": "stream"}},
+		{Event: "connect", Env: map[string]string{"MTX_CONN_TYPE": "rtspConn"}},
+		{Event: "ready", Env: map[string]string{}},
+		{Event: "read", Env: map[string]string{"MTX_PATH": "stream"}},
+	} {
+		checkStatus(t, postHook(t, connectHandler, "/connection", body), http.StatusBadRequest)
+	}
+
+	// The legacy form no longer treats unknown actions as a disconnect
+	req, err := http.NewRequest("GET", "/connection?action=unknown&type=rtspSession&id=conn1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	connectHandler.ServeHTTP(rr, req)
+	checkStatus(t, rr.Code, http.StatusBadRequest)
+}
+
+func TestDisconnectHook(t *testing.T) {
+	maxConnections := 1
+	db := newTestDatabase(t, database.Token{Path: "streamid", Action: "read", QueryToken: "TOKENHERE", MaxConnections: &maxConnections})
+	authHandler := AuthHandler{PrivateIps: []string{}, QueryTokenKey: "token", Database: db}
+	authHandler.Init()
+	connectHandler := ConnectHandler{Database: db}
+	auth := func(id string) int {
+		body := authRequestBody{Ip: strPtr("203.0.113.5"), Query: strPtr("token=TOKENHERE"), Action: strPtr("read"), Path: strPtr("streamid"),
+			Protocol: strPtr("rtsp"), Id: strPtr(id)}
+		buf := bytes.Buffer{}
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "/auth", &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		authHandler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	checkStatus(t, auth("conn1"), http.StatusOK)
+	checkStatus(t, auth("conn2"), http.StatusForbidden)
+	// The disconnected connection no longer counts towards the limit
+	env := map[string]string{"MTX_CONN_TYPE": "rtspSession", "MTX_CONN_ID": "conn1"}
+	checkStatus(t, postHook(t, connectHandler, "/connection", hookRequestBody{Event: "disconnect", Env: env}), http.StatusOK)
+	checkStatus(t, auth("conn2"), http.StatusOK)
+}
+
+func TestReadHookQuote(t *testing.T) {
+	// MediaMTX confirms the reader before it is tracked
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/webrtcsessions/get/conn1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"id": "conn1", "state": "read", "path": "stream", "query": "token=a\"b"}`))
+	}))
+	defer api.Close()
+	conf := config.NewMainConfig()
+	conf.MediaMtxUrlBase = api.URL
+	conf.MediaMtxUrlBasePublish = api.URL
+	store := database.NewMemoryStore()
+	maxConnections := 1
+	if _, err := store.CreateToken(context.Background(), database.Token{Path: "stream", Action: "read", QueryToken: `a"b`, MaxConnections: &maxConnections}); err != nil {
+		t.Fatal(err)
+	}
+	db := &database.DatabaseManager{}
+	db.InitWithStore(&conf, store)
+	defer db.Close()
+	authHandler := AuthHandler{PrivateIps: []string{}, QueryTokenKey: "token", Database: db}
+	authHandler.Init()
+	connectHandler := ConnectHandler{Database: db}
+
+	// As built by jq in the read hook, with the quote escaped rather than ending the string
+	body := `{"event":"read","env":{"MTX_PATH":"stream","MTX_QUERY":"token=a\"b","MTX_READER_TYPE":"webRTCSession","MTX_READER_ID":"conn1"}}`
+	req, err := http.NewRequest("POST", "/connection", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	connectHandler.ServeHTTP(rr, req)
+	checkStatus(t, rr.Code, http.StatusOK)
+
+	// The reader was tracked by the full token, so takes the only connection
+	buf := bytes.Buffer{}
+	if err := json.NewEncoder(&buf).Encode(authRequestBody{Ip: strPtr("203.0.113.5"), Query: strPtr(`token=a"b`), Action: strPtr("read"),
+		Path: strPtr("stream"), Protocol: strPtr("webrtc"), Id: strPtr("conn2")}); err != nil {
+		t.Fatal(err)
+	}
+	req, err = http.NewRequest("POST", "/auth", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	authHandler.ServeHTTP(rr, req)
+	checkStatus(t, rr.Code, http.StatusForbidden)
+}
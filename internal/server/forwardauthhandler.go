@@ -1,16 +1,20 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/pseudoresonance/authserver/internal/config"
 	"github.com/pseudoresonance/authserver/internal/database"
+	"github.com/pseudoresonance/authserver/internal/logging"
+	"github.com/pseudoresonance/authserver/internal/metrics"
+	"github.com/pseudoresonance/authserver/internal/signing"
 )
 
 type ForwardAuthHandler struct {
@@ -19,6 +23,7 @@ type ForwardAuthHandler struct {
 
 	QueryTokenKey string
 	Config        config.ForwardAuthConfig
+	Signer        *signing.Signer
 	Database      *database.DatabaseManager
 }
 
@@ -28,7 +33,7 @@ func (a *ForwardAuthHandler) Init() {
 	for i, entry := range a.PrivateIps {
 		_, cidr, err := net.ParseCIDR(entry)
 		if err != nil {
-			log.Fatalf("Invalid CIDR %v\n", entry)
+			logging.Fatal("Invalid CIDR", "cidr", entry)
 		}
 		a.NetPrivateIps[i] = *cidr
 	}
@@ -44,49 +49,84 @@ func (a ForwardAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	uriHeader := r.Header.Get(a.Config.UriHeader)
 
 	if len(ipHeader) == 0 || len(uriHeader) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
+		a.respond(w, nil, "", "", http.StatusBadRequest, "bad_request")
 		return
 	}
 	uri, found := strings.CutPrefix(uriHeader, a.Config.BasePath)
 	if !found {
-		w.WriteHeader(http.StatusBadRequest)
+		a.respond(w, nil, "", "", http.StatusBadRequest, "bad_request")
 		return
 	}
-	ipSplit := strings.Split(ipHeader, ",")
-	ip := net.ParseIP(ipSplit[0])
+	ip := forwardedIp(ipHeader, a.Config.TrustedHops)
 
 	// Access from private networks is accepted - generally for container networks
 	if listContainsIp(a.NetPrivateIps, ip) {
-		w.WriteHeader(http.StatusOK)
+		a.respond(w, ip, "", "", http.StatusOK, "private_ip")
 		return
 	}
 
 	// External access
 	queryUrl, err := url.Parse(uri)
 	if err != nil {
-		log.Printf("Error parsing URI: (%v)\n%v\n", uri, err)
+		slog.Warn("Error parsing URI", "uri", logging.Uri(uri, a.QueryTokenKey), "err", err)
 	}
 	queryParsed, err := url.ParseQuery(queryUrl.RawQuery)
 	if err != nil {
-		log.Printf("Error parsing URI query string: (%v)\n%v\n", uri, err)
+		slog.Warn("Error parsing URI query string", "uri", logging.Uri(uri, a.QueryTokenKey), "err", err)
 	}
 	token := queryParsed.Get(a.QueryTokenKey)
 
 	targetFile := path.Base(queryUrl.Path)
 	path := strings.TrimSuffix(filepath.Base(targetFile), filepath.Ext(targetFile))
 
+	// Signed tokens are verified without the database
+	if a.Signer.Enabled() && a.Signer.Verify(token, path, "read", ip, time.Now()) == nil {
+		a.respond(w, ip, path, token, http.StatusOK, "signed")
+		return
+	}
+
 	res, err := a.Database.ValidateAuth(&database.Credentials{
 		Action:     "read",
 		Path:       path,
 		QueryToken: token,
-	}, nil)
+	}, database.Client{Ip: ip})
 	if err != nil {
-		log.Printf("Error while validating auth\n%v\n", err)
+		slog.Error("Error while validating auth", "err", err)
 	}
 	if res {
-		w.WriteHeader(http.StatusOK)
+		a.respond(w, ip, path, token, http.StatusOK, "token")
 		return
 	}
 
-	w.WriteHeader(http.StatusForbidden)
+	a.respond(w, ip, path, token, http.StatusForbidden, "invalid_credentials")
+}
+
+/*
+Get the client IP from a proxy header listing each hop (ex: X-Forwarded-For), counting back from the entry appended by the
+proxy in front of the server, as entries before the trusted proxies are set by the client and cannot be trusted
+*/
+func forwardedIp(header string, trustedHops int) net.IP {
+	entries := strings.Split(header, ",")
+	// Fewer entries than trusted proxies means the header was not set by the client at all
+	i := max(len(entries)-1-trustedHops, 0)
+	return net.ParseIP(strings.TrimSpace(entries[i]))
+}
+
+/*
+Answer a forward auth request, logging, auditing and recording the decision, which is always a read over HLS
+*/
+func (a ForwardAuthHandler) respond(w http.ResponseWriter, ip net.IP, path string, token string, status int, reason string) {
+	result := "allow"
+	if status != http.StatusOK {
+		result = "deny"
+	}
+	var ipText string
+	if ip != nil {
+		ipText = ip.String()
+	}
+	slog.Info("Forward auth decision", "action", "read", "path", path, "protocol", "hls", "ip", ipText, "token", logging.Token(token),
+		"result", result, "reason", reason)
+	a.Database.Audit(database.AuditEntry{Action: "read", Path: path, Protocol: "hls", Ip: ipText, Token: logging.Token(token), Result: result, Reason: reason})
+	metrics.AuthDecisions.WithLabelValues("read", "hls", result, reason).Inc()
+	w.WriteHeader(status)
 }
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/pseudoresonance/authserver/internal/config"
+	"github.com/pseudoresonance/authserver/internal/database"
 )
 
 func TestFABadMethod(t *testing.T) {
@@ -65,9 +67,10 @@ func TestFALocalMulti(t *testing.T) {
 	forwardAuthHandler := ForwardAuthHandler{
 		QueryTokenKey: "token",
 		Config: config.ForwardAuthConfig{
-			UriHeader: "X-Forwarded-Uri",
-			IpHeader:  "X-Forwarded-For",
-			BasePath:  "/thumbnails",
+			UriHeader:   "X-Forwarded-Uri",
+			IpHeader:    "X-Forwarded-For",
+			TrustedHops: 1,
+			BasePath:    "/thumbnails",
 		},
 		PrivateIps: []string{"127.0.0.1/8"},
 	}
@@ -92,6 +95,7 @@ func TestFARemote(t *testing.T) {
 			BasePath:  "/thumbnails",
 		},
 		PrivateIps: []string{"127.0.0.1/8"},
+		Database:   newTestDatabase(t, database.Token{Path: "test", Action: "read", QueryToken: "abc"}),
 	}
 	forwardAuthHandler.Init()
 	req, err := http.NewRequest("GET", "/forward", nil)
@@ -104,3 +108,45 @@ func TestFARemote(t *testing.T) {
 	forwardAuthHandler.ServeHTTP(rr, req)
 	checkStatus(t, rr.Code, http.StatusOK)
 }
+
+func TestFARemoteWrongToken(t *testing.T) {
+	forwardAuthHandler := ForwardAuthHandler{
+		QueryTokenKey: "token",
+		Config: config.ForwardAuthConfig{
+			UriHeader: "X-Forwarded-Uri",
+			IpHeader:  "X-Forwarded-For",
+			BasePath:  "/thumbnails",
+		},
+		PrivateIps: []string{"127.0.0.1/8"},
+		Database:   newTestDatabase(t, database.Token{Path: "test", Action: "read", QueryToken: "abc"}),
+	}
+	forwardAuthHandler.Init()
+	req, err := http.NewRequest("GET", "/forward", nil)
+	req.Header.Add(forwardAuthHandler.Config.UriHeader, "/thumbnails/other.png?token=abc")
+	req.Header.Add(forwardAuthHandler.Config.IpHeader, "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	forwardAuthHandler.ServeHTTP(rr, req)
+	checkStatus(t, rr.Code, http.StatusForbidden)
+}
+
+func TestForwardedIp(t *testing.T) {
+	for _, c := range []struct {
+		header      string
+		trustedHops int
+		target      string
+	}{
+		{"203.0.113.5", 0, "203.0.113.5"},
+		// Entries before the one appended by the proxy can be set by the client
+		{"127.0.0.1, 203.0.113.5", 0, "203.0.113.5"},
+		{"127.0.0.1,203.0.113.5 , 198.51.100.1", 1, "203.0.113.5"},
+		{"203.0.113.5", 2, "203.0.113.5"},
+		{"2001:db8::1, 198.51.100.1", 1, "2001:db8::1"},
+	} {
+		if ip := forwardedIp(c.header, c.trustedHops); !ip.Equal(net.ParseIP(c.target)) {
+			t.Errorf("Wrong IP for (%v) with %v trusted hops: need (%v) got (%v)\n", c.header, c.trustedHops, c.target, ip)
+		}
+	}
+}
@@ -4,50 +4,119 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 
 	"github.com/pseudoresonance/authserver/internal/config"
 	"github.com/pseudoresonance/authserver/internal/database"
+	"github.com/pseudoresonance/authserver/internal/jwtauth"
+	"github.com/pseudoresonance/authserver/internal/logging"
+	"github.com/pseudoresonance/authserver/internal/metrics"
+	"github.com/pseudoresonance/authserver/internal/signing"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "sign":
+			signCommand(os.Args[2:])
+			return
+		case "token":
+			tokenCommand(os.Args[2:])
+			return
+		case "migrate":
+			migrateCommand(os.Args[2:])
+			return
+		case "audit":
+			auditCommand(os.Args[2:])
+			return
+		case "reconcile":
+			reconcileCommand(os.Args[2:])
+			return
+		case "config":
+			configCommand(os.Args[2:])
+			return
+		}
+	}
+
 	// Config
 	configPathFlag := flag.String("c", "config.yaml", "path to YAML config file or directory")
 	flag.Parse()
-	configPathEnv, exist := os.LookupEnv("CONFIG_PATH")
+	config := loadConfig(*configPathFlag)
 
-	if exist && len(configPathEnv) > 0 {
-		configPathFlag = &configPathEnv
+	signer, err := signing.NewSigner(config.Signing)
+	if err != nil {
+		logging.Fatal("Error while loading signing keys", "err", err)
 	}
-
-	config, err := config.LoadConfig(*configPathFlag)
+	jwtValidator, err := jwtauth.NewValidator(config.Jwt)
 	if err != nil {
-		log.Fatalf("Error while loading config\n%v\n", err)
+		logging.Fatal("Error while loading JWT keys", "err", err)
 	}
 
 	// Database
 	db := database.DatabaseManager{}
 	db.Init(config)
 	defer db.Close()
+	metrics.Registry.MustRegister(db.Collector())
 
 	// Server
-	authHandler := AuthHandler{ApiIps: config.ApiIps, MonitoringIps: config.MonitoringIpRanges, PrivateIps: config.PrivateIps, QueryTokenKey: config.QueryTokenKey, Database: &db}
+	authHandler := AuthHandler{ApiIps: config.ApiIps, MonitoringIps: config.MonitoringIpRanges, PrivateIps: config.PrivateIps, Instances: config.Instances(),
+		Service: config.ServiceIdentity, QueryTokenKey: config.QueryTokenKey, Signer: signer, Jwt: jwtValidator, Database: &db}
 	authHandler.Init()
 	http.Handle("/auth", authHandler)
 
 	connectHandler := ConnectHandler{Database: &db}
 	http.Handle("/connection", connectHandler)
 
-	forwardAuthHandler := ForwardAuthHandler{PrivateIps: config.PrivateIps, QueryTokenKey: config.QueryTokenKey, Config: config.ForwardAuth, Database: &db}
+	forwardAuthHandler := ForwardAuthHandler{PrivateIps: config.PrivateIps, QueryTokenKey: config.QueryTokenKey, Config: config.ForwardAuth, Signer: signer, Database: &db}
+	forwardAuthHandler.Init()
 	http.Handle("/forward", forwardAuthHandler)
 
+	signHandler := SignHandler{ApiIps: config.ApiIps, MaxTtl: config.Signing.MaxTtl, Signer: signer}
+	signHandler.Init()
+	http.Handle("/sign", signHandler)
+
+	shareHandler := ShareHandler{QueryTokenKey: config.QueryTokenKey, Config: config.Share, Signer: signer, Jwt: jwtValidator, Database: &db}
+	shareHandler.Init()
+	http.Handle("/share", shareHandler)
+
+	apiHandler := ApiHandler{Keys: config.Api.Keys, Database: &db}
+	apiHandler.Init()
+	http.Handle("/api/v1/", apiHandler)
+
+	metricsHandler := MetricsHandler{MonitoringIps: config.MonitoringIpRanges}
+	metricsHandler.Init()
+	http.Handle("/metrics", metricsHandler)
+
+	if config.Reconcile.OnStartup {
+		go reconcileOnStartup(&db, authHandler, config.Reconcile.DryRun)
+	}
+
 	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		io.WriteString(w, "ok")
 	})
 
 	bindAddr := fmt.Sprintf("%v:%v", config.BindAddress, config.BindPort)
-	log.Printf("Starting server on %v\n", bindAddr)
-	log.Fatalf("HTTP server error\n%v\n", http.ListenAndServe(bindAddr, nil))
+	slog.Info("Starting server", "address", bindAddr)
+	logging.Fatal("HTTP server error", "err", http.ListenAndServe(bindAddr, nil))
+}
+
+/*
+Load the config from the given path, or the CONFIG_PATH environment variable if set
+*/
+func loadConfig(configPath string) *config.MainConfig {
+	configPathEnv, exist := os.LookupEnv("CONFIG_PATH")
+	if exist && len(configPathEnv) > 0 {
+		configPath = configPathEnv
+	}
+
+	conf, err := config.LoadConfig(configPath)
+	if err != nil {
+		logging.Fatal("Error while loading config", "err", err)
+	}
+	if err := logging.Setup(conf.Log.Level, conf.Log.Format); err != nil {
+		logging.Fatal("Error while configuring logging", "err", err)
+	}
+	return conf
 }
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/pseudoresonance/authserver/internal/logging"
+	"github.com/pseudoresonance/authserver/internal/metrics"
+)
+
+type MetricsHandler struct {
+	MonitoringIps    []string
+	NetMonitoringIps []net.IPNet
+
+	handler http.Handler
+}
+
+func (a *MetricsHandler) Init() {
+	// Parse CIDR strings to Golang IPNets
+	a.NetMonitoringIps = make([]net.IPNet, len(a.MonitoringIps))
+	for i, entry := range a.MonitoringIps {
+		_, cidr, err := net.ParseCIDR(entry)
+		if err != nil {
+			logging.Fatal("Invalid CIDR", "cidr", entry)
+		}
+		a.NetMonitoringIps[i] = *cidr
+	}
+	a.handler = metrics.Handler()
+}
+
+func (a MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !listContainsIp(a.NetMonitoringIps, net.ParseIP(host)) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	a.handler.ServeHTTP(w, r)
+}
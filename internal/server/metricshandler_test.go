@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsRestricted(t *testing.T) {
+	metricsHandler := MetricsHandler{MonitoringIps: []string{"127.0.0.0/8"}}
+	metricsHandler.Init()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.RemoteAddr = "203.0.113.5:1234"
+	rr := httptest.NewRecorder()
+	metricsHandler.ServeHTTP(rr, req)
+	checkStatus(t, rr.Code, http.StatusForbidden)
+}
+
+func TestMetricsDecisions(t *testing.T) {
+	authHandler := AuthHandler{PrivateIps: []string{"10.0.0.0/8"}, QueryTokenKey: "token", Database: newTestDatabase(t)}
+	authHandler.Init()
+	req := httptest.NewRequest("POST", "/auth", bytes.NewBuffer([]byte(`{"ip": "10.0.0.1", "action": "read", "path": "test", "protocol": "rtsp"}`)))
+	authHandler.ServeHTTP(httptest.NewRecorder(), req)
+
+	metricsHandler := MetricsHandler{MonitoringIps: []string{"127.0.0.0/8"}}
+	metricsHandler.Init()
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	rr := httptest.NewRecorder()
+	metricsHandler.ServeHTTP(rr, req)
+	checkStatus(t, rr.Code, http.StatusOK)
+	target := `mediamtxauth_auth_decisions_total{action="read",protocol="rtsp",reason="private_ip",result="allow"}`
+	if !strings.Contains(rr.Body.String(), target) {
+		t.Errorf("Decision %v missing from metrics\n", target)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/pseudoresonance/authserver/internal/logging"
+)
+
+const migrateUsage = `Usage: migrate <command> [flags]
+
+Commands:
+  status    List migrations and whether they have been applied
+  up        Apply all pending migrations
+  down      Roll back the most recently applied migrations
+`
+
+/*
+Parsed command line of the migrate command
+*/
+type migrateOptions struct {
+	command    string
+	configPath string
+	steps      int
+}
+
+/*
+Parse the migrate subcommand and its flags, writing errors and usage to output
+*/
+func parseMigrate(args []string, output io.Writer) (migrateOptions, error) {
+	var opts migrateOptions
+	if len(args) == 0 {
+		fmt.Fprint(output, migrateUsage)
+		return opts, errors.New("no migrate command given")
+	}
+	opts.command = args[0]
+	flags := flag.NewFlagSet("migrate "+args[0], flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(&opts.configPath, "c", "config.yaml", "path to YAML config file or directory")
+	switch args[0] {
+	case "status", "up":
+	case "down":
+		flags.IntVar(&opts.steps, "n", 1, "number of migrations to roll back")
+	default:
+		err := fmt.Errorf("unknown migrate command %v", args[0])
+		fmt.Fprintf(output, "Unknown migrate command %v\n\n%v", args[0], migrateUsage)
+		return opts, err
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return opts, err
+	}
+	if opts.command == "down" && opts.steps <= 0 {
+		fmt.Fprintln(output, "n must be positive")
+		return opts, errors.New("n must be positive")
+	}
+	return opts, nil
+}
+
+/*
+Manage the database schema from the command line
+*/
+func migrateCommand(args []string) {
+	opts, err := parseMigrate(args, os.Stderr)
+	if err != nil {
+		exitUsage(err)
+	}
+
+	db := openDatabase(loadConfig(opts.configPath))
+	defer db.Close()
+	ctx := context.Background()
+	switch opts.command {
+	case "status":
+		status, err := db.MigrationStatus(ctx)
+		if err != nil {
+			logging.Fatal("Error fetching migration status", "err", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, m := range status {
+			applied := formatTime(m.AppliedAt)
+			if m.Adopted {
+				applied += " (adopted)"
+			}
+			fmt.Fprintf(w, "%04d\t%v\t%v\n", m.Version, m.Name, applied)
+		}
+		w.Flush()
+	case "up":
+		applied, err := db.MigrateUp(ctx)
+		for _, m := range applied {
+			fmt.Printf("Applied %04d_%v\n", m.Version, m.Name)
+		}
+		if err != nil {
+			logging.Fatal("Error while migrating", "err", err)
+		}
+		if len(applied) == 0 {
+			fmt.Println("Schema is up to date")
+		}
+	case "down":
+		rolledBack, err := db.MigrateDown(ctx, opts.steps)
+		for _, m := range rolledBack {
+			fmt.Printf("Rolled back %04d_%v\n", m.Version, m.Name)
+		}
+		if err != nil {
+			logging.Fatal("Error while rolling back", "err", err)
+		}
+	}
+}
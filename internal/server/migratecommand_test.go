@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io"
+	"testing"
+)
+
+func TestParseMigrate(t *testing.T) {
+	for _, c := range []struct {
+		args    []string
+		valid   bool
+		command string
+		steps   int
+	}{
+		{[]string{"status"}, true, "status", 0},
+		{[]string{"up", "-c", "conf"}, true, "up", 0},
+		{[]string{"down"}, true, "down", 1},
+		{[]string{"down", "-n", "3"}, true, "down", 3},
+		{[]string{"down", "-n", "0"}, false, "", 0},
+		{[]string{"down", "-n", "-1"}, false, "", 0},
+		// Only down rolls back steps
+		{[]string{"up", "-n", "3"}, false, "", 0},
+		{[]string{"sideways"}, false, "", 0},
+		{[]string{}, false, "", 0},
+	} {
+		opts, err := parseMigrate(c.args, io.Discard)
+		if (err == nil) != c.valid {
+			t.Errorf("Wrong result for %v: need valid (%v) got (%v)\n", c.args, c.valid, err)
+			continue
+		}
+		if c.valid && (opts.command != c.command || opts.steps != c.steps) {
+			t.Errorf("Wrong options for %v: need (%v, %v) got (%v, %v)\n", c.args, c.command, c.steps, opts.command, opts.steps)
+		}
+	}
+}
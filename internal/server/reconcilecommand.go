@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pseudoresonance/authserver/internal/database"
+	"github.com/pseudoresonance/authserver/internal/logging"
+	"github.com/pseudoresonance/authserver/internal/signing"
+)
+
+/*
+Time allowed for listing and reconciling all connections
+*/
+const reconcileTimeout = 5 * time.Minute
+
+/*
+Reconcile the connections already on MediaMTX when the server starts, logging a summary
+*/
+func reconcileOnStartup(db *database.DatabaseManager, authHandler AuthHandler, dryRun bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), reconcileTimeout)
+	defer cancel()
+	results, err := db.Reconcile(ctx, dryRun, authHandler.acceptsLive)
+	if err != nil {
+		slog.Error("Error while reconciling MediaMTX connections", "err", err)
+	}
+	counts := map[string]int{}
+	for _, r := range results {
+		counts[r.Outcome]++
+		if r.Outcome == database.ReconcileInvalid {
+			slog.Info("Invalid MediaMTX connection", "id", r.Id, "protocol", r.Protocol, "path", r.Path, "action", r.Action, "ip", r.Ip.String(),
+				"instance", r.Instance, "kicked", !dryRun)
+		}
+	}
+	slog.Info("Reconciled MediaMTX connections", "dryRun", dryRun, "connections", len(results), "valid", counts[database.ReconcileValid],
+		"invalid", counts[database.ReconcileInvalid], "accepted", counts[database.ReconcileAccepted], "unknown", counts[database.ReconcileUnknown],
+		"errors", counts[database.ReconcileError])
+}
+
+/*
+Report how the connections on MediaMTX match credentials, optionally kicking those which are invalid
+*/
+func reconcileCommand(args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	configPath := flags.String("c", "config.yaml", "path to YAML config file or directory")
+	jsonOutput := flags.Bool("json", false, "print JSON instead of a table")
+	kick := flags.Bool("kick", false, "kick connections with invalid credentials instead of only reporting them")
+	flags.Parse(args)
+
+	conf := loadConfig(*configPath)
+	signer, err := signing.NewSigner(conf.Signing)
+	if err != nil {
+		logging.Fatal("Error while loading signing keys", "err", err)
+	}
+	authHandler := AuthHandler{PrivateIps: conf.PrivateIps, QueryTokenKey: conf.QueryTokenKey, Signer: signer}
+	authHandler.Init()
+
+	db := openDatabase(conf)
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), reconcileTimeout)
+	defer cancel()
+	results, err := db.Reconcile(ctx, !*kick, authHandler.acceptsLive)
+
+	// Connections on the instances which could be listed are shown even if others failed
+	if *jsonOutput {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		e.Encode(results)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "OUTCOME\tID\tPROTOCOL\tPATH\tACTION\tIP\tINSTANCE")
+		for _, r := range results {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", r.Outcome, r.Id, r.Protocol, r.Path, formatString(r.Action), r.Ip, r.Instance)
+		}
+		w.Flush()
+	}
+	if err != nil {
+		logging.Fatal("Error while reconciling MediaMTX connections", "err", err)
+	}
+}
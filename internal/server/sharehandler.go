@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+	"github.com/pseudoresonance/authserver/internal/database"
+	"github.com/pseudoresonance/authserver/internal/jwtauth"
+	"github.com/pseudoresonance/authserver/internal/logging"
+	"github.com/pseudoresonance/authserver/internal/signing"
+)
+
+type ShareHandler struct {
+	QueryTokenKey string
+	Config        config.ShareConfig
+	Signer        *signing.Signer
+	Jwt           *jwtauth.Validator
+	Database      *database.DatabaseManager
+
+	templates map[string]*template.Template
+}
+
+func (a *ShareHandler) Init() {
+	a.templates = make(map[string]*template.Template, len(a.Config.Urls))
+	for name, text := range a.Config.Urls {
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+		if err != nil {
+			logging.Fatal("Invalid share URL template", "name", name, "err", err)
+		}
+		a.templates[name] = tmpl
+	}
+}
+
+type shareRequestBody struct {
+	Path           string `json:"path"`
+	Token          string `json:"token,omitempty"`          // Publish token, if not using basic auth
+	Action         string `json:"action,omitempty"`         // Defaults to read
+	Ttl            int    `json:"ttl,omitempty"`            // Seconds
+	MaxConnections *int   `json:"maxConnections,omitempty"` // Zero for unlimited, if allowed
+}
+
+type shareResponseBody struct {
+	Token          string            `json:"token"`
+	Path           string            `json:"path"`
+	Action         string            `json:"action"`
+	ExpiresAt      time.Time         `json:"expiresAt"`
+	MaxConnections *int              `json:"maxConnections"`
+	Urls           map[string]string `json:"urls"`
+}
+
+/*
+Values available to URL templates
+*/
+type shareUrlData struct {
+	Path   string
+	Action string
+	Token  string
+	Query  string
+}
+
+func (a ShareHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if a.Config.MaxTtl <= 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	request := shareRequestBody{}
+	if err := readJson(r, &request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	token, err := newShareToken(request, a.Config, time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// The caller must be allowed to publish the path they are sharing
+	allowed, err := a.checkPublisher(r, request)
+	if err != nil {
+		slog.Error("Error while validating publisher", "err", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if !allowed {
+		w.Header().Set("WWW-Authenticate", `Basic realm="share"`)
+		writeError(w, http.StatusUnauthorized, "invalid publish credentials")
+		return
+	}
+
+	created, err := a.Database.CreateToken(r.Context(), token)
+	if err != nil {
+		slog.Error("Error while creating shared token", "err", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	urls, err := a.urls(created)
+	if err != nil {
+		slog.Error("Error while building share URLs", "err", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	slog.Info("Shared stream", "id", created.Id, "path", created.Path, "action", created.Action, "token", logging.Token(created.QueryToken), "expires", created.ExpiresAt.UTC())
+	writeJson(w, http.StatusCreated, shareResponseBody{
+		Token:          created.QueryToken,
+		Path:           created.Path,
+		Action:         created.Action,
+		ExpiresAt:      created.ExpiresAt.UTC(),
+		MaxConnections: created.MaxConnections,
+		Urls:           urls,
+	})
+}
+
+/*
+Check the request has publish credentials for the path, accepting the same credentials as the auth endpoint: a bearer JWT,
+a signed or database token in the body, or username/password as basic auth
+*/
+func (a ShareHandler) checkPublisher(r *http.Request, request shareRequestBody) (bool, error) {
+	now := time.Now()
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && a.Jwt.Enabled() {
+		if _, err := a.Jwt.Validate(bearer, request.Path, "publish", now); err == nil {
+			return true, nil
+		}
+	}
+
+	ip := a.clientIp(r)
+	if len(request.Token) > 0 {
+		// Signed tokens are verified without the database
+		if a.Signer.Enabled() && a.Signer.Verify(request.Token, request.Path, "publish", ip, now) == nil {
+			return true, nil
+		}
+		valid, err := a.Database.CheckAuth(&database.Credentials{Action: "publish", Path: request.Path, QueryToken: request.Token}, ip)
+		if err != nil || valid {
+			return valid, err
+		}
+	}
+
+	if user, pass, ok := r.BasicAuth(); ok {
+		return a.Database.CheckUser(user, pass, request.Path, "publish")
+	}
+	return false, nil
+}
+
+/*
+Get the client address from the configured proxy header, or the connection address if not behind a proxy
+*/
+func (a ShareHandler) clientIp(r *http.Request) net.IP {
+	if len(a.Config.IpHeader) > 0 {
+		if header := r.Header.Get(a.Config.IpHeader); len(header) > 0 {
+			return forwardedIp(header, a.Config.TrustedHops)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+/*
+Build the access URLs for a token from the configured templates
+*/
+func (a ShareHandler) urls(token database.Token) (map[string]string, error) {
+	data := shareUrlData{
+		Path:   token.Path,
+		Action: token.Action,
+		Token:  token.QueryToken,
+		Query:  url.Values{a.QueryTokenKey: []string{token.QueryToken}}.Encode(),
+	}
+	urls := make(map[string]string, len(a.templates))
+	for name, tmpl := range a.templates {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			return nil, err
+		}
+		// Templates can leave out protocols which do not support the action
+		if b.Len() > 0 {
+			urls[name] = b.String()
+		}
+	}
+	return urls, nil
+}
+
+/*
+Validate a share request against the configured bounds and convert it to new credentials
+*/
+func newShareToken(request shareRequestBody, conf config.ShareConfig, now time.Time) (database.Token, error) {
+	if len(request.Path) == 0 {
+		return database.Token{}, errors.New("missing path")
+	}
+	action := request.Action
+	switch action {
+	case "":
+		action = "read"
+	case "read", "playback":
+	default:
+		return database.Token{}, fmt.Errorf("invalid action %v", action)
+	}
+
+	ttl := request.Ttl
+	if ttl == 0 {
+		ttl = min(conf.DefaultTtl, conf.MaxTtl)
+		if ttl <= 0 {
+			ttl = conf.MaxTtl
+		}
+	}
+	if ttl < 0 || ttl > conf.MaxTtl {
+		return database.Token{}, fmt.Errorf("ttl must be between 1 and %v", conf.MaxTtl)
+	}
+
+	maxConnections := conf.DefaultMaxConnections
+	if request.MaxConnections != nil {
+		maxConnections = *request.MaxConnections
+	}
+	if conf.MaxConnections > 0 {
+		if request.MaxConnections == nil && (maxConnections <= 0 || maxConnections > conf.MaxConnections) {
+			maxConnections = conf.MaxConnections
+		}
+		if maxConnections <= 0 || maxConnections > conf.MaxConnections {
+			return database.Token{}, fmt.Errorf("maxConnections must be between 1 and %v", conf.MaxConnections)
+		}
+	} else if maxConnections < 0 {
+		return database.Token{}, errors.New("maxConnections must not be negative")
+	}
+
+	expiresAt := now.Add(time.Duration(ttl) * time.Second)
+	token := database.Token{Path: request.Path, Action: action, ExpiresAt: &expiresAt}
+	if maxConnections > 0 {
+		token.MaxConnections = &maxConnections
+	}
+	return token, nil
+}
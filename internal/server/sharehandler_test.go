@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+	"github.com/pseudoresonance/authserver/internal/database"
+	"github.com/pseudoresonance/authserver/internal/signing"
+)
+
+func TestShareBadBody(t *testing.T) {
+	shareHandler := ShareHandler{Config: config.NewMainConfig().Share}
+	shareHandler.Init()
+	req, err := http.NewRequest("POST", "/share", bytes.NewBuffer([]byte(`{"path": "test", "action": "publish", "token": "abc"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	shareHandler.ServeHTTP(rr, req)
+	checkStatus(t, rr.Code, http.StatusBadRequest)
+}
+
+func TestShareBounds(t *testing.T) {
+	conf := config.NewMainConfig().Share
+	now := time.Now()
+	token, err := newShareToken(shareRequestBody{Path: "test"}, conf, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Action != "read" || !token.ExpiresAt.Equal(now.Add(time.Duration(conf.DefaultTtl)*time.Second)) ||
+		token.MaxConnections == nil || *token.MaxConnections != conf.DefaultMaxConnections {
+		t.Errorf("unexpected default token %+v", token)
+	}
+	if _, err := newShareToken(shareRequestBody{Path: "test", Ttl: conf.MaxTtl + 1}, conf, now); err == nil {
+		t.Error("accepted ttl above maximum")
+	}
+	unlimited := 0
+	if _, err := newShareToken(shareRequestBody{Path: "test", MaxConnections: &unlimited}, conf, now); err == nil {
+		t.Error("accepted unlimited connections")
+	}
+}
+
+func TestSharePublisher(t *testing.T) {
+	conf := config.NewMainConfig().Share
+	conf.IpHeader = "X-Forwarded-For"
+	conf.TrustedHops = 1
+	signer, err := signing.NewSigner(config.SigningConfig{Keys: []config.SigningKey{{Id: "test", Secret: "secret"}}, ActiveKey: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := newTestDatabase(t, database.Token{Path: "stream", Action: "publish", QueryToken: "publishtoken",
+		AllowedCidrs: []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}})
+	shareHandler := ShareHandler{QueryTokenKey: "token", Config: conf, Signer: signer, Database: db}
+	shareHandler.Init()
+	share := func(token string, forwardedFor string) int {
+		req := httptest.NewRequest("POST", "/share", bytes.NewBuffer([]byte(`{"path": "stream", "token": "`+token+`"}`)))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		rr := httptest.NewRecorder()
+		shareHandler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// IP restrictions are checked against the client behind the proxy
+	checkStatus(t, share("publishtoken", "203.0.113.5, 127.0.0.1"), http.StatusCreated)
+	checkStatus(t, share("publishtoken", "198.51.100.1"), http.StatusUnauthorized)
+	// Entries added by the client before the trusted proxies are ignored
+	checkStatus(t, share("publishtoken", "203.0.113.5, 198.51.100.1, 127.0.0.1"), http.StatusUnauthorized)
+
+	signed, err := signer.Sign(signing.Claims{Path: "stream", Action: "publish", Expires: time.Now().Add(time.Minute), Ip: net.ParseIP("198.51.100.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, share(signed, "198.51.100.1"), http.StatusCreated)
+	checkStatus(t, share(signed, "198.51.100.2"), http.StatusUnauthorized)
+}
+
+func TestShareUrls(t *testing.T) {
+	shareHandler := ShareHandler{QueryTokenKey: "token", Config: config.NewMainConfig().Share}
+	shareHandler.Init()
+	urls, err := shareHandler.urls(database.Token{Path: "stream", Action: "read", QueryToken: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target := "srt://localhost:8890?streamid=read:stream:::token=abc"; urls["srt"] != target {
+		t.Errorf("Wrong SRT URL: need (%v) got (%v)\n", target, urls["srt"])
+	}
+	// SRT cannot be used for playback
+	urls, err = shareHandler.urls(database.Token{Path: "stream", Action: "playback", QueryToken: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := urls["srt"]; ok || len(urls) != 3 {
+		t.Errorf("Wrong playback URLs: %v\n", urls)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pseudoresonance/authserver/internal/logging"
+	"github.com/pseudoresonance/authserver/internal/signing"
+)
+
+/*
+Create a signed token from the command line
+*/
+func signCommand(args []string) {
+	flags := flag.NewFlagSet("sign", flag.ExitOnError)
+	configPath := flags.String("c", "config.yaml", "path to YAML config file or directory")
+	path := flags.String("path", "", "MediaMTX path the token is valid for")
+	action := flags.String("action", "read", "action the token is valid for (read, publish, playback)")
+	ttl := flags.Int("ttl", 0, "token lifetime in seconds, defaults to the configured maximum")
+	ip := flags.String("ip", "", "optional client IP the token is bound to")
+	flags.Parse(args)
+
+	config := loadConfig(*configPath)
+	signer, err := signing.NewSigner(config.Signing)
+	if err != nil {
+		logging.Fatal("Error while loading signing keys", "err", err)
+	}
+	if !signer.Enabled() {
+		logging.Fatal("No signing keys configured")
+	}
+
+	claims, err := newSigningClaims(signRequestBody{Path: *path, Action: *action, Ttl: *ttl, Ip: *ip}, config.Signing.MaxTtl)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flags.Usage()
+		os.Exit(2)
+	}
+	token, err := signer.Sign(claims)
+	if err != nil {
+		logging.Fatal("Error while signing token", "err", err)
+	}
+	fmt.Println(token)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pseudoresonance/authserver/internal/logging"
+	"github.com/pseudoresonance/authserver/internal/signing"
+)
+
+/*
+Signs tokens for clients in apiIpRanges, checked against the connection address as forwarded headers cannot be trusted,
+so the endpoint must not be exposed through a reverse proxy
+*/
+type SignHandler struct {
+	ApiIps    []string
+	NetApiIps []net.IPNet
+
+	MaxTtl int
+	Signer *signing.Signer
+}
+
+func (a *SignHandler) Init() {
+	// Parse CIDR strings to Golang IPNets
+	a.NetApiIps = make([]net.IPNet, len(a.ApiIps))
+	for i, entry := range a.ApiIps {
+		_, cidr, err := net.ParseCIDR(entry)
+		if err != nil {
+			logging.Fatal("Invalid CIDR", "cidr", entry)
+		}
+		a.NetApiIps[i] = *cidr
+	}
+}
+
+type signRequestBody struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	Ttl    int    `json:"ttl,omitempty"` // Seconds, defaults to the maximum
+	Ip     string `json:"ip,omitempty"`
+}
+
+type signResponseBody struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (a SignHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !listContainsIp(a.NetApiIps, net.ParseIP(host)) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !a.Signer.Enabled() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Decode
+	request := signRequestBody{}
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	claims, err := newSigningClaims(request, a.MaxTtl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, err := a.Signer.Sign(claims)
+	if err != nil {
+		slog.Error("Error while signing token", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(signResponseBody{Token: token, ExpiresAt: claims.Expires.UTC()})
+}
+
+/*
+Validate a signing request and convert it to claims
+*/
+func newSigningClaims(request signRequestBody, maxTtl int) (signing.Claims, error) {
+	if len(request.Path) == 0 {
+		return signing.Claims{}, errors.New("missing path")
+	}
+	switch request.Action {
+	case "read", "publish", "playback":
+	default:
+		return signing.Claims{}, fmt.Errorf("invalid action %v", request.Action)
+	}
+	if request.Ttl < 0 || request.Ttl > maxTtl {
+		return signing.Claims{}, fmt.Errorf("ttl must be between 0 and %v", maxTtl)
+	}
+	ttl := request.Ttl
+	if ttl == 0 {
+		ttl = maxTtl
+	}
+	var ip net.IP
+	if len(request.Ip) > 0 {
+		if ip = net.ParseIP(request.Ip); ip == nil {
+			return signing.Claims{}, fmt.Errorf("invalid ip %v", request.Ip)
+		}
+	}
+	return signing.Claims{
+		Path:    request.Path,
+		Action:  request.Action,
+		Expires: time.Now().Add(time.Duration(ttl) * time.Second),
+		Ip:      ip,
+	}, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+	"github.com/pseudoresonance/authserver/internal/signing"
+)
+
+func TestSignRestricted(t *testing.T) {
+	signer, err := signing.NewSigner(config.SigningConfig{Keys: []config.SigningKey{{Id: "test", Secret: "secret"}}, ActiveKey: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signHandler := SignHandler{ApiIps: []string{"127.0.0.0/8"}, MaxTtl: 3600, Signer: signer}
+	signHandler.Init()
+	sign := func(remoteAddr string, forwardedFor string) int {
+		req := httptest.NewRequest("POST", "/sign", bytes.NewBuffer([]byte(`{"path": "stream", "action": "read"}`)))
+		req.RemoteAddr = remoteAddr
+		if len(forwardedFor) > 0 {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		rr := httptest.NewRecorder()
+		signHandler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	checkStatus(t, sign("127.0.0.1:1234", ""), http.StatusOK)
+	checkStatus(t, sign("203.0.113.5:1234", ""), http.StatusForbidden)
+	// Forwarded headers can be set by anyone, so are never trusted
+	checkStatus(t, sign("203.0.113.5:1234", "127.0.0.1"), http.StatusForbidden)
+}
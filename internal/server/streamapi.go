@@ -0,0 +1,15 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/pseudoresonance/authserver/internal/database"
+)
+
+type listStreamsResponseBody struct {
+	Streams []database.StreamState `json:"streams"`
+}
+
+func (a ApiHandler) listStreams(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, listStreamsResponseBody{Streams: a.Database.Streams()})
+}
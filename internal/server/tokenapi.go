@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/pseudoresonance/authserver/internal/database"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+type createTokenRequestBody struct {
+	Path           string         `json:"path"`
+	Action         string         `json:"action"`
+	Token          string         `json:"token,omitempty"` // Random if empty
+	ValidFrom      *time.Time     `json:"validFrom,omitempty"`
+	ExpiresAt      *time.Time     `json:"expiresAt,omitempty"`
+	MaxConnections *int           `json:"maxConnections,omitempty"`
+	MaxUses        *int           `json:"maxUses,omitempty"`
+	AllowedCidrs   []netip.Prefix `json:"allowedCidrs,omitempty"`
+	BindFirstIp    bool           `json:"bindFirstIp,omitempty"`
+}
+
+type listTokensResponseBody struct {
+	Tokens []database.Token `json:"tokens"`
+	Next   *int64           `json:"next,omitempty"` // Pass as after to get the next page
+}
+
+func (a ApiHandler) createToken(w http.ResponseWriter, r *http.Request) {
+	request := createTokenRequestBody{}
+	if err := readJson(r, &request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateTokenRequest(request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	token, err := a.Database.CreateToken(r.Context(), database.Token{
+		Path:           request.Path,
+		Action:         request.Action,
+		QueryToken:     request.Token,
+		ValidFrom:      request.ValidFrom,
+		ExpiresAt:      request.ExpiresAt,
+		MaxConnections: request.MaxConnections,
+		MaxUses:        request.MaxUses,
+		AllowedCidrs:   request.AllowedCidrs,
+		BindFirstIp:    request.BindFirstIp,
+	})
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	writeJson(w, http.StatusCreated, token)
+}
+
+func (a ApiHandler) listTokens(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := database.TokenFilter{Path: query.Get("path"), Action: query.Get("action"), Limit: defaultPageSize}
+	var err error
+	if after := query.Get("after"); len(after) > 0 {
+		if filter.After, err = strconv.ParseInt(after, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid after")
+			return
+		}
+	}
+	if limit := query.Get("limit"); len(limit) > 0 {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit <= 0 || filter.Limit > maxPageSize {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %v", maxPageSize))
+			return
+		}
+	}
+	if active := query.Get("active"); len(active) > 0 {
+		parsed, err := strconv.ParseBool(active)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid active")
+			return
+		}
+		filter.Active = &parsed
+	}
+
+	tokens, err := a.Database.ListTokens(r.Context(), filter)
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	response := listTokensResponseBody{Tokens: tokens}
+	if len(tokens) == filter.Limit {
+		response.Next = &tokens[len(tokens)-1].Id
+	}
+	writeJson(w, http.StatusOK, response)
+}
+
+func (a ApiHandler) getToken(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathId(w, r)
+	if !ok {
+		return
+	}
+	token, err := a.Database.GetToken(r.Context(), id)
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, token)
+}
+
+func (a ApiHandler) updateToken(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathId(w, r)
+	if !ok {
+		return
+	}
+	update := database.TokenUpdate{}
+	if err := readJson(r, &update); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Validated as a whole, so a change to one end of the validity window is checked against the stored other end
+	stored, err := a.Database.GetToken(r.Context(), id)
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	if err := validateTokenRequest(mergeTokenUpdate(stored, update)); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	token, err := a.Database.UpdateToken(r.Context(), id, update)
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, token)
+}
+
+func (a ApiHandler) revokeToken(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathId(w, r)
+	if !ok {
+		return
+	}
+	token, err := a.Database.RevokeToken(r.Context(), id)
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, token)
+}
+
+func validateTokenRequest(request createTokenRequestBody) error {
+	if len(request.Path) == 0 {
+		return errors.New("missing path")
+	}
+	switch request.Action {
+	case "read", "publish", "playback":
+	default:
+		return fmt.Errorf("invalid action %v", request.Action)
+	}
+	if request.ValidFrom != nil && request.ExpiresAt != nil && !request.ExpiresAt.After(*request.ValidFrom) {
+		return errors.New("expiresAt must be after validFrom")
+	}
+	return validateLimits(request.MaxConnections, request.MaxUses)
+}
+
+/*
+Stored credentials with the validated fields of an update applied, in the form validated on creation
+*/
+func mergeTokenUpdate(token database.Token, update database.TokenUpdate) createTokenRequestBody {
+	return createTokenRequestBody{
+		Path:           token.Path,
+		Action:         token.Action,
+		ValidFrom:      mergeOptional(token.ValidFrom, update.ValidFrom),
+		ExpiresAt:      mergeOptional(token.ExpiresAt, update.ExpiresAt),
+		MaxConnections: mergeOptional(token.MaxConnections, update.MaxConnections),
+		MaxUses:        mergeOptional(token.MaxUses, update.MaxUses),
+	}
+}
+
+func mergeOptional[T any](stored *T, update database.Optional[T]) *T {
+	if update.Set {
+		return update.Value
+	}
+	return stored
+}
+
+func validateLimits(maxConnections *int, maxUses *int) error {
+	if maxConnections != nil && *maxConnections <= 0 {
+		return errors.New("maxConnections must be positive")
+	}
+	if maxUses != nil && *maxUses <= 0 {
+		return errors.New("maxUses must be positive")
+	}
+	return nil
+}
+
+func pathId(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return 0, false
+	}
+	return id, true
+}
+
+func writeDatabaseError(w http.ResponseWriter, err error) {
+	if errors.Is(err, database.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if errors.Is(err, database.ErrNotSupported) {
+		writeError(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	slog.Error("Error while querying database", "err", err)
+	writeError(w, http.StatusInternalServerError, "database error")
+}
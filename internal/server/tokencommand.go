@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+	"github.com/pseudoresonance/authserver/internal/database"
+	"github.com/pseudoresonance/authserver/internal/logging"
+)
+
+const tokenUsage = `Usage: token <command> [flags]
+
+Commands:
+  create    Create credentials
+  list      List credentials
+  show      Show credentials by ID
+  revoke    Revoke credentials by ID, kicking all connections using them
+`
+
+/*
+Manage credentials in stream_auth from the command line
+*/
+func tokenCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, tokenUsage)
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "create":
+		tokenCreateCommand(args[1:])
+	case "list":
+		tokenListCommand(args[1:])
+	case "show":
+		tokenIdCommand("show", args[1:], func(db *database.DatabaseManager, id int64) (database.Token, error) {
+			return db.GetToken(context.Background(), id)
+		})
+	case "revoke":
+		tokenIdCommand("revoke", args[1:], func(db *database.DatabaseManager, id int64) (database.Token, error) {
+			return db.RevokeToken(context.Background(), id)
+		})
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown token command %v\n\n%v", args[0], tokenUsage)
+		os.Exit(2)
+	}
+}
+
+/*
+Exit after a command line could not be parsed, successfully if only help was asked for
+*/
+func exitUsage(err error) {
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	os.Exit(2)
+}
+
+/*
+Parsed flags of the token create command
+*/
+type tokenCreateOptions struct {
+	configPath string
+	jsonOutput bool
+	request    createTokenRequestBody
+}
+
+/*
+Parse and validate the flags of the token create command, writing errors and usage to output
+*/
+func parseTokenCreate(args []string, output io.Writer, now time.Time) (tokenCreateOptions, error) {
+	var opts tokenCreateOptions
+	flags := flag.NewFlagSet("token create", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(&opts.configPath, "c", "config.yaml", "path to YAML config file or directory")
+	flags.BoolVar(&opts.jsonOutput, "json", false, "print JSON instead of a table")
+	path := flags.String("path", "", "MediaMTX path the credentials are valid for")
+	action := flags.String("action", "read", "action the credentials are valid for (read, publish, playback)")
+	token := flags.String("token", "", "query token, random if empty")
+	ttl := flags.Int("ttl", 0, "lifetime in seconds, never expires if 0")
+	validFrom := flags.String("valid-from", "", "optional RFC 3339 time the credentials become valid")
+	expiresAt := flags.String("expires", "", "optional RFC 3339 time the credentials expire, instead of -ttl")
+	maxConnections := flags.Int("max-connections", 0, "maximum concurrent connections, unlimited if 0")
+	maxUses := flags.Int("max-uses", 0, "maximum number of clients, unlimited if 0")
+	allowedCidrs := flags.String("allowed-cidrs", "", "optional comma separated CIDRs allowed to use the credentials")
+	bindFirstIp := flags.Bool("bind-first-ip", false, "lock the credentials to the address of the first client")
+	if err := flags.Parse(args); err != nil {
+		return opts, err
+	}
+
+	request := createTokenRequestBody{Path: *path, Action: *action, Token: *token, BindFirstIp: *bindFirstIp}
+	err := func() error {
+		if len(*validFrom) > 0 {
+			parsed, err := time.Parse(time.RFC3339, *validFrom)
+			if err != nil {
+				return fmt.Errorf("invalid valid-from %v", *validFrom)
+			}
+			request.ValidFrom = &parsed
+		}
+		if len(*expiresAt) > 0 && *ttl != 0 {
+			return errors.New("only one of expires and ttl can be given")
+		}
+		if len(*expiresAt) > 0 {
+			parsed, err := time.Parse(time.RFC3339, *expiresAt)
+			if err != nil {
+				return fmt.Errorf("invalid expires %v", *expiresAt)
+			}
+			request.ExpiresAt = &parsed
+		} else if *ttl < 0 {
+			return errors.New("ttl must not be negative")
+		} else if *ttl > 0 {
+			expires := now.Add(time.Duration(*ttl) * time.Second)
+			if request.ValidFrom != nil {
+				expires = request.ValidFrom.Add(time.Duration(*ttl) * time.Second)
+			}
+			request.ExpiresAt = &expires
+		}
+		if *maxConnections != 0 {
+			request.MaxConnections = maxConnections
+		}
+		if *maxUses != 0 {
+			request.MaxUses = maxUses
+		}
+		for _, entry := range strings.Split(*allowedCidrs, ",") {
+			if entry = strings.TrimSpace(entry); len(entry) == 0 {
+				continue
+			}
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return fmt.Errorf("invalid CIDR %v", entry)
+			}
+			request.AllowedCidrs = append(request.AllowedCidrs, prefix)
+		}
+		return validateTokenRequest(request)
+	}()
+	if err != nil {
+		fmt.Fprintln(output, err)
+		flags.Usage()
+		return opts, err
+	}
+	opts.request = request
+	return opts, nil
+}
+
+func tokenCreateCommand(args []string) {
+	opts, err := parseTokenCreate(args, os.Stderr, time.Now())
+	if err != nil {
+		exitUsage(err)
+	}
+	request := opts.request
+
+	db := openDatabase(loadConfig(opts.configPath))
+	defer db.Close()
+	created, err := db.CreateToken(context.Background(), database.Token{
+		Path:           request.Path,
+		Action:         request.Action,
+		QueryToken:     request.Token,
+		ValidFrom:      request.ValidFrom,
+		ExpiresAt:      request.ExpiresAt,
+		MaxConnections: request.MaxConnections,
+		MaxUses:        request.MaxUses,
+		AllowedCidrs:   request.AllowedCidrs,
+		BindFirstIp:    request.BindFirstIp,
+	})
+	if err != nil {
+		logging.Fatal("Error while creating credentials", "err", err)
+	}
+	printTokens([]database.Token{created}, opts.jsonOutput, false)
+}
+
+/*
+Parsed flags of the token list command
+*/
+type tokenListOptions struct {
+	configPath string
+	jsonOutput bool
+	limit      int
+	filter     database.TokenFilter
+}
+
+/*
+Parse and validate the flags of the token list command, writing errors and usage to output
+*/
+func parseTokenList(args []string, output io.Writer) (tokenListOptions, error) {
+	var opts tokenListOptions
+	flags := flag.NewFlagSet("token list", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(&opts.configPath, "c", "config.yaml", "path to YAML config file or directory")
+	flags.BoolVar(&opts.jsonOutput, "json", false, "print JSON instead of a table")
+	flags.StringVar(&opts.filter.Path, "path", "", "only list credentials for this path")
+	flags.StringVar(&opts.filter.Action, "action", "", "only list credentials for this action")
+	active := flags.String("active", "", "only list credentials which are (true) or are not (false) currently usable")
+	flags.IntVar(&opts.limit, "limit", 0, "maximum number of credentials to list, all if 0")
+	flags.Int64Var(&opts.filter.After, "after", 0, "only list credentials with IDs after this")
+	if err := flags.Parse(args); err != nil {
+		return opts, err
+	}
+
+	err := func() error {
+		if len(*active) > 0 {
+			parsed, err := strconv.ParseBool(*active)
+			if err != nil {
+				return fmt.Errorf("invalid active %v", *active)
+			}
+			opts.filter.Active = &parsed
+		}
+		if opts.limit < 0 {
+			return errors.New("limit must not be negative")
+		}
+		return nil
+	}()
+	if err != nil {
+		fmt.Fprintln(output, err)
+		flags.Usage()
+	}
+	return opts, err
+}
+
+func tokenListCommand(args []string) {
+	opts, err := parseTokenList(args, os.Stderr)
+	if err != nil {
+		exitUsage(err)
+	}
+	filter := opts.filter
+
+	db := openDatabase(loadConfig(opts.configPath))
+	defer db.Close()
+	tokens := []database.Token{}
+	for opts.limit == 0 || len(tokens) < opts.limit {
+		filter.Limit = maxPageSize
+		if opts.limit > 0 {
+			filter.Limit = min(maxPageSize, opts.limit-len(tokens))
+		}
+		page, err := db.ListTokens(context.Background(), filter)
+		if err != nil {
+			logging.Fatal("Error while listing credentials", "err", err)
+		}
+		tokens = append(tokens, page...)
+		if len(page) < filter.Limit {
+			break
+		}
+		filter.After = page[len(page)-1].Id
+	}
+	printTokens(tokens, opts.jsonOutput, true)
+}
+
+/*
+Parsed flags of a command on a single set of credentials
+*/
+type tokenIdOptions struct {
+	configPath string
+	jsonOutput bool
+	id         int64
+}
+
+/*
+Parse the flags and ID of a command on a single set of credentials, writing errors and usage to output
+*/
+func parseTokenId(name string, args []string, output io.Writer) (tokenIdOptions, error) {
+	var opts tokenIdOptions
+	flags := flag.NewFlagSet("token "+name, flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(&opts.configPath, "c", "config.yaml", "path to YAML config file or directory")
+	flags.BoolVar(&opts.jsonOutput, "json", false, "print JSON instead of a table")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: token %v [flags] <id>\n", name)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return opts, err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return opts, errors.New("exactly one id must be given")
+	}
+	var err error
+	if opts.id, err = strconv.ParseInt(flags.Arg(0), 10, 64); err != nil {
+		err = fmt.Errorf("invalid id %v", flags.Arg(0))
+		fmt.Fprintln(output, err)
+	}
+	return opts, err
+}
+
+/*
+Run a command on a single set of credentials given by ID
+*/
+func tokenIdCommand(name string, args []string, fn func(db *database.DatabaseManager, id int64) (database.Token, error)) {
+	opts, err := parseTokenId(name, args, os.Stderr)
+	if err != nil {
+		exitUsage(err)
+	}
+
+	db := openDatabase(loadConfig(opts.configPath))
+	defer db.Close()
+	token, err := fn(db, opts.id)
+	if errors.Is(err, database.ErrNotFound) {
+		fmt.Fprintf(os.Stderr, "Credentials %v not found\n", opts.id)
+		db.Close()
+		os.Exit(1)
+	}
+	if err != nil {
+		logging.Fatal("Error while querying database", "err", err)
+	}
+	printTokens([]database.Token{token}, opts.jsonOutput, false)
+}
+
+/*
+Connect to the database for a command, without starting the cache or change detection
+*/
+func openDatabase(conf *config.MainConfig) *database.DatabaseManager {
+	db := &database.DatabaseManager{}
+	if err := db.Open(conf); err != nil {
+		logging.Fatal("Error opening credential store", "err", err)
+	}
+	return db
+}
+
+/*
+Print credentials as a table, or as JSON (a list if requested, otherwise a single object)
+*/
+func printTokens(tokens []database.Token, jsonOutput bool, list bool) {
+	if jsonOutput {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		if list {
+			e.Encode(tokens)
+		} else if len(tokens) > 0 {
+			e.Encode(tokens[0])
+		}
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPATH\tACTION\tTOKEN\tVALID FROM\tEXPIRES\tREVOKED\tCONNECTIONS\tUSES\tIP")
+	for _, t := range tokens {
+		uses := strconv.Itoa(t.UseCount)
+		if t.MaxUses != nil {
+			uses += "/" + strconv.Itoa(*t.MaxUses)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", t.Id, t.Path, t.Action, t.QueryToken,
+			formatTime(t.ValidFrom), formatTime(t.ExpiresAt), formatTime(t.RevokedAt), formatInt(t.MaxConnections), uses, formatIp(t))
+	}
+	w.Flush()
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func formatInt(i *int) string {
+	if i == nil {
+		return "-"
+	}
+	return strconv.Itoa(*i)
+}
+
+func formatIp(t database.Token) string {
+	parts := []string{}
+	for _, cidr := range t.AllowedCidrs {
+		parts = append(parts, cidr.String())
+	}
+	if t.BoundIp != nil {
+		parts = append(parts, "bound "+t.BoundIp.String())
+	} else if t.BindFirstIp {
+		parts = append(parts, "bind first")
+	}
+	if len(parts) == 0 {
+		return "-"
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"net/netip"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseTokenCreate(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	hourLater := now.Add(time.Hour)
+	dayLater := now.Add(24 * time.Hour)
+	for _, c := range []struct {
+		args      []string
+		valid     bool
+		expiresAt *time.Time
+		cidrs     []netip.Prefix
+	}{
+		{[]string{"-path", "camera"}, true, nil, nil},
+		{[]string{}, false, nil, nil},
+		{[]string{"-path", "camera", "-action", "delete"}, false, nil, nil},
+		{[]string{"-path", "camera", "-unknown"}, false, nil, nil},
+		{[]string{"-path", "camera", "-ttl", "3600"}, true, &hourLater, nil},
+		// The lifetime starts when the credentials become valid
+		{[]string{"-path", "camera", "-ttl", "3600", "-valid-from", "2026-01-01T23:00:00Z"}, true, &dayLater, nil},
+		{[]string{"-path", "camera", "-ttl", "-1"}, false, nil, nil},
+		{[]string{"-path", "camera", "-expires", "2026-01-02T00:00:00Z"}, true, &dayLater, nil},
+		{[]string{"-path", "camera", "-expires", "tomorrow"}, false, nil, nil},
+		{[]string{"-path", "camera", "-valid-from", "today"}, false, nil, nil},
+		{[]string{"-path", "camera", "-ttl", "3600", "-expires", "2026-01-02T00:00:00Z"}, false, nil, nil},
+		{[]string{"-path", "camera", "-valid-from", "2026-01-02T00:00:00Z", "-expires", "2026-01-01T00:00:00Z"}, false, nil, nil},
+		{[]string{"-path", "camera", "-max-connections", "-1"}, false, nil, nil},
+		{[]string{"-path", "camera", "-allowed-cidrs", "10.0.0.0/8, 2001:db8::/32,"}, true, nil,
+			[]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}},
+		{[]string{"-path", "camera", "-allowed-cidrs", "10.0.0.0"}, false, nil, nil},
+		{[]string{"-path", "camera", "-allowed-cidrs", "10.0.0.0/33"}, false, nil, nil},
+	} {
+		opts, err := parseTokenCreate(c.args, io.Discard, now)
+		if (err == nil) != c.valid {
+			t.Errorf("Wrong result for %v: need valid (%v) got (%v)\n", c.args, c.valid, err)
+			continue
+		}
+		if !c.valid {
+			continue
+		}
+		if c.expiresAt != nil && (opts.request.ExpiresAt == nil || !opts.request.ExpiresAt.Equal(*c.expiresAt)) {
+			t.Errorf("Wrong expiry for %v: need (%v) got (%v)\n", c.args, c.expiresAt, opts.request.ExpiresAt)
+		}
+		if c.expiresAt == nil && opts.request.ExpiresAt != nil {
+			t.Errorf("Wrong expiry for %v: need (%v) got (%v)\n", c.args, nil, opts.request.ExpiresAt)
+		}
+		if !slices.Equal(opts.request.AllowedCidrs, c.cidrs) {
+			t.Errorf("Wrong CIDRs for %v: need (%v) got (%v)\n", c.args, c.cidrs, opts.request.AllowedCidrs)
+		}
+	}
+}
+
+func TestParseTokenCreateDefaults(t *testing.T) {
+	opts, err := parseTokenCreate([]string{"-path", "camera", "-c", "conf", "-json", "-max-uses", "3", "-bind-first-ip"}, io.Discard, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.configPath != "conf" || !opts.jsonOutput {
+		t.Errorf("Wrong options: need (%v, %v) got (%v, %v)\n", "conf", true, opts.configPath, opts.jsonOutput)
+	}
+	request := opts.request
+	if request.Action != "read" || len(request.Token) != 0 || request.MaxConnections != nil || request.MaxUses == nil || *request.MaxUses != 3 || !request.BindFirstIp {
+		t.Errorf("Wrong request: %+v\n", request)
+	}
+}
+
+func TestParseTokenList(t *testing.T) {
+	for _, c := range []struct {
+		args   []string
+		valid  bool
+		active string // Empty if unfiltered
+	}{
+		{[]string{}, true, ""},
+		{[]string{"-active", "true"}, true, "true"},
+		{[]string{"-active", "false"}, true, "false"},
+		{[]string{"-active", "sometimes"}, false, ""},
+		{[]string{"-limit", "-1"}, false, ""},
+		{[]string{"-after", "many"}, false, ""},
+	} {
+		opts, err := parseTokenList(c.args, io.Discard)
+		if (err == nil) != c.valid {
+			t.Errorf("Wrong result for %v: need valid (%v) got (%v)\n", c.args, c.valid, err)
+			continue
+		}
+		active := ""
+		if opts.filter.Active != nil {
+			active = strconv.FormatBool(*opts.filter.Active)
+		}
+		if c.valid && active != c.active {
+			t.Errorf("Wrong active filter for %v: need (%v) got (%v)\n", c.args, c.active, active)
+		}
+	}
+}
+
+func TestParseTokenId(t *testing.T) {
+	for _, c := range []struct {
+		args  []string
+		valid bool
+		id    int64
+	}{
+		{[]string{"12"}, true, 12},
+		{[]string{"-json", "12"}, true, 12},
+		{[]string{}, false, 0},
+		{[]string{"12", "13"}, false, 0},
+		{[]string{"twelve"}, false, 0},
+	} {
+		opts, err := parseTokenId("show", c.args, io.Discard)
+		if (err == nil) != c.valid {
+			t.Errorf("Wrong result for %v: need valid (%v) got (%v)\n", c.args, c.valid, err)
+			continue
+		}
+		if c.valid && opts.id != c.id {
+			t.Errorf("Wrong id for %v: need (%v) got (%v)\n", c.args, c.id, opts.id)
+		}
+	}
+
+	// Help is not an error to exit with
+	if _, err := parseTokenId("show", []string{"-h"}, io.Discard); !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("Wrong error: need (%v) got (%v)\n", flag.ErrHelp, err)
+	}
+}
@@ -0,0 +1,158 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+)
+
+const (
+	tokenVersion   = "v1"
+	tokenSeparator = "."
+)
+
+var (
+	ErrMalformed  = errors.New("malformed signed token")
+	ErrUnknownKey = errors.New("unknown signing key")
+	ErrSignature  = errors.New("invalid signature")
+	ErrExpired    = errors.New("signed token expired")
+	ErrIp         = errors.New("signed token not valid for this IP")
+)
+
+/*
+Details covered by a signature
+*/
+type Claims struct {
+	Path    string
+	Action  string
+	Expires time.Time
+	Ip      net.IP // Optional, the token is only valid from this IP if set
+}
+
+/*
+Signs and verifies stateless access tokens with HMAC-SHA256
+
+Tokens have the form v1.<key id>.<expiry unix seconds>.<base64 IP>.<base64 signature>
+*/
+type Signer struct {
+	keys      map[string][]byte
+	activeKey string
+}
+
+func NewSigner(conf config.SigningConfig) (*Signer, error) {
+	s := &Signer{keys: make(map[string][]byte, len(conf.Keys)), activeKey: conf.ActiveKey}
+	for _, key := range conf.Keys {
+		if len(key.Id) == 0 || strings.Contains(key.Id, tokenSeparator) {
+			return nil, fmt.Errorf("invalid signing key id %q", key.Id)
+		}
+		if len(key.Secret) == 0 {
+			return nil, fmt.Errorf("empty secret for signing key %v", key.Id)
+		}
+		if _, exists := s.keys[key.Id]; exists {
+			return nil, fmt.Errorf("duplicate signing key id %v", key.Id)
+		}
+		s.keys[key.Id] = []byte(key.Secret)
+	}
+	if len(s.activeKey) == 0 && len(conf.Keys) > 0 {
+		s.activeKey = conf.Keys[0].Id
+	}
+	if _, exists := s.keys[s.activeKey]; len(s.activeKey) > 0 && !exists {
+		return nil, fmt.Errorf("active signing key %v is not configured", s.activeKey)
+	}
+	return s, nil
+}
+
+/*
+Check if any keys are configured
+*/
+func (s *Signer) Enabled() bool {
+	return s != nil && len(s.keys) > 0
+}
+
+/*
+Create a signed token with the active key
+*/
+func (s *Signer) Sign(claims Claims) (string, error) {
+	if !s.Enabled() {
+		return "", ErrUnknownKey
+	}
+	expires := strconv.FormatInt(claims.Expires.Unix(), 10)
+	ip := encodeIp(claims.Ip)
+	sig := s.signature(s.keys[s.activeKey], s.activeKey, claims.Path, claims.Action, expires, ip)
+	return strings.Join([]string{tokenVersion, s.activeKey, expires, ip, sig}, tokenSeparator), nil
+}
+
+/*
+Verify a signed token is valid for the given path, action and IP at the given time
+*/
+func (s *Signer) Verify(token string, path string, action string, ip net.IP, now time.Time) error {
+	if !s.Enabled() {
+		return ErrUnknownKey
+	}
+	parts := strings.Split(token, tokenSeparator)
+	if len(parts) != 5 || parts[0] != tokenVersion {
+		return ErrMalformed
+	}
+	keyId, expires, encodedIp, sig := parts[1], parts[2], parts[3], parts[4]
+	secret, exists := s.keys[keyId]
+	if !exists {
+		return ErrUnknownKey
+	}
+	if !hmac.Equal([]byte(sig), []byte(s.signature(secret, keyId, path, action, expires, encodedIp))) {
+		return ErrSignature
+	}
+
+	// Only trust the contents after the signature has been checked
+	expiresUnix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrMalformed
+	}
+	if !now.Before(time.Unix(expiresUnix, 0)) {
+		return ErrExpired
+	}
+	if len(encodedIp) > 0 {
+		boundIp, err := decodeIp(encodedIp)
+		if err != nil {
+			return ErrMalformed
+		}
+		if !boundIp.Equal(ip) {
+			return ErrIp
+		}
+	}
+	return nil
+}
+
+func (s *Signer) signature(secret []byte, keyId string, path string, action string, expires string, ip string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{tokenVersion, keyId, path, action, expires, ip}, "\x00")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func encodeIp(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return base64.RawURLEncoding.EncodeToString(ip)
+}
+
+func decodeIp(encoded string) (net.IP, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != net.IPv4len && len(raw) != net.IPv6len {
+		return nil, ErrMalformed
+	}
+	return net.IP(raw), nil
+}
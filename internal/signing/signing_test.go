@@ -0,0 +1,83 @@
+package signing
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pseudoresonance/authserver/internal/config"
+)
+
+func newTestSigner(t *testing.T, activeKey string) *Signer {
+	signer, err := NewSigner(config.SigningConfig{
+		Keys: []config.SigningKey{
+			{Id: "old", Secret: "old secret"},
+			{Id: "new", Secret: "new secret"},
+		},
+		ActiveKey: activeKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func checkErr(t *testing.T, test error, target error) {
+	if !errors.Is(test, target) {
+		t.Errorf("Wrong error: need (%v) got (%v)\n", target, test)
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	signer := newTestSigner(t, "new")
+	now := time.Now()
+	token, err := signer.Sign(Claims{Path: "stream", Action: "read", Expires: now.Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkErr(t, signer.Verify(token, "stream", "read", net.ParseIP("203.0.113.5"), now), nil)
+	checkErr(t, signer.Verify(token, "other", "read", nil, now), ErrSignature)
+	checkErr(t, signer.Verify(token, "stream", "publish", nil, now), ErrSignature)
+	checkErr(t, signer.Verify(token, "stream", "read", nil, now.Add(time.Minute)), ErrExpired)
+	checkErr(t, signer.Verify(token+"a", "stream", "read", nil, now), ErrSignature)
+	checkErr(t, signer.Verify("not a signed token", "stream", "read", nil, now), ErrMalformed)
+}
+
+func TestSignIp(t *testing.T) {
+	signer := newTestSigner(t, "new")
+	now := time.Now()
+	token, err := signer.Sign(Claims{Path: "stream", Action: "read", Expires: now.Add(time.Minute), Ip: net.ParseIP("203.0.113.5")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkErr(t, signer.Verify(token, "stream", "read", net.ParseIP("203.0.113.5"), now), nil)
+	checkErr(t, signer.Verify(token, "stream", "read", net.ParseIP("::ffff:203.0.113.5"), now), nil)
+	checkErr(t, signer.Verify(token, "stream", "read", net.ParseIP("203.0.113.6"), now), ErrIp)
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldSigner := newTestSigner(t, "old")
+	now := time.Now()
+	token, err := oldSigner.Sign(Claims{Path: "stream", Action: "read", Expires: now.Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tokens from the previous key are still accepted while it is configured
+	checkErr(t, newTestSigner(t, "new").Verify(token, "stream", "read", nil, now), nil)
+
+	removed, err := NewSigner(config.SigningConfig{Keys: []config.SigningKey{{Id: "new", Secret: "new secret"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkErr(t, removed.Verify(token, "stream", "read", nil, now), ErrUnknownKey)
+}
+
+func TestInvalidKeys(t *testing.T) {
+	if _, err := NewSigner(config.SigningConfig{Keys: []config.SigningKey{{Id: "a.b", Secret: "secret"}}}); err == nil {
+		t.Error("Key ID containing separator accepted")
+	}
+	if _, err := NewSigner(config.SigningConfig{Keys: []config.SigningKey{{Id: "a", Secret: "secret"}}, ActiveKey: "b"}); err == nil {
+		t.Error("Missing active key accepted")
+	}
+}